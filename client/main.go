@@ -2,9 +2,14 @@ package main
 
 import (
 	client "TFTP/client/package"
+	"TFTP/logging"
 	"TFTP/packets"
+	"TFTP/throttle"
 	"flag"
-	"log"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
 	"time"
 )
 
@@ -13,6 +18,13 @@ var (
 	compress = flag.Bool("c", false, "Compress payload")
 	mode     = flag.String("m", "octet", "Transfer mode")
 	serverIP = flag.String("s", "127.0.0.1:69", "Server address")
+	resume   = flag.Bool("resume", false, "Resume a partial transfer instead of starting from scratch")
+	parallel = flag.Int("j", client.DEFAULT_PARALLELISM, "Number of concurrent transfers of a batch")
+	retries  = flag.Int("retries", client.DEFAULT_RETRIES, "Number of times a failed transfer of a batch is retried")
+	tree     = flag.Bool("r", false, "Transfer a directory tree recursively")
+
+	blockSize  = flag.Int("blksize", 0, "Block size to ask the server for, 512 bytes when 0 (RFC 2348)")
+	windowSize = flag.Int("windowsize", 0, "Blocks sent before waiting for an ACK to ask the server for, 1 when 0 (RFC 7440)")
 )
 
 const (
@@ -23,47 +35,278 @@ const (
 	opcodeERROR = 5
 )
 
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [get [host remote|tftp://host/remote [local|-]]|put [host local|- [remote]|local|- tftp://host/remote]|batch manifest|ls [dir]]\n", flag.CommandLine.Name())
+	flag.PrintDefaults()
+}
+
+// fatal logs an error and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
 func main() {
+	var (
+		limitRate throttle.Rate
+		logConfig logging.Config
+	)
+	flag.Var(&limitRate, "limit-rate", "Bandwidth of a transfer in bytes per second, e.g. 500k or 2m, no limit by default")
+	logConfig.RegisterFlags(flag.CommandLine)
+	flag.Usage = usage
 	flag.Parse()
-	transferSuccessful := make(chan bool)
-
-	// Create RRQ packet
-	// rrq := packets.ReadRequest{
-	// 	FileName: *filename,
-	// 	Mode:     *mode,
-	// 	Compress: *compress,
-	// }
+	// the logs go to stderr, stdout may carry a downloaded file
+	slog.SetDefault(logConfig.New(os.Stderr))
+	transferSuccessful := make(chan bool, 1)
 
-	// Create WRQ packet
-	wrq := packets.WriteRequest{
-		FileName: *filename,
-		Mode:     *mode,
-		Compress: *compress,
+	// put is the default, that is what the client always did
+	command := flag.Arg(0)
+	if command == "" {
+		command = "put"
 	}
 
-	// localConn, err := client.SendRequest(rrq, serverIP)
-	// if err != nil {
-	// 	log.Fatalf("Error sending RRQ: %v", err)
-	// 	return
-	// }
+	timeout := client.DEFAULT_TIMEOUT
 
-	localConn, err := client.SendRequest(wrq, serverIP)
+	// positional arguments take precedence over -s and -p:
+	// get host remote [local], put host local [remote], where "-" stands for stdin / stdout
+	var args []string
+	if flag.NArg() > 1 {
+		args = flag.Args()[1:]
+	}
+	args, err := expandURL(command, args)
 	if err != nil {
-		log.Fatalf("Error sending WRQ: %v", err)
-		return
+		fatal("invalid URL", "error", err)
+	}
+	if (command == "get" || command == "put") && (len(args) == 1 || len(args) > 3) {
+		usage()
+		os.Exit(2)
 	}
 
-	// Create handler
-	timeout := 10 * time.Second
-	handler := client.NewHandler(localConn, timeout)
-	// go handler.HandleReadRequest(filename, transferSuccessful)
-	go handler.HandleWriteRequest(filename, transferSuccessful)
+	switch command {
+	case "get":
+		remote := *filename
+		if len(args) >= 2 {
+			*serverIP, remote = args[0], args[1]
+		}
+		local := client.OutputFileName(remote)
+		if len(args) == 3 {
+			local = args[2]
+		}
+
+		if *tree {
+			results, err := newBatch(timeout).GetTree(remote, local)
+			os.Exit(report(results, err))
+		}
+
+		// Create RRQ packet
+		rrq := packets.ReadRequest{
+			FileName: remote,
+			Mode:     *mode,
+			Compress: *compress,
+		}
+
+		// ask the server to skip what we already have
+		if *resume {
+			if local == "-" {
+				fatal("cannot resume a download to stdout")
+			}
+			offset, err := client.ResumeOffset(local)
+			if err != nil {
+				fatal("inspecting the partial file failed", "local", local, "error", err)
+			}
+			rrq.Options = map[string]string{packets.OptOffset: strconv.FormatInt(offset, 10)}
+		}
+		rrq.Options = withTransferOptions(rrq.Options)
+
+		localConn, err := client.SendRequest(rrq, serverIP)
+		if err != nil {
+			fatal("sending the RRQ failed", "error", err)
+		}
+
+		handler := client.NewHandler(localConn, timeout)
+		handler.Logger = client.RequestLogger(rrq, *serverIP)
+		if limitRate > 0 {
+			handler.Limit = throttle.NewBucket(int64(limitRate), 0)
+		}
+		handler.Resume = *resume
+		if local == "-" {
+			err = handler.ReadTo(os.Stdout)
+			if err == nil {
+				transferSuccessful <- true
+			}
+		} else {
+			handler.Local = local
+			err = handler.HandleReadRequest(&remote, transferSuccessful)
+		}
+		if err != nil {
+			fatal("transfer failed", "error", err)
+		}
+
+	case "put":
+		local := *filename
+		if len(args) >= 2 {
+			*serverIP, local = args[0], args[1]
+		}
+		remote := local
+		if len(args) == 3 {
+			remote = args[2]
+		}
+
+		if remote == "-" {
+			fatal("a remote name is required when uploading from stdin")
+		}
+
+		if *tree {
+			results, err := newBatch(timeout).PutTree(local, remote)
+			os.Exit(report(results, err))
+		}
+
+		// Create WRQ packet
+		wrq := packets.WriteRequest{
+			FileName: remote,
+			Mode:     *mode,
+			Compress: *compress,
+		}
+
+		// the server answers with the offset it wants us to continue from
+		if *resume {
+			wrq.Options = map[string]string{packets.OptOffset: "0"}
+		}
+		wrq.Options = withTransferOptions(wrq.Options)
+
+		localConn, err := client.SendRequest(wrq, serverIP)
+		if err != nil {
+			fatal("sending the WRQ failed", "error", err)
+		}
+
+		handler := client.NewHandler(localConn, timeout)
+		handler.Logger = client.RequestLogger(wrq, *serverIP)
+		if limitRate > 0 {
+			handler.Limit = throttle.NewBucket(int64(limitRate), 0)
+		}
+		handler.Resume = *resume
+		if local == "-" {
+			err = handler.WriteFrom(os.Stdin)
+			if err == nil {
+				transferSuccessful <- true
+			}
+		} else {
+			handler.Local = local
+			err = handler.HandleWriteRequest(&remote, transferSuccessful)
+		}
+		if err != nil {
+			fatal("transfer failed", "error", err)
+		}
+
+	case "ls":
+		entries, err := client.List(*serverIP, flag.Arg(1), timeout)
+		if err != nil {
+			fatal("listing the directory failed", "error", err)
+		}
+		client.WriteListing(os.Stdout, entries)
+		return
+
+	case "batch":
+		os.Exit(runBatch(flag.Arg(1), timeout))
+
+	default:
+		usage()
+		fatal("unknown command", "command", command)
+	}
 
 	select {
 	case <-transferSuccessful:
-		log.Println("Transfer successful")
-	case <-time.After(handler.Deadline):
-		log.Println("Transfer timed out")
+		slog.Info("transfer successful")
+	default:
+		slog.Warn("transfer did not complete")
+	}
+
+}
+
+// withTransferOptions adds the options of -blksize and -windowsize to the options of a request.
+func withTransferOptions(options map[string]string) map[string]string {
+	if *blockSize == 0 && *windowSize == 0 {
+		return options
+	}
+	if options == nil {
+		options = make(map[string]string)
+	}
+	if *blockSize != 0 {
+		options[packets.OptBlockSize] = strconv.Itoa(*blockSize)
+	}
+	if *windowSize != 0 {
+		options[packets.OptWindowSize] = strconv.Itoa(*windowSize)
+	}
+	return options
+}
+
+// runBatch performs the transfers listed in the manifest and returns the exit code,
+// which is non-zero when any of them failed.
+func runBatch(manifest string, timeout time.Duration) int {
+	if manifest == "" {
+		usage()
+		return 2
+	}
+
+	file, err := os.Open(manifest)
+	if err != nil {
+		slog.Error("opening the manifest failed", "error", err)
+		return 2
+	}
+	defer file.Close()
+
+	entries, err := client.ParseManifest(file)
+	if err != nil {
+		slog.Error("reading the manifest failed", "error", err)
+		return 2
+	}
+
+	return report(newBatch(timeout).Run(entries), nil)
+}
+
+func newBatch(timeout time.Duration) *client.Batch {
+	return &client.Batch{
+		Server:      *serverIP,
+		Parallelism: *parallel,
+		Retries:     *retries,
+		RetryDelay:  client.DEFAULT_RETRY_DELAY,
+		Timeout:     timeout,
+	}
+}
+
+// report prints the results of a batch and returns the exit code, which is non-zero when any transfer failed.
+func report(results []client.BatchResult, err error) int {
+	if err != nil {
+		slog.Error("transfer failed", "error", err)
+		return 1
+	}
+
+	if client.WriteReport(os.Stdout, results) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// expandURL replaces a tftp:// URL by the host and remote file it stands for: get URL [local], put local URL.
+// The transfer mode of the URL takes precedence over -m.
+func expandURL(command string, args []string) ([]string, error) {
+	switch {
+	case command == "get" && len(args) > 0 && client.IsURL(args[0]):
+		u, err := client.ParseURL(args[0])
+		if err != nil {
+			return nil, err
+		}
+		*mode = u.Mode
+		return append([]string{u.Host, u.File}, args[1:]...), nil
+
+	case command == "put" && len(args) == 2 && client.IsURL(args[1]):
+		u, err := client.ParseURL(args[1])
+		if err != nil {
+			return nil, err
+		}
+		*mode = u.Mode
+		return []string{u.Host, args[0], u.File}, nil
 	}
 
+	return args, nil
 }
@@ -0,0 +1,219 @@
+package client
+
+import (
+	"TFTP/packets"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	DEFAULT_PARALLELISM = 4
+	DEFAULT_RETRIES     = 3
+	DEFAULT_RETRY_DELAY = time.Second
+)
+
+// Get downloads remote from the server into local.
+func Get(serverIP, remote, local string, timeout time.Duration) error {
+	rrq := packets.ReadRequest{FileName: remote, Mode: packets.OCTET}
+	conn, err := SendRequest(rrq, &serverIP)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	handler := NewHandler(conn, timeout)
+	handler.Local = local
+	handler.Logger = RequestLogger(rrq, serverIP)
+	// reading a file twice does no harm, the request is sent again while the server does not answer
+	handler.Request = rrq
+	handler.Server, err = net.ResolveUDPAddr("udp", serverIP)
+	if err != nil {
+		return err
+	}
+	return handler.HandleReadRequest(&remote, make(chan bool, 1))
+}
+
+// Put uploads local to the server as remote.
+func Put(serverIP, local, remote string, timeout time.Duration) error {
+	// fail before the server starts waiting for data we cannot send
+	_, err := os.Stat(local)
+	if err != nil {
+		return err
+	}
+
+	wrq := packets.WriteRequest{FileName: remote, Mode: packets.OCTET}
+	conn, err := SendRequest(wrq, &serverIP)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	handler := NewHandler(conn, timeout)
+	handler.Local = local
+	handler.Logger = RequestLogger(wrq, serverIP)
+	return handler.HandleWriteRequest(&remote, make(chan bool, 1))
+}
+
+// BatchEntry is a single transfer of a manifest.
+type BatchEntry struct {
+	Op     string `json:"op"`               // "get" or "put"
+	Remote string `json:"remote"`           // name of the file on the server
+	Local  string `json:"local"`            // name of the local file
+	Server string `json:"server,omitempty"` // server address, the batch server is used when empty
+}
+
+// BatchResult reports how a single transfer of a batch went.
+type BatchResult struct {
+	Entry    BatchEntry
+	Attempts int
+	Bytes    int64
+	Duration time.Duration
+	Err      error
+}
+
+// ParseManifest reads the transfers of a batch. The manifest is either a JSON array of entries
+// or one transfer per line in the form "get|put remote local [server]",
+// empty lines and lines starting with # are skipped.
+func ParseManifest(r io.Reader) ([]BatchEntry, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []BatchEntry
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		err = json.Unmarshal(trimmed, &entries)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid JSON manifest: %v", err)
+		}
+	} else {
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for line := 1; scanner.Scan(); line++ {
+			text := strings.TrimSpace(scanner.Text())
+			if text == "" || strings.HasPrefix(text, "#") {
+				continue
+			}
+
+			fields := strings.Fields(text)
+			if len(fields) != 3 && len(fields) != 4 {
+				return nil, fmt.Errorf("Invalid manifest line %d: %q", line, text)
+			}
+
+			entry := BatchEntry{Op: fields[0], Remote: fields[1], Local: fields[2]}
+			if len(fields) == 4 {
+				entry.Server = fields[3]
+			}
+			entries = append(entries, entry)
+		}
+		if err = scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	for i, entry := range entries {
+		if entry.Op != "get" && entry.Op != "put" {
+			return nil, fmt.Errorf("Invalid operation %q in manifest entry %d", entry.Op, i+1)
+		}
+		if entry.Remote == "" || entry.Local == "" {
+			return nil, fmt.Errorf("Missing file name in manifest entry %d", i+1)
+		}
+	}
+
+	return entries, nil
+}
+
+// Batch runs many transfers concurrently.
+type Batch struct {
+	Server      string        // server used by the entries that do not name one
+	Parallelism int           // maximum number of transfers running at the same time
+	Retries     int           // number of times a failed transfer is tried again
+	RetryDelay  time.Duration // pause before a failed transfer is tried again
+	Timeout     time.Duration // deadline of every read of a transfer
+}
+
+// Run performs every transfer and returns their results in the order of the entries.
+func (b *Batch) Run(entries []BatchEntry) []BatchResult {
+	parallelism := b.Parallelism
+	if parallelism <= 0 {
+		parallelism = DEFAULT_PARALLELISM
+	}
+
+	results := make([]BatchResult, len(entries))
+	slots := make(chan struct{}, parallelism)
+	var wg sync.WaitGroup
+
+	for i, entry := range entries {
+		if entry.Server == "" {
+			entry.Server = b.Server
+		}
+
+		wg.Add(1)
+		slots <- struct{}{}
+		go func() {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			results[i] = b.run(entry)
+		}()
+	}
+
+	wg.Wait()
+	return results
+}
+
+func (b *Batch) run(entry BatchEntry) BatchResult {
+	result := BatchResult{Entry: entry}
+	start := time.Now()
+
+	for result.Attempts = 1; ; result.Attempts++ {
+		if entry.Op == "get" {
+			result.Err = Get(entry.Server, entry.Remote, entry.Local, b.Timeout)
+		} else {
+			result.Err = Put(entry.Server, entry.Local, entry.Remote, b.Timeout)
+		}
+
+		if result.Err == nil || result.Attempts > b.Retries {
+			break
+		}
+		time.Sleep(b.RetryDelay)
+	}
+
+	result.Duration = time.Since(start)
+	if result.Err == nil {
+		if info, err := os.Stat(entry.Local); err == nil {
+			result.Bytes = info.Size()
+		}
+	}
+	return result
+}
+
+// WriteReport prints a line for every transfer of a batch and returns how many of them failed.
+func WriteReport(w io.Writer, results []BatchResult) int {
+	failed := 0
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "STATUS\tOP\tREMOTE\tLOCAL\tSERVER\tBYTES\tATTEMPTS\tDURATION\tERROR")
+	for _, result := range results {
+		status, message := "ok", ""
+		if result.Err != nil {
+			status, message = "FAILED", result.Err.Error()
+			failed++
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%d\t%d\t%s\t%s\n",
+			status, result.Entry.Op, result.Entry.Remote, result.Entry.Local, result.Entry.Server,
+			result.Bytes, result.Attempts, result.Duration.Round(time.Millisecond), message)
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "%d transfers, %d failed\n", len(results), failed)
+	return failed
+}
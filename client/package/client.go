@@ -2,11 +2,15 @@ package client
 
 import (
 	"TFTP/packets"
-	"bytes"
+	"TFTP/resume"
+	"TFTP/transfer"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"net"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -17,246 +21,392 @@ const (
 	opcodeDATA  = 3
 	opcodeACK   = 4
 	opcodeERROR = 5
+	opcodeOACK  = 6
 )
 
+// retries is how many times a packet is sent before a transfer is given up, they share the Deadline.
+const retries = 10
+
 func SendRequest(req packets.Request, serverIP *string) (*net.UDPConn, error) {
 	serverAddr, err := net.ResolveUDPAddr("udp", *serverIP)
 	if err != nil {
-		fmt.Println("Invalid server address:", err)
+		slog.Error("invalid server address", "server", *serverIP, "error", err)
 		return nil, err
 	}
 
 	// Set up local UDP connection, any available local address
 	localConn, err := net.ListenUDP("udp", nil) // nil means any available local address
 	if err != nil {
-		fmt.Println("Failed to set up local UDP connection:", err)
+		slog.Error("opening the local UDP socket failed", "error", err)
 		return nil, err
 	}
-	fmt.Printf("Local UDP connection set up on %s\n", localConn.LocalAddr())
+	slog.Debug("local UDP socket opened", "addr", localConn.LocalAddr().String())
 
-	reqData, err := req.MarshalBinary()
+	err = SendRequestTo(localConn, req, serverAddr)
 	if err != nil {
-		fmt.Println("Error while marshaling REQ:", err)
+		localConn.Close()
 		return nil, err
 	}
-	fmt.Printf("Sending %s request to %s\n", req.String(), serverAddr)
+	return localConn, nil
+}
+
+// SendRequestTo sends the request over an existing connection, which can then be passed to NewHandler.
+func SendRequestTo(conn net.PacketConn, req packets.Request, serverAddr net.Addr) error {
+	reqData, err := req.MarshalBinary()
+	if err != nil {
+		slog.Error("marshaling the request failed", "error", err)
+		return err
+	}
+	slog.Debug("sending request", "server", serverAddr.String(), "request", req.String())
 
 	// Send REQ to server
-	_, err = localConn.WriteTo(reqData, serverAddr)
+	_, err = conn.WriteTo(reqData, serverAddr)
 	if err != nil {
-		fmt.Println("Error while sending REQ:", err)
-		return nil, err
+		slog.Error("sending the request failed", "server", serverAddr.String(), "error", err)
+		return err
 	}
-	return localConn, nil
+	return nil
+}
+
+// RequestLogger returns the default logger with the attributes of the transfer of a request to server,
+// see Handler.Logger.
+func RequestLogger(req packets.Request, server string) *slog.Logger {
+	var file, mode string
+	switch req := req.(type) {
+	case packets.ReadRequest:
+		file, mode = req.FileName, req.Mode
+	case packets.WriteRequest:
+		file, mode = req.FileName, req.Mode
+	}
+	return slog.With("op", req.RequestType(), "server", server, "file", file, "mode", mode)
 }
 
+// RemoteError is returned when the server aborts a transfer with an ERROR packet.
+type RemoteError = transfer.RemoteError
+
 type Handler struct {
-	Conn     *net.UDPConn
-	Deadline time.Duration
+	Conn         net.PacketConn
+	Deadline     time.Duration
+	Resume       bool             // continue a partial transfer instead of starting from scratch, see ResumeOffset
+	Local        string           // local file to read from or write to, OutputFileName / the remote name when empty
+	TransferSize int64            // size of the file the server reported with the tsize option, -1 when it did not
+	Stats        transfer.Stats   // statistics of the last transfer
+	Limit        transfer.Limiter // limits the bandwidth of the transfers when set, e.g. a throttle.Bucket
+
+	// Logger logs the transfers, slog.Default() when nil. A logger with the attributes of the transfer,
+	// e.g. the server and the file, lets it be traced end to end.
+	Logger *slog.Logger
+
+	// Request is sent again to Server while the server does not answer it, when both are set.
+	// Without them the first packet of the server is awaited for the whole Deadline.
+	Request packets.Request
+	Server  net.Addr
 }
 
-func NewHandler(conn *net.UDPConn, deadline time.Duration) *Handler {
+func NewHandler(conn net.PacketConn, deadline time.Duration) *Handler {
 	return &Handler{
-		Conn:     conn,
-		Deadline: deadline,
+		Conn:         conn,
+		Deadline:     deadline,
+		TransferSize: -1,
+	}
+}
+
+// OutputFileName returns the name of the local file a downloaded file is stored in.
+func OutputFileName(filename string) string {
+	return strings.ReplaceAll("received_"+filename, "/", "_")
+}
+
+// ResumeOffset returns the offset to request in order to resume the download into the local file,
+// based on how much of it has already been received. It is 0 when nothing was received yet.
+func ResumeOffset(local string) (int64, error) {
+	info, err := os.Stat(local)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
 	}
+	return resume.Offset(info.Size()), nil
 }
 
 func (h *Handler) HandleReadRequest(filename *string, transferSucessful chan bool) error {
 	// Open file for writing the received data
-	outputFileName := "received_" + *filename
-	outputFile, err := os.Create(strings.ReplaceAll(outputFileName, "/", "_"))
+	// a partial file is kept when resuming, the server tells us where it continues from
+	outputFileName := OutputFileName(*filename)
+	if h.Local != "" {
+		outputFileName = h.Local
+	}
+	flags := os.O_RDWR | os.O_CREATE | os.O_TRUNC
+	if h.Resume {
+		flags = os.O_RDWR | os.O_CREATE
+	}
+	outputFile, err := os.OpenFile(outputFileName, flags, 0644)
 	if err != nil {
 		return err
 	}
-	// Ensure file is closed and deleted on failure
-	defer func() {
-		if outputFile != nil {
-			outputFile.Close()
-			if err != nil {
-				if removeErr := os.Remove(outputFileName); removeErr != nil {
-					log.Printf("Failed to delete incomplete file '%s': %v", outputFileName, removeErr)
-				} else {
-					log.Printf("Incomplete file '%s' deleted due to errors.", outputFileName)
-				}
-			}
-		}
-	}()
-	fmt.Printf("Output file created: %s\n", outputFile.Name())
+	defer outputFile.Close()
+	h.logger().Debug("output file created", "local", outputFile.Name())
+
+	err = h.receive(outputFile, outputFile)
+	if err != nil {
+		return err
+	}
+
+	h.logger().Info("file received", "local", outputFileName, "stats", h.Stats)
+	transferSucessful <- true
+	return nil
+}
+
+// ReadTo streams the requested file to w as it is received.
+// The read request has to be sent already, see SendRequest.
+func (h *Handler) ReadTo(w io.Writer) error {
+	return h.receive(w, nil)
+}
 
-	// Variables to track the server's ephemeral address
-	var serverDataAddr *net.UDPAddr
+// receive writes the received data to w. Resuming is only possible when partial, the file behind w, is known.
+func (h *Handler) receive(w io.Writer, partial *os.File) error {
+	var (
+		output  = w
+		resumed *resume.Writer
+		buffer  = make([]byte, packets.DatagramSize)
+	)
+
+	// the first packet tells the server's ephemeral address, the transfer continues with it
+	n, serverDataAddr, err := h.readFirst(buffer)
+	if err != nil {
+		return err
+	}
+	if n < 4 {
+		return errors.New("Invalid packet received")
+	}
+	h.logger().Debug("transfer started", "peer", serverDataAddr.String())
 
-	for {
-		buffer := make([]byte, 516)
-		h.Conn.SetReadDeadline(time.Now().Add(h.Deadline))
+	// the deadline covers all the attempts to receive a block
+	receiver := transfer.Receiver{Conn: h.Conn, Peer: serverDataAddr, Timeout: h.Deadline / retries, Retries: retries, Limit: h.Limit, Logger: h.logger()}
+	defer func() { h.Stats = receiver.Stats }()
 
-		n, addr, err := h.Conn.ReadFromUDP(buffer)
+	if buffer[1] == opcodeOACK {
+		oackPck := packets.OptionAck{}
+		err = oackPck.UnmarshalBinary(buffer[:n])
 		if err != nil {
-			return err
+			return fmt.Errorf("Error unmarshaling OACK packet: %v", err)
 		}
 
-		// Update serverDataAddr if it's the first data packet
-		if serverDataAddr == nil {
-			serverDataAddr = addr
-			fmt.Printf("Server data address set to %s\n", serverDataAddr)
+		err = h.readTransferSize(oackPck.Options)
+		if err == nil {
+			receiver.Options, err = transfer.ParseOptionAck(oackPck.Options)
+		}
+		if err != nil {
+			h.sendError(serverDataAddr, packets.ErrUnknown, err.Error())
+			return err
 		}
 
-		if !addr.IP.Equal(serverDataAddr.IP) || addr.Port != serverDataAddr.Port {
-			fmt.Printf("Received packet from unknown address %s\n", addr)
-			continue // Ignore packets from unknown sources
+		offset, resuming, err := resume.ParseOffset(oackPck.Options)
+		if err != nil || (resuming && (!h.Resume || partial == nil)) {
+			h.sendError(serverDataAddr, packets.ErrUnknown, "Unexpected options")
+			return fmt.Errorf("Unexpected options in OACK: %v", oackPck.Options)
 		}
 
-		opcode := buffer[1]
-		switch opcode {
-		case opcodeDATA:
-			dataPck := packets.Data{}
-			err = dataPck.UnmarshalBinary(buffer[:n])
+		if resuming {
+			resumed, err = resume.NewWriter(partial, offset)
 			if err != nil {
-				fmt.Println("Error unmarshaling DATA packet:", err)
-				break
+				h.sendError(serverDataAddr, packets.ErrUnknown, err.Error())
+				return err
 			}
-
-			// Write data to file
-			// TFTP DATA packet: 2 bytes opcode + 2 bytes block number + data
-			_, err = outputFile.Write(buffer[4:n])
+			output = resumed
+			h.logger().Info("resuming", "offset", offset)
+		} else if h.Resume && partial != nil {
+			h.logger().Warn("the server does not support resuming, downloading from scratch")
+			err = partial.Truncate(0)
 			if err != nil {
 				return err
 			}
+		}
 
-			// Send ACK
-			ack := packets.Ack{BlockNumber: dataPck.BlockNumber}
-			ackData, err := ack.MarshalBinary()
+		// ACK of block 0 confirms the options
+		err = receiver.Acknowledge(nil)
+		if err != nil {
+			return err
+		}
+	} else {
+		// the server ignored the offset option and sends the file from the start
+		if h.Resume && partial != nil && buffer[1] == opcodeDATA {
+			h.logger().Warn("the server does not support resuming, downloading from scratch")
+			err = partial.Truncate(0)
 			if err != nil {
-				return fmt.Errorf("Error while marshaling ACK packet: %v", err)
+				return err
 			}
+		}
+		receiver.Pending = buffer[:n]
+	}
 
-			b, err := h.Conn.WriteTo(ackData, serverDataAddr)
-			fmt.Printf("Sent ACK for block %d, sent %d\n", dataPck.BlockNumber, b)
-			if err != nil {
-				return fmt.Errorf("Error while sending ACK packet: %v", err)
-			}
+	err = receiver.Receive(output)
+	if err != nil {
+		return err
+	}
 
-			if n < 516 {
-				transferSucessful <- true
-				break
-			}
+	if resumed != nil {
+		return resumed.Verify()
+	}
+	return nil
+}
+
+// readFirst reads the answer of the server to the request, which comes from the address of the transfer.
+func (h *Handler) readFirst(buf []byte) (int, net.Addr, error) {
+	attempts, wait := 1, h.Deadline
+	if h.Request != nil && h.Server != nil {
+		attempts, wait = retries, h.Deadline/retries
+	}
 
-		case opcodeERROR:
-			errorPck := packets.Error{}
-			err = errorPck.UnmarshalBinary(buffer[:n])
+	for attempt := 1; ; attempt++ {
+		h.Conn.SetReadDeadline(time.Now().Add(wait))
+		n, addr, err := h.Conn.ReadFrom(buf)
+		if nErr, ok := err.(net.Error); ok && nErr.Timeout() && attempt < attempts {
+			h.logger().Warn("no answer, sending the request again", "server", h.Server.String(), "attempt", attempt)
+			err = SendRequestTo(h.Conn, h.Request, h.Server)
 			if err != nil {
-				return fmt.Errorf("Error unmarshaling ERROR packet: %v", err)
-			} else {
-				return fmt.Errorf("Received ERROR packet: %s", errorPck.Message)
+				return 0, nil, err
 			}
-
-		default:
-			fmt.Printf("Unknown opcode %d received\n", opcode)
-		}
-
-		if opcode == opcodeERROR || err != nil {
-			break
+			continue
 		}
+		return n, addr, err
+	}
+}
 
+// readTransferSize keeps the file size the server reported in the OACK, if it did.
+func (h *Handler) readTransferSize(options map[string]string) error {
+	value, ok := options[packets.OptTransferSize]
+	if !ok {
+		return nil
 	}
 
-	// Close file and return
-	if err != nil {
-		log.Printf("File '%s' received successfully.", outputFileName)
-		err = outputFile.Close()
-		if err != nil {
-			log.Printf("Error closing file '%s': %v", outputFileName, err)
-		}
-		outputFile = nil
-	} else {
-		log.Printf("File transfer failed. Cleaning up '%s'.", outputFileName)
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || size < 0 {
+		return errors.New("Invalid transfer size")
 	}
 
+	h.TransferSize = size
 	return nil
 }
 
+// sendError lets the server know why the transfer is aborted.
+func (h *Handler) sendError(addr net.Addr, code packets.ErrCode, message string) {
+	transfer.SendError(h.Conn, addr, code, message)
+}
+
 func (h *Handler) HandleWriteRequest(filename *string, transferSucessful chan bool) error {
-	log.Printf("Handling write request for file: %s", *filename)
-	//read file
-	payload, err := os.ReadFile(*filename)
+	//open file, it is streamed block by block
+	inputFileName := *filename
+	if h.Local != "" {
+		inputFileName = h.Local
+	}
+	inputFile, err := os.Open(inputFileName)
 	if err != nil {
-		fmt.Println("Error reading payload file")
+		h.logger().Error("opening the file failed", "local", inputFileName, "error", err)
 		return err
 	}
+	defer inputFile.Close()
+
+	err = h.WriteFrom(inputFile)
+	if err != nil {
+		return err
+	}
+
+	transferSucessful <- true
+	return nil
+}
 
+// WriteFrom sends everything read from r until EOF, so the length does not have to be known up front.
+// The write request has to be sent already, see SendRequest.
+func (h *Handler) WriteFrom(r io.Reader) error {
 	var (
-		ackPacket   packets.Ack
 		errorPacket packets.Error
-		dataPacket  = packets.Data{Payload: bytes.NewReader(payload)}
+		options     transfer.Options
 		buf         = make([]byte, packets.DatagramSize)
 	)
 
 	// we read the initial packet from the server
-	// we do it only to get the server address
-	_, addr, err := h.Conn.ReadFromUDP(buf)
+	// we do it to get the server address, and the offset to resume from if we asked for one
+	n, addr, err := h.readFirst(buf)
 	if err != nil {
 		return err
 	}
 
-NEXT:
-	for n := packets.DatagramSize; n == packets.DatagramSize; {
-		dataPacket.BlockNumber++
-		data, err := dataPacket.MarshalBinary()
+	if n > 1 && buf[1] == opcodeERROR && errorPacket.UnmarshalBinary(buf[:n]) == nil {
+		return &RemoteError{Code: errorPacket.ErrCode, Message: errorPacket.Message}
+	}
+
+	if n > 1 && buf[1] == opcodeOACK {
+		var oackPacket packets.OptionAck
+		err = oackPacket.UnmarshalBinary(buf[:n])
 		if err != nil {
-			log.Printf("Error marshaling data packet: %v", err)
 			return err
 		}
 
-	RETRY:
-		for i := 0; i < 10; i++ {
-			n, err = h.Conn.WriteTo(data, addr)
-			if err != nil {
-				log.Printf("Error sending data packet: %v", err)
-				return err
+		err = h.readTransferSize(oackPacket.Options)
+		if err == nil {
+			options, err = transfer.ParseOptionAck(oackPacket.Options)
+		}
+		if err != nil {
+			h.sendError(addr, packets.ErrUnknown, err.Error())
+			return err
+		}
+
+		// the server already has everything before the offset
+		offset, resuming, err := resume.ParseOffset(oackPacket.Options)
+		if err == nil && resuming {
+			if !h.Resume {
+				err = errors.New("Unexpected offset")
+			} else {
+				err = skip(r, offset)
 			}
+		}
+		if err != nil {
+			h.sendError(addr, packets.ErrUnknown, "Invalid offset")
+			return fmt.Errorf("Invalid offset in OACK: %v", oackPacket.Options)
+		}
+		if resuming {
+			h.logger().Info("resuming", "offset", offset)
+		}
+	}
 
-			h.Conn.SetReadDeadline(time.Now().Add(h.Deadline / 10))
+	// the deadline covers all the attempts to send a block
+	sender := transfer.Sender{Conn: h.Conn, Peer: addr, Timeout: h.Deadline / retries, Retries: retries, Options: options, Limit: h.Limit, Logger: h.logger()}
+	err = sender.Send(r)
+	h.Stats = sender.Stats
+	if err != nil {
+		h.logger().Warn("sending the file failed", "error", err, "stats", sender.Stats)
+		return err
+	}
+
+	h.logger().Info("file sent", "stats", sender.Stats)
+	return nil
+}
+
+func (h *Handler) logger() *slog.Logger {
+	if h.Logger == nil {
+		return slog.Default()
+	}
+	return h.Logger
+}
 
-			// we read ACK packet from server
-			_, addr, err = h.Conn.ReadFromUDP(buf)
+// skip moves r forward by n bytes, seeking when it is possible.
+func skip(r io.Reader, n int64) error {
+	// pipes implement io.Seeker too, but seeking them fails
+	if seeker, ok := r.(io.Seeker); ok {
+		if current, err := seeker.Seek(0, io.SeekCurrent); err == nil {
+			end, err := seeker.Seek(0, io.SeekEnd)
 			if err != nil {
-				if nErr, ok := err.(net.Error); ok && nErr.Timeout() {
-					log.Printf("Timeout reading ack packet: %v", err)
-					continue RETRY
-				}
-				log.Printf("Error unmarshaling ack packet: %v", err)
 				return err
 			}
-
-			// Unmarshal ACK packet
-			ackErr := ackPacket.UnmarshalBinary(buf)
-			errorErr := errorPacket.UnmarshalBinary(buf)
-
-			switch {
-			case ackErr == nil:
-				if uint16(ackPacket.BlockNumber) == dataPacket.BlockNumber {
-					continue NEXT
-				} else {
-					log.Printf("Unexpected ACK block number: got %d, expected %d", ackPacket.BlockNumber, dataPacket.BlockNumber)
-					break
-				}
-			case errorErr == nil:
-				log.Printf("Error packet received: %v", errorPacket)
-				return fmt.Errorf("Error packet received: %v", errorPacket)
-			default:
-				log.Printf("Unknown packet received: %v", buf)
-				return fmt.Errorf("Unknown packet received: %v", buf)
+			if current+n > end {
+				return io.ErrUnexpectedEOF
 			}
-
-			log.Printf("Max retries reached for: %s", h.Conn.RemoteAddr())
-			return fmt.Errorf("Max retries reached for: %s", h.Conn.RemoteAddr())
+			_, err = seeker.Seek(current+n, io.SeekStart)
+			return err
 		}
-
-		return nil
 	}
 
-	log.Printf("[%s] file sent", h.Conn.RemoteAddr())
-	transferSucessful <- true
-	return nil
+	_, err := io.CopyN(io.Discard, r, n)
+	return err
 }
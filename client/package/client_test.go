@@ -1 +1,454 @@
 package client
+
+import (
+	"TFTP/packets"
+	server "TFTP/server/package"
+	"TFTP/tftptest"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestParseManifestLines(t *testing.T) {
+	manifest := `
+# configs for the lab switch
+get pxelinux.cfg/default default.cfg
+put backups/switch.cfg switch.cfg 10.0.0.2:69
+`
+	entries, err := ParseManifest(strings.NewReader(manifest))
+	if err != nil {
+		t.Fatalf("Error parsing manifest: %v", err)
+	}
+
+	expected := []BatchEntry{
+		{Op: "get", Remote: "pxelinux.cfg/default", Local: "default.cfg"},
+		{Op: "put", Remote: "backups/switch.cfg", Local: "switch.cfg", Server: "10.0.0.2:69"},
+	}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Errorf("Expected %v, got %v", expected, entries)
+	}
+}
+
+func TestParseManifestJSON(t *testing.T) {
+	manifest := `[{"op": "put", "remote": "fw.bin", "local": "build/fw.bin", "server": "10.0.0.3:69"}]`
+	entries, err := ParseManifest(strings.NewReader(manifest))
+	if err != nil {
+		t.Fatalf("Error parsing manifest: %v", err)
+	}
+
+	expected := []BatchEntry{{Op: "put", Remote: "fw.bin", Local: "build/fw.bin", Server: "10.0.0.3:69"}}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Errorf("Expected %v, got %v", expected, entries)
+	}
+}
+
+func TestParseManifestInvalid(t *testing.T) {
+	for _, manifest := range []string{
+		"delete fw.bin fw.bin",
+		"get fw.bin",
+		`[{"op": "get", "remote": "fw.bin"}]`,
+	} {
+		_, err := ParseManifest(strings.NewReader(manifest))
+		if err == nil {
+			t.Errorf("Expected error parsing %q", manifest)
+		}
+	}
+}
+
+func TestWriteReport(t *testing.T) {
+	results := []BatchResult{
+		{Entry: BatchEntry{Op: "get", Remote: "a", Local: "a"}, Attempts: 1, Bytes: 10},
+		{Entry: BatchEntry{Op: "put", Remote: "b", Local: "b"}, Attempts: 4, Err: errors.New("timeout")},
+	}
+
+	var out bytes.Buffer
+	failed := WriteReport(&out, results)
+	if failed != 1 {
+		t.Errorf("Expected 1 failed transfer, got %d", failed)
+	}
+
+	if !strings.Contains(out.String(), "FAILED") || !strings.Contains(out.String(), "timeout") {
+		t.Errorf("Expected the failure in the report, got:\n%s", out.String())
+	}
+}
+
+func TestBatchRun(t *testing.T) {
+	// the transfers are slowed down, so that the ones of the batch running at the same time can be seen
+	const size = 4*packets.BlockSize + 100
+	srv := tftptest.NewUnstartedServer(t, nil)
+	srv.Config.SessionRateLimit = 8 * 1024
+	srv.Handler = func(req tftptest.Request) ([]byte, error) {
+		if req.FileName == "missing.bin" {
+			return nil, fs.ErrNotExist
+		}
+		return bytes.Repeat([]byte(req.FileName[:1]), size), nil
+	}
+	srv.Start()
+	// the first attempts of a.bin fail, the last retry gets it
+	srv.InjectError("a.bin", packets.ErrUnknown, "injected")
+	srv.InjectError("a.bin", packets.ErrUnknown, "injected")
+
+	local := t.TempDir()
+	var entries []BatchEntry
+	for _, name := range []string{"a.bin", "b.bin", "c.bin", "d.bin", "missing.bin", "e.bin"} {
+		entries = append(entries, BatchEntry{Op: "get", Remote: name, Local: filepath.Join(local, name)})
+	}
+	batch := &Batch{Server: srv.Addr.String(), Parallelism: 2, Retries: 2, RetryDelay: 10 * time.Millisecond, Timeout: 5 * time.Second}
+
+	done := make(chan []BatchResult)
+	go func() { done <- batch.Run(entries) }()
+	var results []BatchResult
+	peak := 0
+	for results == nil {
+		select {
+		case results = <-done:
+		case <-time.After(5 * time.Millisecond):
+			running := 0
+			for _, transfer := range srv.Transfers() {
+				if !transfer.Done && transfer.Error == nil && transfer.Bytes < size {
+					running++
+				}
+			}
+			peak = max(peak, running)
+		}
+	}
+
+	if peak != batch.Parallelism {
+		t.Errorf("Expected %d transfers at the same time, got %d", batch.Parallelism, peak)
+	}
+	for i, result := range results {
+		name := entries[i].Remote
+		switch {
+		case name == "a.bin" && (result.Err != nil || result.Attempts != 3):
+			t.Errorf("Expected a.bin on the last retry, got %d attempts (%v)", result.Attempts, result.Err)
+		case name == "missing.bin":
+			var remote *RemoteError
+			if !errors.As(result.Err, &remote) || remote.Code != packets.ErrNotFound || result.Attempts != 3 {
+				t.Errorf("Expected missing.bin to fail after every retry, got %d attempts (%v)", result.Attempts, result.Err)
+			}
+		case name != "a.bin" && (result.Err != nil || result.Attempts != 1):
+			t.Errorf("Expected %s on the first attempt, got %d attempts (%v)", name, result.Attempts, result.Err)
+		}
+		if result.Err == nil && result.Bytes != size {
+			t.Errorf("Expected %d bytes of %s, got %d", size, name, result.Bytes)
+		}
+	}
+
+	// the client exits with a failure status when a transfer failed
+	if failed := WriteReport(io.Discard, results); failed != 1 {
+		t.Errorf("Expected 1 failed transfer, got %d", failed)
+	}
+}
+
+func TestReadIndexRejectsEscapingPaths(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "index")
+	err := os.WriteFile(name, []byte("a.txt\nsub/b.txt\n../../etc/passwd\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = readIndex(name)
+	if err == nil {
+		t.Errorf("Expected error for a path outside of the directory")
+	}
+}
+
+func TestTreeRoundTrip(t *testing.T) {
+	srv := tftptest.NewUnstartedServer(t, nil)
+	srv.Config.CreateDirs = true
+	srv.Start()
+
+	files := map[string]string{
+		"boot.cfg":         "menu",
+		"fw/a.bin":         strings.Repeat("a", 3*packets.BlockSize),
+		"fw/sub/empty.bin": "",
+	}
+	local := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(local, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	batch := &Batch{Server: srv.Addr.String(), Timeout: time.Second}
+	results, err := batch.PutTree(local, "tree")
+	if err != nil || len(results) != len(files) {
+		t.Fatalf("Expected %d uploads, got %d (%v)", len(files), len(results), err)
+	}
+	for _, result := range results {
+		if result.Err != nil {
+			t.Errorf("Error uploading %s: %v", result.Entry.Remote, result.Err)
+		}
+	}
+	for name, content := range files {
+		if uploaded, err := srv.Uploaded("tree/" + name); err != nil || string(uploaded) != content {
+			t.Errorf("Expected %s to be uploaded, got %d bytes (%v)", name, len(uploaded), err)
+		}
+	}
+
+	// the uploads are downloaded back from the upload directory, through its index
+	downloaded := t.TempDir()
+	results, err = batch.GetTree(server.UploadDir+"/tree", downloaded)
+	if err != nil || len(results) != len(files) {
+		t.Fatalf("Expected %d downloads, got %d (%v)", len(files), len(results), err)
+	}
+	for _, result := range results {
+		if result.Err != nil {
+			t.Errorf("Error downloading %s: %v", result.Entry.Remote, result.Err)
+		}
+	}
+	for name, content := range files {
+		data, err := os.ReadFile(filepath.Join(downloaded, filepath.FromSlash(name)))
+		if err != nil || string(data) != content {
+			t.Errorf("Expected %s to be downloaded, got %d bytes (%v)", name, len(data), err)
+		}
+	}
+}
+
+func TestSkip(t *testing.T) {
+	// a pipe cannot seek, the skipped bytes have to be read
+	r, w := io.Pipe()
+	go func() {
+		w.Write([]byte("0123456789"))
+		w.Close()
+	}()
+
+	if err := skip(r, 4); err != nil {
+		t.Fatalf("Error skipping: %v", err)
+	}
+	rest, _ := io.ReadAll(r)
+	if string(rest) != "456789" {
+		t.Errorf("Expected %q, got %q", "456789", rest)
+	}
+
+	seeker := strings.NewReader("0123456789")
+	if err := skip(seeker, 8); err != nil {
+		t.Fatalf("Error skipping: %v", err)
+	}
+	rest, _ = io.ReadAll(seeker)
+	if string(rest) != "89" {
+		t.Errorf("Expected %q, got %q", "89", rest)
+	}
+
+	if err := skip(strings.NewReader("0123"), 8); err == nil {
+		t.Errorf("Expected error skipping past the end")
+	}
+}
+
+func TestParseURL(t *testing.T) {
+	tests := []struct {
+		raw      string
+		expected URL
+	}{
+		{"tftp://10.0.0.1/pxelinux.0", URL{Host: "10.0.0.1:69", File: "pxelinux.0", Mode: packets.OCTET}},
+		{"tftp://boot.lan:6969/images/fw%20v2.bin;mode=netascii", URL{Host: "boot.lan:6969", File: "images/fw v2.bin", Mode: packets.NETASCII}},
+		{"tftp://[::1]/a%3Bb", URL{Host: "[::1]:69", File: "a;b", Mode: packets.OCTET}},
+	}
+
+	for _, test := range tests {
+		u, err := ParseURL(test.raw)
+		if err != nil {
+			t.Errorf("Error parsing %s: %v", test.raw, err)
+			continue
+		}
+		if *u != test.expected {
+			t.Errorf("Expected %v, got %v", test.expected, *u)
+		}
+	}
+
+	for _, raw := range []string{"http://host/file", "tftp://host/", "tftp:///file", "tftp://host/file;mode=mail", "tftp://host/file?x=1"} {
+		if _, err := ParseURL(raw); err == nil {
+			t.Errorf("Expected error parsing %s", raw)
+		}
+	}
+}
+
+func TestURLString(t *testing.T) {
+	u := URL{Host: "10.0.0.1:69", File: "fw v2.bin", Mode: packets.NETASCII}
+	expected := "tftp://10.0.0.1/fw%20v2.bin;mode=netascii"
+	if u.String() != expected {
+		t.Errorf("Expected %s, got %s", expected, u.String())
+	}
+}
+
+// startServer serves root on a loopback port and returns its address.
+func startServer(t *testing.T, root string) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	s := &server.Server{Root: root, Timeout: time.Second, Retries: 3}
+	go s.Serve(conn)
+	return conn.LocalAddr().String()
+}
+
+func TestTransport(t *testing.T) {
+	root := t.TempDir()
+	content := bytes.Repeat([]byte("firmware"), 300)
+	if err := os.WriteFile(filepath.Join(root, "fw.bin"), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	addr := startServer(t, root)
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.RegisterProtocol("tftp", &Transport{Timeout: time.Second})
+	httpClient := &http.Client{Transport: transport}
+
+	resp, err := httpClient.Get("tftp://" + addr + "/fw.bin")
+	if err != nil {
+		t.Fatalf("Error getting file: %v", err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK || !bytes.Equal(body, content) {
+		t.Errorf("Expected 200 with %d bytes, got %d with %d bytes (%v)", len(content), resp.StatusCode, len(body), err)
+	}
+
+	resp, err = httpClient.Get("tftp://" + addr + "/missing.bin")
+	if err != nil {
+		t.Fatalf("Error getting missing file: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404, got %d", resp.StatusCode)
+	}
+
+	req, err := http.NewRequest(http.MethodPut, "tftp://"+addr+"/upload.bin", bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = httpClient.Do(req)
+	if err != nil {
+		t.Fatalf("Error putting file: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Errorf("Expected 201, got %d", resp.StatusCode)
+	}
+
+	// the server writes every block before acknowledging it
+	uploaded, err := os.ReadFile(filepath.Join(root, "received/upload.bin"))
+	if err != nil || !bytes.Equal(uploaded, content) {
+		t.Errorf("Expected uploaded file to match, got %d bytes (%v)", len(uploaded), err)
+	}
+}
+
+func TestTransportContext(t *testing.T) {
+	// the server never answers, the transfers wait far longer than the test
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.RegisterProtocol("tftp", &Transport{Timeout: time.Minute})
+	httpClient := &http.Client{Transport: transport}
+
+	for _, method := range []string{http.MethodGet, http.MethodPut} {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		req, err := http.NewRequestWithContext(ctx, method, "tftp://"+conn.LocalAddr().String()+"/fw.bin", strings.NewReader("firmware"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		start := time.Now()
+		resp, err := httpClient.Do(req)
+		cancel()
+		if err == nil {
+			resp.Body.Close()
+		}
+		if !errors.Is(err, context.DeadlineExceeded) || time.Since(start) > 10*time.Second {
+			t.Errorf("Expected %s to end with the context, got %v after %v", method, err, time.Since(start))
+		}
+	}
+}
+
+func TestFS(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		"hello.txt":           "hello",
+		"pxelinux/default":    strings.Repeat("menu ", 500),
+		"pxelinux/empty.cfg":  "",
+		"pxelinux/sub/x.conf": strings.Repeat("x", packets.BlockSize),
+	}
+	for name, content := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fsys := &FS{Server: startServer(t, root), Timeout: time.Second}
+
+	data, err := fs.ReadFile(fsys, "pxelinux/default")
+	if err != nil || string(data) != files["pxelinux/default"] {
+		t.Errorf("Expected %d bytes, got %d (%v)", len(files["pxelinux/default"]), len(data), err)
+	}
+
+	file, err := fsys.Open("pxelinux/sub/x.conf")
+	if err != nil {
+		t.Fatalf("Error opening file: %v", err)
+	}
+	info, err := file.Stat()
+	if err != nil || info.Size() != packets.BlockSize {
+		t.Errorf("Expected size %d from tsize, got %v (%v)", packets.BlockSize, info, err)
+	}
+	file.Close()
+
+	_, err = fsys.Open("missing.txt")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected fs.ErrNotExist, got %v", err)
+	}
+
+	var walked []string
+	err = fs.WalkDir(fsys, ".", func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.IsDir() {
+			walked = append(walked, path)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Error walking: %v", err)
+	}
+	expected := []string{"hello.txt", "pxelinux/default", "pxelinux/empty.cfg", "pxelinux/sub/x.conf"}
+	if !reflect.DeepEqual(walked, expected) {
+		t.Errorf("Expected %v, got %v", expected, walked)
+	}
+
+	dir, err := fsys.Open("pxelinux")
+	if err != nil {
+		t.Fatalf("Error opening directory: %v", err)
+	}
+	info, err = dir.Stat()
+	if err != nil || !info.IsDir() {
+		t.Errorf("Expected a directory, got %v (%v)", info, err)
+	}
+
+	if err = fstest.TestFS(fsys, expected...); err != nil {
+		t.Error(err)
+	}
+}
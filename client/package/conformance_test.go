@@ -0,0 +1,376 @@
+package client
+
+import (
+	"TFTP/packets"
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// The conformance tests play the server with raw packets and check the behavior RFC 1350 requires from the client.
+
+const conformanceTimeout = 300 * time.Millisecond
+
+// fakeServer is the server side of a transfer, it sends and expects raw packets.
+type fakeServer struct {
+	t      *testing.T
+	listen net.PacketConn // port the requests are sent to
+	conn   net.PacketConn // port of the transfer
+	client net.Addr
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+	t.Helper()
+	listen, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	t.Cleanup(func() {
+		listen.Close()
+		conn.Close()
+	})
+	return &fakeServer{t: t, listen: listen, conn: conn}
+}
+
+// start sends the request with a new handler, runs the transfer in the background and waits for the request.
+// The error of the transfer is sent on the returned channel.
+func (f *fakeServer) start(req packets.Request, transfer func(h *Handler) error) <-chan error {
+	f.t.Helper()
+	addr := f.listen.LocalAddr().String()
+	conn, err := SendRequest(req, &addr)
+	if err != nil {
+		f.t.Fatalf("Error sending request: %v", err)
+	}
+	f.t.Cleanup(func() { conn.Close() })
+
+	result := make(chan error, 1)
+	go func() { result <- transfer(NewHandler(conn, conformanceTimeout)) }()
+
+	buf := make([]byte, packets.DatagramSize)
+	f.listen.SetReadDeadline(time.Now().Add(conformanceTimeout))
+	_, f.client, err = f.listen.ReadFrom(buf)
+	if err != nil {
+		f.t.Fatalf("Expected a request, got %v", err)
+	}
+	return result
+}
+
+func (f *fakeServer) send(packet encoding.BinaryMarshaler) {
+	f.t.Helper()
+	data, err := packet.MarshalBinary()
+	if err != nil {
+		f.t.Fatalf("Error marshaling packet: %v", err)
+	}
+	f.sendRaw(data)
+}
+
+func (f *fakeServer) sendRaw(data []byte) {
+	f.t.Helper()
+	if _, err := f.conn.WriteTo(data, f.client); err != nil {
+		f.t.Fatalf("Error sending packet: %v", err)
+	}
+}
+
+func (f *fakeServer) sendData(block uint16, data []byte) {
+	f.t.Helper()
+	f.send(packets.Data{BlockNumber: block, Payload: bytes.NewReader(data)})
+}
+
+// receive returns the next packet of the client, it has to be sent to the port of the transfer.
+func (f *fakeServer) receive(timeout time.Duration) []byte {
+	f.t.Helper()
+	buf := make([]byte, packets.DatagramSize+1)
+	f.conn.SetReadDeadline(time.Now().Add(timeout))
+	n, addr, err := f.conn.ReadFrom(buf)
+	if err != nil {
+		f.t.Fatalf("Expected a packet, got %v", err)
+	}
+	if addr.String() != f.client.String() {
+		f.t.Fatalf("Expected a packet from %s, got one from %s", f.client, addr)
+	}
+	return buf[:n]
+}
+
+// expectNothing fails when a packet arrives within wait.
+func (f *fakeServer) expectNothing(wait time.Duration) {
+	f.t.Helper()
+	buf := make([]byte, packets.DatagramSize)
+	f.conn.SetReadDeadline(time.Now().Add(wait))
+	if n, _, err := f.conn.ReadFrom(buf); err == nil {
+		f.t.Fatalf("Expected no packet, got %v", buf[:n])
+	}
+}
+
+func (f *fakeServer) expectData(block uint16) []byte {
+	f.t.Helper()
+	packet := f.receive(conformanceTimeout)
+	if len(packet) < 4 || binary.BigEndian.Uint16(packet) != uint16(packets.DATA) || binary.BigEndian.Uint16(packet[2:]) != block {
+		f.t.Fatalf("Expected DATA %d, got %v", block, packet)
+	}
+	return packet[4:]
+}
+
+func (f *fakeServer) expectAck(block uint16) {
+	f.t.Helper()
+	packet := f.receive(conformanceTimeout)
+	if len(packet) != 4 || binary.BigEndian.Uint16(packet) != uint16(packets.ACK) || binary.BigEndian.Uint16(packet[2:]) != block {
+		f.t.Fatalf("Expected ACK %d, got %v", block, packet)
+	}
+}
+
+func (f *fakeServer) expectError(code packets.ErrCode) {
+	f.t.Helper()
+	var errorPacket packets.Error
+	packet := f.receive(conformanceTimeout)
+	if errorPacket.UnmarshalBinary(packet) != nil || errorPacket.ErrCode != code {
+		f.t.Fatalf("Expected ERROR %d, got %v", code, packet)
+	}
+}
+
+// expectResult waits for the end of the transfer.
+func (f *fakeServer) expectResult(result <-chan error) error {
+	f.t.Helper()
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(5 * conformanceTimeout):
+		f.t.Fatalf("Expected the transfer to end")
+		return nil
+	}
+}
+
+// blocks splits content into the payloads of the DATA packets, a multiple of the block size ends with an empty one.
+func blocks(content []byte) [][]byte {
+	var payloads [][]byte
+	for {
+		n := min(len(content), packets.BlockSize)
+		payloads = append(payloads, content[:n])
+		content = content[n:]
+		if n < packets.BlockSize {
+			return payloads
+		}
+	}
+}
+
+var conformanceFiles = map[string][]byte{
+	"partial.bin":  bytes.Repeat([]byte("p"), 2*packets.BlockSize+100),
+	"multiple.bin": bytes.Repeat([]byte("m"), 2*packets.BlockSize),
+	"empty.bin":    {},
+}
+
+func TestConformanceReadRequest(t *testing.T) {
+	for name, content := range conformanceFiles {
+		f := newFakeServer(t)
+		var received bytes.Buffer
+		result := f.start(packets.ReadRequest{FileName: name, Mode: packets.OCTET}, func(h *Handler) error {
+			return h.ReadTo(&received)
+		})
+
+		for i, payload := range blocks(content) {
+			f.sendData(uint16(i+1), payload)
+			f.expectAck(uint16(i + 1))
+		}
+
+		if err := f.expectResult(result); err != nil {
+			t.Errorf("Error receiving %s: %v", name, err)
+		} else if !bytes.Equal(received.Bytes(), content) {
+			t.Errorf("Expected %d bytes of %s, got %d", len(content), name, received.Len())
+		}
+	}
+}
+
+func TestConformanceWriteRequest(t *testing.T) {
+	for name, content := range conformanceFiles {
+		f := newFakeServer(t)
+		result := f.start(packets.WriteRequest{FileName: name, Mode: packets.OCTET}, func(h *Handler) error {
+			return h.WriteFrom(bytes.NewReader(content))
+		})
+
+		f.send(packets.Ack{BlockNumber: 0})
+		var sent []byte
+		for i, payload := range blocks(content) {
+			data := f.expectData(uint16(i + 1))
+			if !bytes.Equal(data, payload) {
+				t.Fatalf("Expected block %d of %s with %d bytes, got %d", i+1, name, len(payload), len(data))
+			}
+			sent = append(sent, data...)
+			f.send(packets.Ack{BlockNumber: uint16(i + 1)})
+		}
+
+		if err := f.expectResult(result); err != nil {
+			t.Errorf("Error sending %s: %v", name, err)
+		}
+		f.expectNothing(conformanceTimeout / 2)
+	}
+}
+
+func TestConformanceFileNotFound(t *testing.T) {
+	f := newFakeServer(t)
+	result := f.start(packets.ReadRequest{FileName: "missing.bin", Mode: packets.OCTET}, func(h *Handler) error {
+		return h.ReadTo(&bytes.Buffer{})
+	})
+
+	f.send(packets.Error{ErrCode: packets.ErrNotFound, Message: "File not found"})
+
+	var remote *RemoteError
+	if err := f.expectResult(result); !errors.As(err, &remote) || remote.Code != packets.ErrNotFound {
+		t.Errorf("Expected a not found error, got %v", err)
+	}
+}
+
+func TestConformanceIllegalOpcode(t *testing.T) {
+	f := newFakeServer(t)
+	result := f.start(packets.ReadRequest{FileName: "fw.bin", Mode: packets.OCTET}, func(h *Handler) error {
+		return h.ReadTo(&bytes.Buffer{})
+	})
+
+	f.sendData(1, bytes.Repeat([]byte("x"), packets.BlockSize))
+	f.expectAck(1)
+	f.sendRaw([]byte{0, 9, 0, 2})
+	f.expectError(packets.ErrIllegalOp)
+	if err := f.expectResult(result); err == nil {
+		t.Errorf("Expected the transfer to fail")
+	}
+}
+
+func TestConformanceDuplicateAck(t *testing.T) {
+	content := bytes.Repeat([]byte("x"), 2*packets.BlockSize+10)
+	f := newFakeServer(t)
+	result := f.start(packets.WriteRequest{FileName: "fw.bin", Mode: packets.OCTET}, func(h *Handler) error {
+		return h.WriteFrom(bytes.NewReader(content))
+	})
+
+	f.send(packets.Ack{BlockNumber: 0})
+	f.expectData(1)
+
+	// a delayed duplicate of ACK 1 must not make the client send block 2 again (Sorcerer's Apprentice)
+	f.send(packets.Ack{BlockNumber: 1})
+	f.send(packets.Ack{BlockNumber: 1})
+	f.expectData(2)
+	f.expectNothing(conformanceTimeout / 20)
+
+	f.send(packets.Ack{BlockNumber: 2})
+	f.expectData(3)
+	f.send(packets.Ack{BlockNumber: 3})
+	if err := f.expectResult(result); err != nil {
+		t.Errorf("Error sending: %v", err)
+	}
+}
+
+func TestConformanceDuplicateData(t *testing.T) {
+	content := bytes.Repeat([]byte("d"), packets.BlockSize+10)
+	f := newFakeServer(t)
+	var received bytes.Buffer
+	result := f.start(packets.ReadRequest{FileName: "fw.bin", Mode: packets.OCTET}, func(h *Handler) error {
+		return h.ReadTo(&received)
+	})
+
+	// the duplicate is acknowledged again, but only written once
+	f.sendData(1, content[:packets.BlockSize])
+	f.expectAck(1)
+	f.sendData(1, content[:packets.BlockSize])
+	f.expectAck(1)
+	f.sendData(2, content[packets.BlockSize:])
+	f.expectAck(2)
+
+	if err := f.expectResult(result); err != nil || !bytes.Equal(received.Bytes(), content) {
+		t.Errorf("Expected %d bytes, got %d (%v)", len(content), received.Len(), err)
+	}
+}
+
+func TestConformanceUnknownTransferID(t *testing.T) {
+	content := bytes.Repeat([]byte("x"), packets.BlockSize+10)
+	f := newFakeServer(t)
+	var received bytes.Buffer
+	result := f.start(packets.ReadRequest{FileName: "fw.bin", Mode: packets.OCTET}, func(h *Handler) error {
+		return h.ReadTo(&received)
+	})
+
+	f.sendData(1, content[:packets.BlockSize])
+	f.expectAck(1)
+
+	// a packet from another port is answered with an ERROR, the transfer goes on
+	stranger := &fakeServer{t: t, conn: f.listen, client: f.client}
+	stranger.sendData(2, []byte("intruder"))
+	stranger.expectError(packets.ErrUnknownID)
+
+	f.sendData(2, content[packets.BlockSize:])
+	f.expectAck(2)
+	if err := f.expectResult(result); err != nil || !bytes.Equal(received.Bytes(), content) {
+		t.Errorf("Expected %d bytes, got %d (%v)", len(content), received.Len(), err)
+	}
+}
+
+func TestConformanceReadTimeout(t *testing.T) {
+	f := newFakeServer(t)
+	result := f.start(packets.ReadRequest{FileName: "fw.bin", Mode: packets.OCTET}, func(h *Handler) error {
+		return h.ReadTo(&bytes.Buffer{})
+	})
+
+	f.sendData(1, bytes.Repeat([]byte("x"), packets.BlockSize))
+	f.expectAck(1)
+
+	// without the next block the last ACK is sent again
+	f.expectAck(1)
+	f.sendData(2, nil)
+	f.expectAck(2)
+	if err := f.expectResult(result); err != nil {
+		t.Errorf("Error receiving: %v", err)
+	}
+}
+
+func TestConformanceWriteTimeout(t *testing.T) {
+	f := newFakeServer(t)
+	result := f.start(packets.WriteRequest{FileName: "fw.bin", Mode: packets.OCTET}, func(h *Handler) error {
+		return h.WriteFrom(bytes.NewReader([]byte("firmware")))
+	})
+
+	f.send(packets.Ack{BlockNumber: 0})
+	first := f.expectData(1)
+
+	// without an ACK the block is sent again
+	if again := f.expectData(1); !bytes.Equal(first, again) {
+		t.Errorf("Expected the same block again")
+	}
+	f.send(packets.Ack{BlockNumber: 1})
+	if err := f.expectResult(result); err != nil {
+		t.Errorf("Error sending: %v", err)
+	}
+}
+
+func TestConformanceGetRequestLost(t *testing.T) {
+	f := newFakeServer(t)
+	addr := f.listen.LocalAddr().String()
+	local := filepath.Join(t.TempDir(), "fw.bin")
+	result := make(chan error, 1)
+	go func() { result <- Get(addr, "fw.bin", local, conformanceTimeout) }()
+
+	// the first request is lost, the client sends it again well before its deadline
+	buf := make([]byte, packets.DatagramSize)
+	for i := 0; i < 2; i++ {
+		f.listen.SetReadDeadline(time.Now().Add(conformanceTimeout / 2))
+		var err error
+		if _, f.client, err = f.listen.ReadFrom(buf); err != nil {
+			t.Fatalf("Expected request %d, got %v", i+1, err)
+		}
+	}
+	f.sendData(1, []byte("firmware"))
+	f.expectAck(1)
+
+	if err := f.expectResult(result); err != nil {
+		t.Fatalf("Expected the file, got %v", err)
+	}
+	if content, err := os.ReadFile(local); err != nil || string(content) != "firmware" {
+		t.Errorf("Expected the file to be stored, got %q (%v)", content, err)
+	}
+}
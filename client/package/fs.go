@@ -0,0 +1,249 @@
+package client
+
+import (
+	"TFTP/packets"
+	"bufio"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"time"
+)
+
+// FS exposes the files of a TFTP server as an fs.FS, so they can be used with fs.ReadFile,
+// fs.WalkDir, http.FS, template.ParseFS and so on.
+//
+// Open sends a read request, the returned file streams the blocks as they are read: the next block
+// is only acknowledged once the previous one was consumed. Stat and ReadDir use the directory
+// listing of the server (see packets.ListFileName).
+type FS struct {
+	Server  string        // address of the server
+	Timeout time.Duration // deadline of every read of a transfer, DEFAULT_TIMEOUT when zero
+}
+
+var (
+	_ fs.StatFS    = (*FS)(nil)
+	_ fs.ReadDirFS = (*FS)(nil)
+)
+
+func (fsys *FS) timeout() time.Duration {
+	if fsys.Timeout == 0 {
+		return DEFAULT_TIMEOUT
+	}
+	return fsys.Timeout
+}
+
+func (fsys *FS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+
+	if name == "." {
+		return &remoteDir{fsys: fsys, name: name, info: rootInfo{}}, nil
+	}
+
+	file, err := fsys.openFile(name)
+	if err == nil {
+		return file, nil
+	}
+
+	// directories cannot be read, the listing of the parent tells whether the name is one
+	var remote *RemoteError
+	if errors.As(err, &remote) {
+		if info, statErr := fsys.Stat(name); statErr == nil && info.IsDir() {
+			return &remoteDir{fsys: fsys, name: name, info: info}, nil
+		}
+	}
+
+	return nil, &fs.PathError{Op: "open", Path: name, Err: pathError(err)}
+}
+
+// openFile starts the transfer and waits for the first block, so that errors are reported by Open.
+func (fsys *FS) openFile(name string) (*remoteFile, error) {
+	serverIP := fsys.Server
+	rrq := packets.ReadRequest{
+		FileName: name,
+		Mode:     packets.OCTET,
+		Options:  map[string]string{packets.OptTransferSize: "0"},
+	}
+
+	conn, err := SendRequest(rrq, &serverIP)
+	if err != nil {
+		return nil, err
+	}
+
+	handler := NewHandler(conn, fsys.timeout())
+	handler.Logger = RequestLogger(rrq, serverIP)
+	pr, pw := io.Pipe()
+	go func() {
+		defer conn.Close()
+		pw.CloseWithError(handler.ReadTo(pw))
+	}()
+
+	r := bufio.NewReaderSize(pr, packets.BlockSize)
+	_, err = r.Peek(1)
+	if err != nil && err != io.EOF {
+		pr.Close()
+		return nil, err
+	}
+
+	// the OACK is handled before the first block is written to the pipe
+	info := fileInfo{ListEntry: packets.ListEntry{Name: path.Base(name), Size: handler.TransferSize}}
+	if info.ListEntry.Size < 0 {
+		info.ListEntry.Size = 0
+	}
+
+	return &remoteFile{fsys: fsys, name: name, r: r, pipe: pr, info: info}, nil
+}
+
+func (fsys *FS) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+
+	if name == "." {
+		return rootInfo{}, nil
+	}
+
+	entries, err := List(fsys.Server, path.Dir(name), fsys.timeout())
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: pathError(err)}
+	}
+
+	base := path.Base(name)
+	for _, entry := range entries {
+		if entry.Name == base {
+			return fileInfo{entry}, nil
+		}
+	}
+
+	return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+}
+
+func (fsys *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+
+	entries, err := List(fsys.Server, name, fsys.timeout())
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: pathError(err)}
+	}
+
+	dirEntries := make([]fs.DirEntry, 0, len(entries))
+	for _, entry := range entries {
+		dirEntries = append(dirEntries, fs.FileInfoToDirEntry(fileInfo{entry}))
+	}
+	sort.Slice(dirEntries, func(i, j int) bool { return dirEntries[i].Name() < dirEntries[j].Name() })
+
+	return dirEntries, nil
+}
+
+// pathError maps the ERROR packets of the server to the errors of the fs package.
+func pathError(err error) error {
+	var remote *RemoteError
+	if errors.As(err, &remote) {
+		switch remote.Code {
+		case packets.ErrNotFound:
+			return fs.ErrNotExist
+		case packets.ErrAccessViolation:
+			return fs.ErrPermission
+		}
+	}
+	return err
+}
+
+type remoteFile struct {
+	fsys   *FS
+	name   string
+	r      *bufio.Reader
+	pipe   *io.PipeReader
+	info   fileInfo // name and size reported with tsize
+	listed fs.FileInfo
+}
+
+// Stat prefers the entry of the directory listing, which also has the modification time,
+// and falls back to the size the server reported when the transfer started.
+func (f *remoteFile) Stat() (fs.FileInfo, error) {
+	if f.listed == nil {
+		info, err := f.fsys.Stat(f.name)
+		if err != nil {
+			return f.info, nil
+		}
+		f.listed = info
+	}
+	return f.listed, nil
+}
+
+func (f *remoteFile) Read(p []byte) (int, error) { return f.r.Read(p) }
+
+// Close aborts the transfer if the file was not read to the end.
+func (f *remoteFile) Close() error { return f.pipe.Close() }
+
+type remoteDir struct {
+	fsys    *FS
+	name    string
+	info    fs.FileInfo
+	entries []fs.DirEntry
+	read    bool
+}
+
+func (d *remoteDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *remoteDir) Close() error               { return nil }
+
+func (d *remoteDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: errors.New("is a directory")}
+}
+
+func (d *remoteDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !d.read {
+		entries, err := d.fsys.ReadDir(d.name)
+		if err != nil {
+			return nil, err
+		}
+		d.entries, d.read = entries, true
+	}
+
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+
+	n = min(n, len(d.entries))
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
+
+// fileInfo describes a remote file with an entry of the directory listing.
+type fileInfo struct {
+	packets.ListEntry
+}
+
+func (i fileInfo) Name() string       { return i.ListEntry.Name }
+func (i fileInfo) Size() int64        { return i.ListEntry.Size }
+func (i fileInfo) ModTime() time.Time { return i.ListEntry.ModTime }
+func (i fileInfo) IsDir() bool        { return i.ListEntry.IsDir }
+func (i fileInfo) Sys() any           { return nil }
+
+func (i fileInfo) Mode() fs.FileMode {
+	if i.ListEntry.IsDir {
+		return fs.ModeDir | 0555
+	}
+	return 0444
+}
+
+type rootInfo struct{}
+
+func (rootInfo) Name() string       { return "." }
+func (rootInfo) Size() int64        { return 0 }
+func (rootInfo) Mode() fs.FileMode  { return fs.ModeDir | 0555 }
+func (rootInfo) ModTime() time.Time { return time.Time{} }
+func (rootInfo) IsDir() bool        { return true }
+func (rootInfo) Sys() any           { return nil }
@@ -0,0 +1,58 @@
+package client
+
+import (
+	"TFTP/packets"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"text/tabwriter"
+	"time"
+)
+
+// List fetches the listing the server generates for the directory, see packets.ListFileName.
+func List(serverIP, dir string, timeout time.Duration) ([]packets.ListEntry, error) {
+	data, err := fetch(serverIP, path.Join(dir, packets.ListFileName), timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []packets.ListEntry
+	err = json.Unmarshal(data, &entries)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid listing: %v", err)
+	}
+
+	return entries, nil
+}
+
+// fetch downloads a small remote file into memory.
+func fetch(serverIP, remote string, timeout time.Duration) ([]byte, error) {
+	file, err := os.CreateTemp("", "tftp-fetch-")
+	if err != nil {
+		return nil, err
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+
+	err = Get(serverIP, remote, file.Name(), timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	return os.ReadFile(file.Name())
+}
+
+// WriteListing prints the entries of a listing, one per line.
+func WriteListing(w io.Writer, entries []packets.ListEntry) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, entry := range entries {
+		kind, name := "-", entry.Name
+		if entry.IsDir {
+			kind, name = "d", entry.Name+"/"
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\n", kind, entry.Size, entry.ModTime.Local().Format(time.DateTime), entry.SHA256, name)
+	}
+	tw.Flush()
+}
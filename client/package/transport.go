@@ -0,0 +1,157 @@
+package client
+
+import (
+	"TFTP/packets"
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const DEFAULT_TIMEOUT = 10 * time.Second
+
+// Transport is an http.RoundTripper for tftp:// URLs, GET downloads the file and PUT uploads the request body.
+// It is meant to be registered on an http.Transport:
+//
+//	transport := http.DefaultTransport.(*http.Transport).Clone()
+//	transport.RegisterProtocol("tftp", &client.Transport{})
+//	resp, err := (&http.Client{Transport: transport}).Get("tftp://10.0.0.1/pxelinux.0")
+//
+// ERROR packets are turned into the closest HTTP status, e.g. ErrNotFound into 404. The transfer is aborted
+// with the error of the context of the request once it is done, also while the body of a GET is read.
+type Transport struct {
+	Timeout time.Duration // deadline of every read of a transfer, DEFAULT_TIMEOUT when zero
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		defer req.Body.Close()
+	}
+
+	u, err := ParseURL(req.URL.String())
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := t.Timeout
+	if timeout == 0 {
+		timeout = DEFAULT_TIMEOUT
+	}
+
+	switch req.Method {
+	case http.MethodGet, "":
+		return t.get(req, u, timeout)
+	case http.MethodPut:
+		return t.put(req, u, timeout)
+	default:
+		return nil, fmt.Errorf("tftp: unsupported method %s", req.Method)
+	}
+}
+
+// get streams the file into the response body. It waits for the first data so that
+// a missing file is reported with the status of the response rather than while reading the body.
+func (t *Transport) get(req *http.Request, u *URL, timeout time.Duration) (*http.Response, error) {
+	rrq := packets.ReadRequest{FileName: u.File, Mode: u.Mode}
+	conn, err := SendRequest(rrq, &u.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	// closing the socket interrupts the transfer, whatever it waits for
+	ctx := req.Context()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+
+	handler := NewHandler(conn, timeout)
+	handler.Logger = RequestLogger(rrq, u.Host)
+	pr, pw := io.Pipe()
+	go func() {
+		defer conn.Close()
+		defer stop()
+		err := handler.ReadTo(pw)
+		if err != nil && ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	body := bufio.NewReaderSize(pr, packets.BlockSize)
+	_, err = body.Peek(1)
+	if err != nil && err != io.EOF {
+		pr.Close()
+		return errorResponse(req, err)
+	}
+
+	return response(req, http.StatusOK, struct {
+		io.Reader
+		io.Closer
+	}{body, pr}), nil
+}
+
+func (t *Transport) put(req *http.Request, u *URL, timeout time.Duration) (*http.Response, error) {
+	wrq := packets.WriteRequest{FileName: u.File, Mode: u.Mode}
+	conn, err := SendRequest(wrq, &u.Host)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	ctx := req.Context()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	var body io.Reader = http.NoBody
+	if req.Body != nil {
+		body = req.Body
+	}
+
+	handler := NewHandler(conn, timeout)
+	handler.Logger = RequestLogger(wrq, u.Host)
+	err = handler.WriteFrom(body)
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		return errorResponse(req, err)
+	}
+
+	return response(req, http.StatusCreated, http.NoBody), nil
+}
+
+// errorResponse turns an ERROR packet into a response, any other error fails the round trip.
+func errorResponse(req *http.Request, err error) (*http.Response, error) {
+	var remote *RemoteError
+	if !errors.As(err, &remote) {
+		return nil, err
+	}
+
+	status := http.StatusBadGateway
+	switch remote.Code {
+	case packets.ErrNotFound:
+		status = http.StatusNotFound
+	case packets.ErrAccessViolation:
+		status = http.StatusForbidden
+	case packets.ErrDiskFull:
+		status = http.StatusInsufficientStorage
+	case packets.ErrFileExists:
+		status = http.StatusConflict
+	}
+
+	return response(req, status, io.NopCloser(strings.NewReader(remote.Message))), nil
+}
+
+func response(req *http.Request, status int, body io.ReadCloser) *http.Response {
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.0",
+		ProtoMajor:    1,
+		ProtoMinor:    0,
+		Header:        make(http.Header),
+		Body:          body,
+		ContentLength: -1,
+		Request:       req,
+	}
+}
@@ -0,0 +1,98 @@
+package client
+
+import (
+	"TFTP/packets"
+	"bufio"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// PutTree uploads every regular file under localDir, the files keep their paths relative to localDir under remoteDir.
+// The server has to allow creating directories for files in subdirectories.
+func (b *Batch) PutTree(localDir, remoteDir string) ([]BatchResult, error) {
+	var entries []BatchEntry
+	err := filepath.WalkDir(localDir, func(local string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(localDir, local)
+		if err != nil {
+			return err
+		}
+
+		entries = append(entries, BatchEntry{Op: "put", Remote: path.Join(remoteDir, filepath.ToSlash(rel)), Local: local})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return b.Run(entries), nil
+}
+
+// GetTree downloads the index the server generates for remoteDir (see packets.IndexFileName)
+// and then every file it lists, reproducing the directory tree under localDir.
+func (b *Batch) GetTree(remoteDir, localDir string) ([]BatchResult, error) {
+	index, err := os.CreateTemp("", "tftp-index-")
+	if err != nil {
+		return nil, err
+	}
+	index.Close()
+	defer os.Remove(index.Name())
+
+	result := b.run(BatchEntry{Op: "get", Remote: path.Join(remoteDir, packets.IndexFileName), Local: index.Name(), Server: b.Server})
+	if result.Err != nil {
+		return nil, fmt.Errorf("Error fetching index of '%s': %v", remoteDir, result.Err)
+	}
+
+	names, err := readIndex(index.Name())
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]BatchEntry, 0, len(names))
+	for _, name := range names {
+		local := filepath.Join(localDir, filepath.FromSlash(name))
+		err = os.MkdirAll(filepath.Dir(local), 0755)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, BatchEntry{Op: "get", Remote: path.Join(remoteDir, name), Local: local})
+	}
+
+	return b.Run(entries), nil
+}
+
+// readIndex reads the file paths of an index, paths that would end up outside of the local directory are rejected.
+func readIndex(name string) ([]string, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var names []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		name := strings.TrimSpace(scanner.Text())
+		if name == "" {
+			continue
+		}
+
+		if !filepath.IsLocal(filepath.FromSlash(name)) {
+			return nil, fmt.Errorf("Invalid path in index: %q", name)
+		}
+		names = append(names, name)
+	}
+
+	return names, scanner.Err()
+}
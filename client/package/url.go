@@ -0,0 +1,84 @@
+package client
+
+import (
+	"TFTP/packets"
+	"errors"
+	"net"
+	"net/url"
+	"strings"
+)
+
+const DEFAULT_PORT = "69"
+
+// URL is a tftp:// URL as described in RFC 3617: tftp://host[:port]/file[;mode=octet|netascii]
+type URL struct {
+	Host string // host and port, the port is 69 when the URL does not name one
+	File string // name of the file on the server, without the leading slash
+	Mode string // transfer mode, octet unless the URL names another one
+}
+
+// ParseURL parses a tftp:// URL, the file name is percent-decoded.
+func ParseURL(raw string) (*URL, error) {
+	parsed, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	if parsed.Scheme != "tftp" {
+		return nil, errors.New("Invalid TFTP URL: scheme must be tftp")
+	}
+
+	if parsed.Host == "" || parsed.User != nil || parsed.RawQuery != "" || parsed.Fragment != "" {
+		return nil, errors.New("Invalid TFTP URL: expected tftp://host[:port]/file[;mode=octet|netascii]")
+	}
+
+	u := &URL{Host: parsed.Host, Mode: packets.OCTET}
+	if parsed.Port() == "" {
+		u.Host = net.JoinHostPort(parsed.Hostname(), DEFAULT_PORT)
+	}
+
+	// the mode is split off before decoding, so an escaped ; can be part of the file name
+	file := strings.TrimPrefix(parsed.EscapedPath(), "/")
+	if i := strings.LastIndex(file, ";"); i >= 0 {
+		mode, ok := strings.CutPrefix(strings.ToLower(file[i+1:]), "mode=")
+		if !ok || (mode != packets.OCTET && mode != packets.NETASCII) {
+			return nil, errors.New("Invalid TFTP URL: unknown mode")
+		}
+		u.Mode = mode
+		file = file[:i]
+	}
+
+	file, err = url.PathUnescape(file)
+	if err != nil {
+		return nil, err
+	}
+
+	if file == "" {
+		return nil, errors.New("Invalid TFTP URL: missing file name")
+	}
+	u.File = file
+
+	return u, nil
+}
+
+// IsURL reports whether the argument is a tftp:// URL rather than a host or file name.
+func IsURL(s string) bool {
+	return strings.HasPrefix(strings.ToLower(s), "tftp://")
+}
+
+func (u *URL) String() string {
+	host := u.Host
+	if h, port, err := net.SplitHostPort(u.Host); err == nil && port == DEFAULT_PORT {
+		host = h
+		if strings.Contains(h, ":") {
+			host = "[" + h + "]"
+		}
+	}
+
+	file := (&url.URL{Path: u.File}).EscapedPath()
+	s := "tftp://" + host + "/" + file
+	if u.Mode != "" && u.Mode != packets.OCTET {
+		s += ";mode=" + u.Mode
+	}
+	return s
+}
@@ -0,0 +1,58 @@
+// Package logging sets up the log/slog logger of the commands from their flags.
+//
+// The server, the client and the transfers log with the same attributes, so that a transfer can be
+// traced end to end: session, client, server, file, mode, block, bytes, duration, code and error.
+package logging
+
+import (
+	"errors"
+	"flag"
+	"io"
+	"log/slog"
+	"strconv"
+)
+
+// Format is the output format of the logs. It implements flag.Value.
+type Format string
+
+const (
+	Text Format = "text" // key=value pairs, the default
+	JSON Format = "json" // a JSON object per line
+)
+
+func (f *Format) String() string {
+	if f == nil || *f == "" {
+		return string(Text)
+	}
+	return string(*f)
+}
+
+func (f *Format) Set(value string) error {
+	switch Format(value) {
+	case Text, JSON:
+		*f = Format(value)
+		return nil
+	}
+	return errors.New("Invalid log format " + strconv.Quote(value) + ", expected text or json")
+}
+
+// Config is how a command logs.
+type Config struct {
+	Level  slog.Level // least important level logged, slog.LevelInfo by default
+	Format Format
+}
+
+// RegisterFlags adds the -log-level and -log-format flags to fs.
+func (c *Config) RegisterFlags(fs *flag.FlagSet) {
+	fs.TextVar(&c.Level, "log-level", slog.LevelInfo, "Least important level logged: debug, info, warn or error")
+	fs.Var(&c.Format, "log-format", "Format of the logs: text or json")
+}
+
+// New returns a logger that writes to w.
+func (c Config) New(w io.Writer) *slog.Logger {
+	options := &slog.HandlerOptions{Level: c.Level}
+	if c.Format == JSON {
+		return slog.New(slog.NewJSONHandler(w, options))
+	}
+	return slog.New(slog.NewTextHandler(w, options))
+}
@@ -0,0 +1,55 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"strings"
+	"testing"
+)
+
+func TestFlags(t *testing.T) {
+	var c Config
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	c.RegisterFlags(fs)
+	if err := fs.Parse([]string{"-log-level", "warn", "-log-format", "json"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	logger := c.New(&buf)
+	logger.Info("hidden")
+	logger.Warn("timeout waiting for ACK", "session", 7, "block", 3)
+
+	var record map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("Expected a single JSON record, got %q: %v", buf.String(), err)
+	}
+	if record["msg"] != "timeout waiting for ACK" || record["level"] != "WARN" || record["session"] != 7.0 || record["block"] != 3.0 {
+		t.Errorf("Unexpected record %v", record)
+	}
+}
+
+func TestDefaults(t *testing.T) {
+	var c Config
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	c.RegisterFlags(fs)
+	if err := fs.Parse(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	logger := c.New(&buf)
+	logger.Debug("hidden")
+	logger.Info("file sent", "file", "fw.bin")
+	if out := buf.String(); !strings.Contains(out, "level=INFO msg=\"file sent\" file=fw.bin") || strings.Contains(out, "hidden") {
+		t.Errorf("Unexpected text output %q", out)
+	}
+}
+
+func TestInvalidFormat(t *testing.T) {
+	var f Format
+	if err := f.Set("xml"); err == nil {
+		t.Errorf("Expected xml to be refused")
+	}
+}
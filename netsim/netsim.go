@@ -0,0 +1,319 @@
+// Package netsim simulates an unreliable datagram network in memory, so transfers between the
+// client and the server can be tested under packet loss, duplication, reordering, delay and
+// corruption without touching the real network.
+//
+// Every decision is taken from a random source seeded with Config.Seed, the same seed damages the
+// same packets as long as they are sent in the same order.
+package netsim
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// queueSize is the number of datagrams a socket buffers before new ones are dropped, like a full
+// receive buffer of a UDP socket.
+const queueSize = 256
+
+// Config describes how the network mistreats the datagrams sent over it.
+// The probabilities range from 0 (never) to 1 (always).
+type Config struct {
+	Seed int64
+
+	Loss      float64                // probability a datagram is dropped
+	Drop      func(data []byte) bool // drops the datagrams it returns true for, e.g. a given packet, may be nil
+	Duplicate float64                // probability a datagram is delivered twice
+	Corrupt   float64                // probability a byte of the block number of a DATA or ACK packet is flipped
+	Reorder   float64                // probability a datagram is held back by ReorderDelay, so later ones overtake it
+
+	ReorderDelay time.Duration // how long reordered datagrams are held back, 10ms when zero
+	Delay        time.Duration // latency of every datagram
+	Jitter       time.Duration // random latency added to Delay
+}
+
+// Stats counts what happened to the datagrams sent over a network.
+type Stats struct {
+	Sent       int
+	Delivered  int
+	Lost       int
+	Duplicated int
+	Corrupted  int
+	Reordered  int
+}
+
+// Network connects the sockets opened with Listen.
+type Network struct {
+	mu       sync.Mutex
+	cfg      Config
+	rand     *rand.Rand
+	conns    map[string]*PacketConn
+	nextPort int
+	stats    Stats
+}
+
+func NewNetwork(cfg Config) *Network {
+	if cfg.ReorderDelay == 0 {
+		cfg.ReorderDelay = 10 * time.Millisecond
+	}
+
+	return &Network{
+		cfg:      cfg,
+		rand:     rand.New(rand.NewSource(cfg.Seed)),
+		conns:    make(map[string]*PacketConn),
+		nextPort: 49152,
+	}
+}
+
+// Stats returns the counters of the datagrams sent so far.
+func (n *Network) Stats() Stats {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.stats
+}
+
+// Listen opens a socket on addr, a "host:port" pair. The host is only a name, port 0 picks an unused port.
+func (n *Network) Listen(addr string) (*PacketConn, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 65535 {
+		return nil, errors.New("Invalid port: " + portStr)
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if port == 0 {
+		for ; n.conns[(&Addr{host, n.nextPort}).String()] != nil; n.nextPort++ {
+		}
+		port = n.nextPort
+		n.nextPort++
+	}
+
+	local := &Addr{Host: host, Port: port}
+	if n.conns[local.String()] != nil {
+		return nil, &net.OpError{Op: "listen", Net: network, Addr: local, Err: errors.New("address already in use")}
+	}
+
+	conn := &PacketConn{
+		network:         n,
+		local:           local,
+		queue:           make(chan datagram, queueSize),
+		closed:          make(chan struct{}),
+		deadlineChanged: make(chan struct{}),
+	}
+	n.conns[local.String()] = conn
+	return conn, nil
+}
+
+// send applies the configuration to a datagram and schedules its delivery.
+func (n *Network) send(from *Addr, to net.Addr, p []byte) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.stats.Sent++
+	if n.rand.Float64() < n.cfg.Loss || n.cfg.Drop != nil && n.cfg.Drop(p) {
+		n.stats.Lost++
+		return
+	}
+
+	copies := 1
+	if n.rand.Float64() < n.cfg.Duplicate {
+		n.stats.Duplicated++
+		copies++
+	}
+
+	for i := 0; i < copies; i++ {
+		data := append([]byte(nil), p...)
+		if isBlock(data) && n.rand.Float64() < n.cfg.Corrupt {
+			//UDP checksums discard damaged datagrams, so only the block number is damaged here
+			//to exercise how the protocol copes with unexpected blocks
+			data[2+n.rand.Intn(2)] ^= byte(1 + n.rand.Intn(255))
+			n.stats.Corrupted++
+		}
+
+		delay := n.cfg.Delay
+		if n.cfg.Jitter > 0 {
+			delay += time.Duration(n.rand.Int63n(int64(n.cfg.Jitter)))
+		}
+		if n.rand.Float64() < n.cfg.Reorder {
+			delay += n.cfg.ReorderDelay
+			n.stats.Reordered++
+		}
+
+		d := datagram{from: from, data: data}
+		key := to.String()
+		if delay == 0 {
+			n.deliver(key, d)
+			continue
+		}
+		time.AfterFunc(delay, func() {
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			n.deliver(key, d)
+		})
+	}
+}
+
+// deliver queues a datagram on the socket listening on to, it is dropped when there is none.
+// The network has to be locked.
+func (n *Network) deliver(to string, d datagram) {
+	conn := n.conns[to]
+	if conn == nil {
+		return
+	}
+
+	select {
+	case conn.queue <- d:
+		n.stats.Delivered++
+	default:
+	}
+}
+
+const network = "sim"
+
+// Addr is the address of a socket of a simulated network.
+type Addr struct {
+	Host string
+	Port int
+}
+
+func (a *Addr) Network() string { return network }
+func (a *Addr) String() string  { return net.JoinHostPort(a.Host, strconv.Itoa(a.Port)) }
+
+type datagram struct {
+	from *Addr
+	data []byte
+}
+
+// PacketConn is a socket of a simulated network.
+type PacketConn struct {
+	network *Network
+	local   *Addr
+	queue   chan datagram
+
+	closeOnce sync.Once
+	closed    chan struct{}
+
+	mu              sync.Mutex
+	readDeadline    time.Time
+	deadlineChanged chan struct{}
+}
+
+var _ net.PacketConn = (*PacketConn)(nil)
+
+// ReadFrom reads the next datagram, the part that does not fit into p is discarded.
+func (c *PacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		select {
+		case <-c.closed:
+			return 0, nil, c.opError("read", net.ErrClosed)
+		default:
+		}
+
+		c.mu.Lock()
+		deadline, changed := c.readDeadline, c.deadlineChanged
+		c.mu.Unlock()
+
+		var (
+			timer   *time.Timer
+			expired <-chan time.Time
+		)
+		if !deadline.IsZero() {
+			timer = time.NewTimer(time.Until(deadline))
+			expired = timer.C
+		}
+
+		var (
+			d   *datagram
+			err error
+		)
+		select {
+		case next := <-c.queue:
+			d = &next
+		case <-c.closed:
+			err = net.ErrClosed
+		case <-expired:
+			err = os.ErrDeadlineExceeded
+		case <-changed:
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+		if d != nil {
+			return copy(p, d.data), d.from, nil
+		}
+		if err != nil {
+			return 0, nil, c.opError("read", err)
+		}
+	}
+}
+
+// WriteTo sends a datagram to addr, which does not have to exist, like UDP.
+func (c *PacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, c.opError("write", net.ErrClosed)
+	default:
+	}
+
+	if addr == nil {
+		return 0, c.opError("write", errors.New("missing address"))
+	}
+
+	c.network.send(c.local, addr, p)
+	return len(p), nil
+}
+
+func (c *PacketConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.network.mu.Lock()
+		delete(c.network.conns, c.local.String())
+		c.network.mu.Unlock()
+	})
+	return nil
+}
+
+func (c *PacketConn) LocalAddr() net.Addr { return c.local }
+
+func (c *PacketConn) SetDeadline(t time.Time) error { return c.SetReadDeadline(t) }
+
+// SetReadDeadline also applies to reads already waiting.
+func (c *PacketConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	close(c.deadlineChanged)
+	c.deadlineChanged = make(chan struct{})
+	return nil
+}
+
+// SetWriteDeadline does nothing, writes never block.
+func (c *PacketConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// Listen opens a socket on an unused port of the host of c, it can be used as server.Server.Listen.
+func (c *PacketConn) Listen() (net.PacketConn, error) {
+	conn, err := c.network.Listen(net.JoinHostPort(c.local.Host, "0"))
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (c *PacketConn) opError(op string, err error) error {
+	return &net.OpError{Op: op, Net: network, Addr: c.local, Err: err}
+}
+
+// isBlock tells whether a datagram is a DATA or ACK packet, the ones with a block number.
+func isBlock(data []byte) bool {
+	return len(data) >= 4 && data[0] == 0 && (data[1] == 3 || data[1] == 4)
+}
@@ -0,0 +1,222 @@
+package netsim_test
+
+import (
+	client "TFTP/client/package"
+	"TFTP/netsim"
+	"TFTP/packets"
+	server "TFTP/server/package"
+	"bytes"
+	"errors"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+const timeout = 100 * time.Millisecond
+
+// startServer serves root on the simulated network and returns the address of the server.
+func startServer(t *testing.T, network *netsim.Network, root string) net.Addr {
+	t.Helper()
+	conn, err := network.Listen("server:69")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	s := &server.Server{Root: root, Timeout: timeout, Retries: 20, Listen: conn.Listen}
+	go s.Serve(conn)
+	return conn.LocalAddr()
+}
+
+// newHandler sends the request from a new client socket and returns the handler of the transfer.
+func newHandler(t *testing.T, network *netsim.Network, req packets.Request, serverAddr net.Addr) *client.Handler {
+	t.Helper()
+	conn, err := network.Listen("client:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	if err = client.SendRequestTo(conn, req, serverAddr); err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	handler := client.NewHandler(conn, 10*timeout)
+	handler.Request, handler.Server = req, serverAddr
+	return handler
+}
+
+// content returns size random bytes, so misplaced blocks cannot go unnoticed.
+func content(size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(data)
+	return data
+}
+
+// testTransfers downloads and uploads a file over a network with cfg and compares the results byte by byte.
+func testTransfers(t *testing.T, cfg netsim.Config) {
+	// a partial last block and an empty last block
+	for _, size := range []int{20*packets.BlockSize + 100, 8 * packets.BlockSize} {
+		network := netsim.NewNetwork(cfg)
+		root := t.TempDir()
+		expected := content(size)
+		if err := os.WriteFile(filepath.Join(root, "fw.bin"), expected, 0644); err != nil {
+			t.Fatal(err)
+		}
+		serverAddr := startServer(t, network, root)
+
+		var downloaded bytes.Buffer
+		handler := newHandler(t, network, packets.ReadRequest{FileName: "fw.bin", Mode: packets.OCTET}, serverAddr)
+		if err := handler.ReadTo(&downloaded); err != nil {
+			t.Errorf("Error downloading %d bytes: %v", size, err)
+		} else if !bytes.Equal(downloaded.Bytes(), expected) {
+			t.Errorf("Expected %d downloaded bytes, got %d different ones", size, downloaded.Len())
+		}
+
+		handler = newHandler(t, network, packets.WriteRequest{FileName: "up.bin", Mode: packets.OCTET}, serverAddr)
+		if err := handler.WriteFrom(bytes.NewReader(expected)); err != nil {
+			t.Errorf("Error uploading %d bytes: %v", size, err)
+		} else if uploaded, err := os.ReadFile(filepath.Join(root, "received/up.bin")); err != nil || !bytes.Equal(uploaded, expected) {
+			t.Errorf("Expected %d uploaded bytes, got %d different ones (%v)", size, len(uploaded), err)
+		}
+
+		t.Logf("%d bytes: %+v", size, network.Stats())
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	testTransfers(t, netsim.Config{Seed: 1})
+}
+
+func TestTransferWithDelay(t *testing.T) {
+	testTransfers(t, netsim.Config{Seed: 2, Delay: 2 * time.Millisecond, Jitter: time.Millisecond})
+}
+
+func TestTransferWithLoss(t *testing.T) {
+	testTransfers(t, netsim.Config{Seed: 3, Loss: 0.1})
+}
+
+func TestTransferWithDuplicates(t *testing.T) {
+	testTransfers(t, netsim.Config{Seed: 4, Duplicate: 0.1})
+}
+
+func TestTransferWithReordering(t *testing.T) {
+	// held back longer than the timeout, so the retransmission overtakes the original
+	testTransfers(t, netsim.Config{Seed: 5, Reorder: 0.1, ReorderDelay: 3 * timeout / 2})
+}
+
+func TestTransferWithCorruption(t *testing.T) {
+	testTransfers(t, netsim.Config{Seed: 6, Corrupt: 0.05})
+}
+
+func TestAntiReflectionFirstPacketLost(t *testing.T) {
+	// the first DATA without options, the OACK with options
+	for _, options := range []map[string]string{nil, {packets.OptBlockSize: "1024"}} {
+		lost := false
+		network := netsim.NewNetwork(netsim.Config{Drop: func(data []byte) bool {
+			first := !lost && len(data) >= 2 && (data[1] == byte(packets.DATA) || data[1] == byte(packets.OACK))
+			lost = lost || first
+			return first
+		}})
+		root := t.TempDir()
+		expected := content(3*packets.BlockSize + 100)
+		if err := os.WriteFile(filepath.Join(root, "fw.bin"), expected, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		conn, err := network.Listen("server:69")
+		if err != nil {
+			t.Fatalf("Error listening: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		s := &server.Server{Root: root, Timeout: timeout, Retries: 5, Listen: conn.Listen, AntiReflection: true}
+		go s.Serve(conn)
+
+		// the packet sent again was already counted in the unverified bytes, it does not exhaust them.
+		// The client does not send the request again, which would start another transfer
+		var downloaded bytes.Buffer
+		handler := newHandler(t, network, packets.ReadRequest{FileName: "fw.bin", Mode: packets.OCTET, Options: options}, conn.LocalAddr())
+		handler.Server = nil
+		if err := handler.ReadTo(&downloaded); err != nil {
+			t.Errorf("Error downloading with options %v: %v", options, err)
+		} else if !bytes.Equal(downloaded.Bytes(), expected) {
+			t.Errorf("Expected %d downloaded bytes, got %d different ones", len(expected), downloaded.Len())
+		}
+		if !lost {
+			t.Errorf("Expected the first packet to be dropped")
+		}
+	}
+}
+
+func TestDeterministic(t *testing.T) {
+	cfg := netsim.Config{Seed: 7, Loss: 0.3, Duplicate: 0.3, Corrupt: 0.3, Reorder: 0.3}
+	run := func() ([]string, netsim.Stats) {
+		network := netsim.NewNetwork(cfg)
+		sender, _ := network.Listen("a:1")
+		receiver, _ := network.Listen("b:1")
+		defer sender.Close()
+		defer receiver.Close()
+
+		for i := 0; i < 100; i++ {
+			sender.WriteTo([]byte{0, 3, 0, byte(i)}, receiver.LocalAddr())
+		}
+
+		var received []string
+		buf := make([]byte, 4)
+		for {
+			receiver.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+			n, _, err := receiver.ReadFrom(buf)
+			if err != nil {
+				break
+			}
+			received = append(received, string(buf[:n]))
+		}
+		return received, network.Stats()
+	}
+
+	first, firstStats := run()
+	second, secondStats := run()
+	if firstStats != secondStats {
+		t.Errorf("Expected the same stats for the same seed, got %+v and %+v", firstStats, secondStats)
+	}
+	if firstStats.Lost == 0 || firstStats.Duplicated == 0 || firstStats.Corrupted == 0 || firstStats.Reordered == 0 {
+		t.Errorf("Expected every kind of damage, got %+v", firstStats)
+	}
+
+	// the timers of the held back datagrams may fire in any order, but the same datagrams arrive
+	sort.Strings(first)
+	sort.Strings(second)
+	if len(first) != len(second) {
+		t.Fatalf("Expected the same datagrams, got %d and %d", len(first), len(second))
+	}
+	for i := range first {
+		if first[i] != second[i] {
+			t.Errorf("Expected datagram %d to match, got %q and %q", i, first[i], second[i])
+		}
+	}
+}
+
+func TestReadDeadline(t *testing.T) {
+	network := netsim.NewNetwork(netsim.Config{})
+	conn, err := network.Listen("a:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	_, _, err = conn.ReadFrom(make([]byte, 1))
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Errorf("Expected a timeout, got %v", err)
+	}
+
+	conn.Close()
+	_, _, err = conn.ReadFrom(make([]byte, 1))
+	if !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Expected net.ErrClosed, got %v", err)
+	}
+}
@@ -0,0 +1,135 @@
+package packets
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// The functions of this file encode and decode packets without allocating: Append* functions append
+// a packet to a buffer the caller reuses, Parse* functions decode a packet in place, without copying it.
+// They are used on the hot path of a transfer, for every DATA and ACK packet.
+
+// AppendData appends a DATA packet with payload to dst. Passing a nil payload only appends the header,
+// so the payload can be read into the buffer afterwards.
+func AppendData(dst []byte, block uint16, payload []byte) []byte {
+	dst = binary.BigEndian.AppendUint16(dst, uint16(DATA))
+	dst = binary.BigEndian.AppendUint16(dst, block)
+	return append(dst, payload...)
+}
+
+// AppendAck appends an ACK packet to dst.
+func AppendAck(dst []byte, block uint16) []byte {
+	dst = binary.BigEndian.AppendUint16(dst, uint16(ACK))
+	return binary.BigEndian.AppendUint16(dst, block)
+}
+
+// AppendError appends an ERROR packet to dst.
+func AppendError(dst []byte, code ErrCode, message string) []byte {
+	dst = binary.BigEndian.AppendUint16(dst, uint16(ERROR))
+	dst = binary.BigEndian.AppendUint16(dst, uint16(code))
+	dst = append(dst, message...)
+	return append(dst, 0)
+}
+
+// AppendOptionAck appends an OACK packet with the options to dst.
+func AppendOptionAck(dst []byte, options map[string]string) []byte {
+	dst = binary.BigEndian.AppendUint16(dst, uint16(OACK))
+	return appendOptions(dst, options)
+}
+
+// ParseOpCode returns the opcode of a packet.
+func ParseOpCode(packet []byte) (OpCode, error) {
+	if len(packet) < 2 {
+		return 0, errors.New("Invalid opcode")
+	}
+	return OpCode(binary.BigEndian.Uint16(packet)), nil
+}
+
+// ParseData decodes a DATA packet in place, the payload shares the memory of packet.
+// The length of the payload is not checked, it depends on the negotiated block size.
+func ParseData(packet []byte) (uint16, []byte, error) {
+	if len(packet) < 4 || OpCode(binary.BigEndian.Uint16(packet)) != DATA {
+		return 0, nil, errors.New("Invalid data packet")
+	}
+	return binary.BigEndian.Uint16(packet[2:]), packet[4:], nil
+}
+
+// ParseAck decodes an ACK packet.
+func ParseAck(packet []byte) (uint16, error) {
+	if len(packet) < 4 || OpCode(binary.BigEndian.Uint16(packet)) != ACK {
+		return 0, errors.New("Invalid ACK packet")
+	}
+	return binary.BigEndian.Uint16(packet[2:]), nil
+}
+
+// ParseError decodes an ERROR packet.
+func ParseError(packet []byte) (ErrCode, string, error) {
+	if len(packet) < 4 || OpCode(binary.BigEndian.Uint16(packet)) != ERROR {
+		return 0, "", errors.New("Invalid error packet")
+	}
+
+	message, _, ok := readString(packet[4:])
+	if !ok {
+		return 0, "", errors.New("Invalid error message")
+	}
+	return ErrCode(binary.BigEndian.Uint16(packet[2:])), message, nil
+}
+
+// appendRequest appends a RRQ or WRQ to dst, see how the packet is structured in the README.
+func appendRequest(dst []byte, code OpCode, compress bool, fileName, mode string, options map[string]string) []byte {
+	if mode == "" {
+		mode = OCTET
+	}
+
+	dst = binary.BigEndian.AppendUint16(dst, uint16(code))
+	if compress {
+		dst = append(dst, 1)
+	} else {
+		dst = append(dst, 0)
+	}
+	dst = append(dst, fileName...)
+	dst = append(dst, 0)
+	dst = append(dst, mode...)
+	dst = append(dst, 0)
+	return appendOptions(dst, options)
+}
+
+// parseRequest decodes a RRQ or WRQ, the mode is checked by the caller.
+func parseRequest(data []byte, code OpCode) (fileName, mode string, options map[string]string, err error) {
+	actual, err := ParseOpCode(data)
+	if err != nil {
+		return "", "", nil, err
+	}
+	if actual != code {
+		return "", "", nil, errors.New("Invalid request opcode")
+	}
+
+	//skip the compress byte
+	if len(data) < 3 {
+		return "", "", nil, errors.New("Invalid compress")
+	}
+
+	fileName, rest, ok := readString(data[3:])
+	if !ok || fileName == "" {
+		return "", "", nil, errors.New("Invalid filename")
+	}
+
+	mode, rest, ok = readString(rest)
+	if !ok {
+		return "", "", nil, errors.New("Invalid mode")
+	}
+
+	options, err = readOptions(rest)
+	return fileName, mode, options, err
+}
+
+// readString returns the zero terminated string at the start of data and what follows it.
+// It reports false when the terminator is missing.
+func readString(data []byte) (string, []byte, bool) {
+	end := bytes.IndexByte(data, 0)
+	if end < 0 {
+		return "", nil, false
+	}
+	return string(data[:end]), data[end+1:], true
+}
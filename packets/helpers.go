@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"sort"
+	"strings"
 )
 
 func decodeNetAscii(data []byte) (string, error) {
@@ -51,3 +53,59 @@ func encodeNetAscii(message string) ([]byte, error) {
 	}
 	return buf.Bytes(), nil
 }
+
+// readOptions reads the "name\0value\0" pairs that follow the mode of a request
+// or the opcode of an OACK. Option names are case insensitive, so they are lowercased.
+// Reading stops at the end of the data or at an empty name (zero padding).
+func readOptions(data []byte) (map[string]string, error) {
+	var options map[string]string
+	for len(data) > 0 {
+		name, rest, ok := readString(data)
+		if !ok {
+			return nil, errors.New("Invalid option")
+		}
+
+		if name == "" {
+			break
+		}
+
+		value, rest, ok := readString(rest)
+		if !ok {
+			return nil, errors.New("Invalid option value")
+		}
+
+		if options == nil {
+			options = make(map[string]string)
+		}
+		options[strings.ToLower(name)] = value
+		data = rest
+	}
+	return options, nil
+}
+
+// appendOptions appends the options as "name\0value\0" pairs, sorted by name
+// so that the same options always produce the same packet.
+func appendOptions(dst []byte, options map[string]string) []byte {
+	for _, name := range sortedOptionNames(options) {
+		dst = append(dst, name...)
+		dst = append(dst, 0)
+		dst = append(dst, options[name]...)
+		dst = append(dst, 0)
+	}
+	return dst
+}
+
+func writeOptionsString(out *bytes.Buffer, options map[string]string) {
+	for _, name := range sortedOptionNames(options) {
+		out.WriteString("\tOption " + name + ": " + options[name] + "\n")
+	}
+}
+
+func sortedOptionNames(options map[string]string) []string {
+	names := make([]string, 0, len(options))
+	for name := range options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,13 @@
+package packets
+
+import "time"
+
+// ListEntry describes a file of a directory listing, the listing of a directory
+// is a JSON array of entries served under the ListFileName of the directory.
+type ListEntry struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	SHA256  string    `json:"sha256,omitempty"` // hex encoded checksum of the content, empty for directories
+	IsDir   bool      `json:"dir,omitempty"`
+}
@@ -5,8 +5,8 @@ import (
 	"encoding/binary"
 	"errors"
 	"io"
+	"slices"
 	"strconv"
-	"strings"
 )
 
 const (
@@ -16,6 +16,8 @@ const (
 	OCTET         = "octet"
 	READ_REQUEST  = "read"
 	WRITE_REQUEST = "write"
+	IndexFileName = ".index" // name the server generates a directory index for, one file path per line
+	ListFileName  = ".list"  // name the server generates a directory listing for, see ListEntry
 )
 
 type OpCode uint16
@@ -28,6 +30,15 @@ const (
 	DATA                    // Data
 	ACK                     // Acknowledgement
 	ERROR                   // Error
+	OACK                    // Option acknowledgement (RFC 2347)
+)
+
+// names of the options that can be negotiated (RFC 2347)
+const (
+	OptOffset       = "offset"     // byte position in the file the transfer starts at, used to resume transfers
+	OptTransferSize = "tsize"      // size of the file in bytes (RFC 2349)
+	OptBlockSize    = "blksize"    // bytes of data in a DATA packet (RFC 2348)
+	OptWindowSize   = "windowsize" // DATA packets sent before waiting for an ACK (RFC 7440)
 )
 
 type ErrCode uint16
@@ -52,9 +63,10 @@ type Request interface {
 
 // READ REQUEST PACKET
 type ReadRequest struct {
-	FileName string // name of the file to read
-	Mode     string // "netascii", "octet"
-	Compress bool   // compress the file (that is a twist in the protocol)
+	FileName string            // name of the file to read
+	Mode     string            // "netascii", "octet"
+	Compress bool              // compress the file (that is a twist in the protocol)
+	Options  map[string]string // requested options, see RFC 2347
 }
 
 func (r ReadRequest) RequestType() string {
@@ -67,104 +79,31 @@ func (r ReadRequest) String() string {
 	out.WriteString("\tFileName: " + r.FileName + "\n")
 	out.WriteString("\tMode: " + r.Mode + "\n")
 	out.WriteString("\tCompress: " + strconv.FormatBool(r.Compress) + "\n")
+	writeOptionsString(&out, r.Options)
 	out.WriteString("}")
 	return out.String()
 }
 
 func (r *ReadRequest) UnmarshalBinary(data []byte) error {
-	buf := bytes.NewBuffer(data)
-	var code OpCode
-	var compress Compress
-
-	//read opcode
-	err := binary.Read(buf, binary.BigEndian, &code)
+	var err error
+	r.FileName, r.Mode, r.Options, err = parseRequest(data, PRQ)
 	if err != nil {
-		return errors.New("Invalid opcode")
+		return err
 	}
 
-	if code != PRQ {
-		return errors.New("Invalid PRQ ")
-	}
-
-	//read compress, see how the packet is structured in the README
-	err = binary.Read(buf, binary.BigEndian, &compress)
-	if err != nil {
-		return errors.New("Invalid compress")
-	}
-
-	r.FileName, err = buf.ReadString(0)
-	if err != nil {
-		return errors.New("Invalid filename")
-	}
-
-	r.FileName = strings.TrimRight(r.FileName, "\x00")
-	if r.FileName == "" {
-		return errors.New("Invalid filename")
-	}
-
-	r.Mode, err = buf.ReadString(0)
-	if err != nil {
-		return errors.New("Invalid PRQ")
-	}
-
-	r.Mode = strings.TrimRight(r.Mode, "\x00")
 	if r.Mode != NETASCII && r.Mode != OCTET {
 		return errors.New("Invalid mode")
 	}
-
 	return nil
 }
 
 func (r ReadRequest) MarshalBinary() ([]byte, error) {
-	mode := "octet"
-	compress := false
-	if r.Mode != "" {
-		mode = r.Mode
-	}
-
-	if r.Compress {
-		compress = r.Compress
-	}
-
-	cap := 2 + 1 + 2 + len(r.FileName) + 1 + len(mode) + 1
-	buf := new(bytes.Buffer)
-	buf.Grow(cap)
-
-	var code OpCode = PRQ
-	err := binary.Write(buf, binary.BigEndian, code)
-	if err != nil {
-		return nil, err
-	}
-
-	var compressByte byte
-	if compress {
-		compressByte = 1
-	} else {
-		compressByte = 0
-	}
-	err = binary.Write(buf, binary.BigEndian, compressByte)
-
-	if err != nil {
-		return nil, err
-	}
-
-	err = binary.Write(buf, binary.BigEndian, []byte(r.FileName))
-	if err != nil {
-		return nil, err
-	}
-
-	err = binary.Write(buf, binary.BigEndian, []byte{0})
-	if err != nil {
-		return nil, err
-	}
-
-	err = binary.Write(buf, binary.BigEndian, []byte(r.Mode))
-	if err != nil {
-		return nil, err
-	}
-
-	return buf.Bytes(), nil
+	return r.AppendBinary(nil)
+}
 
+// AppendBinary appends the encoded request to dst.
+func (r ReadRequest) AppendBinary(dst []byte) ([]byte, error) {
+	return appendRequest(dst, PRQ, r.Compress, r.FileName, r.Mode, r.Options), nil
 }
 func (r *ReadRequest) UnmarshalNetascii(data []byte) error {
 	buf := bytes.NewBuffer(data)
@@ -266,9 +205,10 @@ func (r ReadRequest) MarshalNetascii() ([]byte, error) {
 
 // WRITE REQUEST PACKET
 type WriteRequest struct {
-	FileName string // name of the file to write
-	Mode     string // "netascii", "octet"
-	Compress bool   // compress the file (that is a twist in the protocol)
+	FileName string            // name of the file to write
+	Mode     string            // "netascii", "octet"
+	Compress bool              // compress the file (that is a twist in the protocol)
+	Options  map[string]string // requested options, see RFC 2347
 }
 
 func (w WriteRequest) RequestType() string {
@@ -281,96 +221,31 @@ func (w WriteRequest) String() string {
 	out.WriteString("\tFileName: " + w.FileName + "\n")
 	out.WriteString("\tMode: " + w.Mode + "\n")
 	out.WriteString("\tCompress: " + strconv.FormatBool(w.Compress) + "\n")
+	writeOptionsString(&out, w.Options)
 	out.WriteString("}")
 	return out.String()
 }
 
 func (w *WriteRequest) UnmarshalBinary(data []byte) error {
-	buf := bytes.NewBuffer(data)
-	var code OpCode
-	var compress Compress
-
-	//read opcode
-	err := binary.Read(buf, binary.BigEndian, &code)
+	var err error
+	w.FileName, w.Mode, w.Options, err = parseRequest(data, WRQ)
 	if err != nil {
-		return errors.New("Invalid opcode")
+		return err
 	}
 
-	//read compress
-	err = binary.Read(buf, binary.BigEndian, &compress)
-	if err != nil {
-		return errors.New("Invalid compress")
-	}
-
-	if code != WRQ {
-		return errors.New("Invalid PRQ or WRQ")
-	}
-
-	w.FileName, err = buf.ReadString(0)
-	if err != nil {
-		return errors.New("Invalid filename")
-	}
-
-	w.FileName = strings.TrimRight(w.FileName, "\x00")
-	if w.FileName == "" {
-		return errors.New("Invalid filename")
-	}
-
-	w.Mode, err = buf.ReadString(0)
-	if err != nil {
-		return errors.New("Invalid PRQ")
-	}
-
-	w.Mode = strings.TrimRight(w.Mode, "\x00")
 	if w.Mode != OCTET {
 		return errors.New("Invalid mode")
 	}
-
 	return nil
 }
 
 func (w WriteRequest) MarshalBinary() ([]byte, error) {
-	mode := "octet"
-	if w.Mode != "" {
-		mode = w.Mode
-	}
-
-	cap := 2 + 1 + 2 + len(w.FileName) + 1 + len(mode) + 1
-	buf := new(bytes.Buffer)
-	buf.Grow(cap)
-
-	var code OpCode = WRQ
-	err := binary.Write(buf, binary.BigEndian, code)
-	if err != nil {
-		return nil, err
-	}
-
-	err = binary.Write(buf, binary.BigEndian, w.Compress)
-	if err != nil {
-		return nil, err
-	}
-
-	err = binary.Write(buf, binary.BigEndian, []byte(w.FileName))
-	if err != nil {
-		return nil, err
-	}
-
-	err = binary.Write(buf, binary.BigEndian, []byte{0})
-	if err != nil {
-		return nil, err
-	}
-
-	err = binary.Write(buf, binary.BigEndian, []byte(w.Mode))
-	if err != nil {
-		return nil, err
-	}
-
-	err = binary.Write(buf, binary.BigEndian, []byte{0})
-	if err != nil {
-		return nil, err
-	}
+	return w.AppendBinary(nil)
+}
 
-	return buf.Bytes(), nil
+// AppendBinary appends the encoded request to dst.
+func (w WriteRequest) AppendBinary(dst []byte) ([]byte, error) {
+	return appendRequest(dst, WRQ, w.Compress, w.FileName, w.Mode, w.Options), nil
 }
 
 func (w *WriteRequest) UnmarshalNetascii(data []byte) error {
@@ -481,55 +356,37 @@ type Data struct {
 }
 
 func (d *Data) UnmarshalBinary(data []byte) error {
-	len := len(data)
-	if len < 4 || len > DatagramSize {
+	if len(data) > DatagramSize {
 		return errors.New("Invalid data packet")
 	}
 
-	buf := bytes.NewBuffer(data)
-	var code OpCode
-
-	err := binary.Read(bytes.NewReader(buf.Next(2)), binary.BigEndian, &code)
+	block, payload, err := ParseData(data)
 	if err != nil {
-		return errors.New("Invalid OpCode")
+		return err
 	}
 
-	if code != DATA {
-		return errors.New("Invalid OpCode")
-	}
-
-	err = binary.Read(bytes.NewReader(buf.Next(2)), binary.BigEndian, &d.BlockNumber)
-	if err != nil {
-		return errors.New("Invalid block number")
-	}
-
-	d.Payload = buf
-
+	d.BlockNumber = block
+	d.Payload = bytes.NewReader(payload)
 	return nil
 }
 func (d Data) MarshalBinary() ([]byte, error) {
-	buf := new(bytes.Buffer)
-	cap := 2 + 2 + DatagramSize
-	buf.Grow(cap)
-
-	var code OpCode = DATA
-	err := binary.Write(buf, binary.BigEndian, code)
-	if err != nil {
-		return nil, err
-	}
+	return d.AppendBinary(make([]byte, 0, DatagramSize))
+}
 
-	err = binary.Write(buf, binary.BigEndian, d.BlockNumber)
-	if err != nil {
-		return nil, err
+// AppendBinary appends the packet to dst, with up to BlockSize bytes read from the payload.
+func (d Data) AppendBinary(dst []byte) ([]byte, error) {
+	dst = AppendData(dst, d.BlockNumber, nil)
+	if d.Payload == nil {
+		return dst, nil
 	}
 
-	_, err = io.CopyN(buf, d.Payload, BlockSize)
-	if err != nil && err != io.EOF {
+	start := len(dst)
+	dst = slices.Grow(dst, BlockSize)[:start+BlockSize]
+	n, err := io.ReadFull(d.Payload, dst[start:])
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
 		return nil, err
 	}
-
-	return buf.Bytes(), nil
-
+	return dst[:start+n], nil
 }
 
 // ACK PACKET
@@ -538,43 +395,49 @@ type Ack struct {
 }
 
 func (a *Ack) UnmarshalBinary(data []byte) error {
-	buf := bytes.NewBuffer(data)
-	var code OpCode
-
-	err := binary.Read(bytes.NewReader(buf.Next(2)), binary.BigEndian, &code)
+	block, err := ParseAck(data)
 	if err != nil {
-		return errors.New("Invalid OpCode")
+		return err
 	}
-
-	if code != ACK {
-		return errors.New("Invalid OpCode")
-	}
-
-	err = binary.Read(bytes.NewReader(buf.Next(2)), binary.BigEndian, &a.BlockNumber)
-	if err != nil {
-		return errors.New("Invalid block number")
-	}
-
+	a.BlockNumber = block
 	return nil
 }
 
 func (a Ack) MarshalBinary() ([]byte, error) {
-	buf := new(bytes.Buffer)
-	cap := 2 + 2
-	buf.Grow(cap)
+	return a.AppendBinary(nil)
+}
 
-	code := ACK
-	err := binary.Write(buf, binary.BigEndian, code)
+// AppendBinary appends the packet to dst.
+func (a Ack) AppendBinary(dst []byte) ([]byte, error) {
+	return AppendAck(dst, a.BlockNumber), nil
+}
+
+// OPTION ACKNOWLEDGEMENT PACKET
+type OptionAck struct {
+	Options map[string]string // options accepted by the server, with their final values
+}
+
+func (o *OptionAck) UnmarshalBinary(data []byte) error {
+	code, err := ParseOpCode(data)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	err = binary.Write(buf, binary.BigEndian, a.BlockNumber)
-	if err != nil {
-		return nil, err
+	if code != OACK {
+		return errors.New("Invalid OACK")
 	}
 
-	return buf.Bytes(), nil
+	o.Options, err = readOptions(data[2:])
+	return err
+}
+
+func (o OptionAck) MarshalBinary() ([]byte, error) {
+	return o.AppendBinary(nil)
+}
+
+// AppendBinary appends the packet to dst.
+func (o OptionAck) AppendBinary(dst []byte) ([]byte, error) {
+	return AppendOptionAck(dst, o.Options), nil
 }
 
 // ERROR PACKET
@@ -584,58 +447,21 @@ type Error struct {
 }
 
 func (e *Error) UnmarshalBinary(data []byte) error {
-	buf := bytes.NewBuffer(data)
-
-	var code OpCode
-	err := binary.Read(buf, binary.BigEndian, &code)
+	code, message, err := ParseError(data)
 	if err != nil {
-		return errors.New("Invalid opcode")
-	}
-
-	if code != ERROR {
-		return errors.New("Invalid error packet")
+		return err
 	}
-
-	err = binary.Read(buf, binary.BigEndian, &e.ErrCode)
-	if err != nil {
-		return errors.New("Invalid error code")
-	}
-
-	e.Message, err = buf.ReadString(0)
-	e.Message = strings.TrimRight(e.Message, "\x00") // remove the 0-byte
-	if err != nil {
-		return errors.New("Invalid error message")
-	}
-
+	e.ErrCode, e.Message = code, message
 	return nil
 }
 
 func (e Error) MarshalBinary() ([]byte, error) {
-	cap := 2 + 2 + len(e.Message) + 1
-	buf := new(bytes.Buffer)
-	buf.Grow(cap)
-
-	code := ERROR
-	err := binary.Write(buf, binary.BigEndian, code)
-	if err != nil {
-		return nil, err
-	}
-
-	err = binary.Write(buf, binary.BigEndian, e.ErrCode)
-	if err != nil {
-		return nil, err
-	}
-
-	err = binary.Write(buf, binary.BigEndian, []byte(e.Message))
-	if err != nil {
-		return nil, err
-	}
-	err = buf.WriteByte(0)
-	if err != nil {
-		return nil, err
-	}
+	return e.AppendBinary(nil)
+}
 
-	return buf.Bytes(), nil
+// AppendBinary appends the packet to dst.
+func (e Error) AppendBinary(dst []byte) ([]byte, error) {
+	return AppendError(dst, e.ErrCode, e.Message), nil
 }
 func (e *Error) UmarshalNetascii(data []byte) error {
 	buf := bytes.NewBuffer(data)
@@ -1 +1,171 @@
 package packets
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestReadRequestOptions(t *testing.T) {
+	rrq := ReadRequest{FileName: "image.bin", Mode: OCTET, Options: map[string]string{OptOffset: "1024"}}
+	data, err := rrq.MarshalBinary()
+	if err != nil {
+		t.Fatalf("Error marshaling RRQ: %v", err)
+	}
+
+	// the server reads requests into a zero padded buffer
+	padded := make([]byte, 1024)
+	copy(padded, data)
+
+	var actual ReadRequest
+	err = actual.UnmarshalBinary(padded)
+	if err != nil {
+		t.Fatalf("Error unmarshaling RRQ: %v", err)
+	}
+
+	if actual.FileName != rrq.FileName || actual.Mode != rrq.Mode {
+		t.Errorf("Expected %v, got %v", rrq, actual)
+	}
+
+	if !reflect.DeepEqual(actual.Options, rrq.Options) {
+		t.Errorf("Expected options %v, got %v", rrq.Options, actual.Options)
+	}
+}
+
+func TestWriteRequestWithoutOptions(t *testing.T) {
+	wrq := WriteRequest{FileName: "backup.tar", Mode: OCTET}
+	data, err := wrq.MarshalBinary()
+	if err != nil {
+		t.Fatalf("Error marshaling WRQ: %v", err)
+	}
+
+	var actual WriteRequest
+	err = actual.UnmarshalBinary(data)
+	if err != nil {
+		t.Fatalf("Error unmarshaling WRQ: %v", err)
+	}
+
+	if actual.Options != nil {
+		t.Errorf("Expected no options, got %v", actual.Options)
+	}
+}
+
+func TestOptionAck(t *testing.T) {
+	oack := OptionAck{Options: map[string]string{OptOffset: "512"}}
+	data, err := oack.MarshalBinary()
+	if err != nil {
+		t.Fatalf("Error marshaling OACK: %v", err)
+	}
+
+	var actual OptionAck
+	err = actual.UnmarshalBinary(data)
+	if err != nil {
+		t.Fatalf("Error unmarshaling OACK: %v", err)
+	}
+
+	if !reflect.DeepEqual(actual.Options, oack.Options) {
+		t.Errorf("Expected options %v, got %v", oack.Options, actual.Options)
+	}
+}
+
+func TestOptionAckInvalid(t *testing.T) {
+	var oack OptionAck
+	err := oack.UnmarshalBinary([]byte{0, byte(OACK), 'o', 'f', 'f', 's', 'e', 't'})
+	if err == nil {
+		t.Errorf("Expected error unmarshaling truncated OACK")
+	}
+}
+
+func TestAppendAndParse(t *testing.T) {
+	block, payload, err := ParseData(AppendData(nil, 7, []byte("payload")))
+	if err != nil || block != 7 || string(payload) != "payload" {
+		t.Errorf("Expected DATA 7, got %d %q (%v)", block, payload, err)
+	}
+
+	if block, err = ParseAck(AppendAck(nil, 65535)); err != nil || block != 65535 {
+		t.Errorf("Expected ACK 65535, got %d (%v)", block, err)
+	}
+
+	code, message, err := ParseError(AppendError(nil, ErrDiskFull, "Disk full"))
+	if err != nil || code != ErrDiskFull || message != "Disk full" {
+		t.Errorf("Expected the error, got %d %q (%v)", code, message, err)
+	}
+
+	// the encoders append to what the buffer already holds
+	if data := AppendAck([]byte("x"), 1); string(data) != "x\x00\x04\x00\x01" {
+		t.Errorf("Expected the ACK after the existing data, got %q", data)
+	}
+
+	for _, packet := range [][]byte{nil, {0, byte(DATA), 0}, AppendAck(nil, 1)} {
+		if _, _, err = ParseData(packet); err == nil {
+			t.Errorf("Expected an error parsing %v as DATA", packet)
+		}
+	}
+	if _, _, err = ParseError([]byte{0, byte(ERROR), 0, 1, 'x'}); err == nil {
+		t.Errorf("Expected an error parsing an unterminated message")
+	}
+}
+
+func TestDataMarshalBinary(t *testing.T) {
+	payload := bytes.Repeat([]byte("d"), BlockSize+10)
+	data, err := Data{BlockNumber: 3, Payload: bytes.NewReader(payload)}.MarshalBinary()
+	if err != nil {
+		t.Fatalf("Error marshaling DATA: %v", err)
+	}
+
+	var actual Data
+	if err = actual.UnmarshalBinary(data); err != nil {
+		t.Fatalf("Error unmarshaling DATA: %v", err)
+	}
+	received, _ := io.ReadAll(actual.Payload)
+	if actual.BlockNumber != 3 || !bytes.Equal(received, payload[:BlockSize]) {
+		t.Errorf("Expected block 3 with a full block, got %d with %d bytes", actual.BlockNumber, len(received))
+	}
+}
+
+// BenchmarkDataMarshalBinary encodes a block with MarshalBinary, it allocates a new packet every time.
+func BenchmarkDataMarshalBinary(b *testing.B) {
+	payload := bytes.NewReader(make([]byte, BlockSize))
+	b.ReportAllocs()
+	b.SetBytes(BlockSize)
+	for i := 0; i < b.N; i++ {
+		payload.Seek(0, io.SeekStart)
+		if _, err := (Data{BlockNumber: uint16(i), Payload: payload}).MarshalBinary(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkAppendData encodes a block into a reused buffer, it does not allocate.
+func BenchmarkAppendData(b *testing.B) {
+	payload := make([]byte, BlockSize)
+	buf := make([]byte, 0, DatagramSize)
+	b.ReportAllocs()
+	b.SetBytes(BlockSize)
+	for i := 0; i < b.N; i++ {
+		buf = AppendData(buf[:0], uint16(i), payload)
+	}
+}
+
+func BenchmarkParseData(b *testing.B) {
+	packet := AppendData(nil, 1, make([]byte, BlockSize))
+	b.ReportAllocs()
+	b.SetBytes(BlockSize)
+	for i := 0; i < b.N; i++ {
+		if _, _, err := ParseData(packet); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkAppendAndParseAck(b *testing.B) {
+	buf := make([]byte, 0, 4)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf = AppendAck(buf[:0], uint16(i))
+		if _, err := ParseAck(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package resume
+
+import (
+	"TFTP/packets"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+)
+
+// Overlap is the number of bytes, already stored by the receiver, that are sent again when a transfer is resumed.
+// The receiver compares them with its copy to make sure both sides are talking about the same file.
+const Overlap = packets.BlockSize
+
+var ErrMismatch = errors.New("Resumed data does not match the partial file")
+
+// Offset returns the position a transfer should be resumed from when size bytes are already stored.
+func Offset(size int64) int64 {
+	if size < Overlap {
+		return 0
+	}
+	return size - Overlap
+}
+
+// ParseOffset reads the offset option from the request options,
+// the second value reports whether the option was present at all.
+func ParseOffset(options map[string]string) (int64, bool, error) {
+	value, ok := options[packets.OptOffset]
+	if !ok {
+		return 0, false, nil
+	}
+
+	offset, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || offset < 0 {
+		return 0, true, errors.New("Invalid offset")
+	}
+
+	return offset, true, nil
+}
+
+// Writer appends a resumed transfer to a partial file.
+// The bytes of the transfer that overlap with the file are compared instead of being written.
+type Writer struct {
+	file    *os.File
+	overlap []byte
+}
+
+// NewWriter prepares file for a transfer starting at offset. It keeps the bytes between offset and
+// the end of the file for verification and moves to the end of the file.
+func NewWriter(file *os.File, offset int64) (*Writer, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	if offset > info.Size() {
+		return nil, errors.New("Offset beyond the end of the partial file")
+	}
+
+	overlap := make([]byte, info.Size()-offset)
+	_, err = file.ReadAt(overlap, offset)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	_, err = file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Writer{file: file, overlap: overlap}, nil
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	n := 0
+	if len(w.overlap) > 0 {
+		k := min(len(p), len(w.overlap))
+		if !bytes.Equal(p[:k], w.overlap[:k]) {
+			return 0, ErrMismatch
+		}
+		w.overlap = w.overlap[k:]
+		p = p[k:]
+		n = k
+	}
+
+	if len(p) == 0 {
+		return n, nil
+	}
+
+	m, err := w.file.Write(p)
+	return n + m, err
+}
+
+// Verify reports ErrMismatch if the transfer ended before the whole overlap was compared,
+// which means the file on the other side is shorter than the partial one.
+func (w *Writer) Verify() error {
+	if len(w.overlap) > 0 {
+		return ErrMismatch
+	}
+	return nil
+}
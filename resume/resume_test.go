@@ -0,0 +1,114 @@
+package resume
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func partialFile(t *testing.T, content []byte) *os.File {
+	t.Helper()
+	file, err := os.OpenFile(filepath.Join(t.TempDir(), "partial"), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatalf("Error creating partial file: %v", err)
+	}
+	t.Cleanup(func() { file.Close() })
+
+	_, err = file.Write(content)
+	if err != nil {
+		t.Fatalf("Error writing partial file: %v", err)
+	}
+	return file
+}
+
+func TestOffset(t *testing.T) {
+	if offset := Offset(100); offset != 0 {
+		t.Errorf("Expected 0, got %d", offset)
+	}
+	if offset := Offset(2000); offset != 2000-Overlap {
+		t.Errorf("Expected %d, got %d", 2000-Overlap, offset)
+	}
+}
+
+func TestParseOffset(t *testing.T) {
+	_, ok, err := ParseOffset(nil)
+	if ok || err != nil {
+		t.Errorf("Expected no offset, got %v %v", ok, err)
+	}
+
+	offset, ok, err := ParseOffset(map[string]string{"offset": "42"})
+	if !ok || err != nil || offset != 42 {
+		t.Errorf("Expected offset 42, got %d %v %v", offset, ok, err)
+	}
+
+	_, _, err = ParseOffset(map[string]string{"offset": "-1"})
+	if err == nil {
+		t.Errorf("Expected error for negative offset")
+	}
+}
+
+func TestWriterAppendsAfterOverlap(t *testing.T) {
+	full := bytes.Repeat([]byte("0123456789"), 200)
+	file := partialFile(t, full[:1500])
+
+	w, err := NewWriter(file, Offset(1500))
+	if err != nil {
+		t.Fatalf("Error creating writer: %v", err)
+	}
+
+	// the transfer is sent in blocks which do not line up with the overlap
+	rest := full[Offset(1500):]
+	for len(rest) > 0 {
+		n := min(len(rest), 300)
+		_, err = w.Write(rest[:n])
+		if err != nil {
+			t.Fatalf("Error writing: %v", err)
+		}
+		rest = rest[n:]
+	}
+
+	if err = w.Verify(); err != nil {
+		t.Errorf("Expected overlap to be verified, got %v", err)
+	}
+
+	actual, err := os.ReadFile(file.Name())
+	if err != nil {
+		t.Fatalf("Error reading file: %v", err)
+	}
+	if !bytes.Equal(actual, full) {
+		t.Errorf("Expected %d bytes of the original file, got %d", len(full), len(actual))
+	}
+}
+
+func TestWriterDetectsMismatch(t *testing.T) {
+	file := partialFile(t, bytes.Repeat([]byte("a"), 1000))
+
+	w, err := NewWriter(file, Offset(1000))
+	if err != nil {
+		t.Fatalf("Error creating writer: %v", err)
+	}
+
+	_, err = w.Write(bytes.Repeat([]byte("b"), 512))
+	if err != ErrMismatch {
+		t.Errorf("Expected ErrMismatch, got %v", err)
+	}
+}
+
+func TestWriterDetectsShorterSource(t *testing.T) {
+	file := partialFile(t, bytes.Repeat([]byte("a"), 1000))
+
+	w, err := NewWriter(file, Offset(1000))
+	if err != nil {
+		t.Fatalf("Error creating writer: %v", err)
+	}
+
+	_, err = w.Write(bytes.Repeat([]byte("a"), 100))
+	if err != nil {
+		t.Fatalf("Error writing: %v", err)
+	}
+
+	if err = w.Verify(); err != ErrMismatch {
+		t.Errorf("Expected ErrMismatch, got %v", err)
+	}
+}
@@ -1,29 +1,126 @@
 package main
 
 import (
+	"TFTP/logging"
 	server "TFTP/server/package"
+	"TFTP/throttle"
 	"flag"
-	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
 	"time"
 )
 
 var (
 	address = flag.String("a", "127.0.0.1:69", "Address to listen on")
 	payload = flag.String("p", "server/test.pdf", "Payload to send")
+	root    = flag.String("root", "", "Directory to serve files from, the working directory by default")
+	mkdir   = flag.Bool("mkdir", false, "Allow uploads to create directories under the root")
+	config  = flag.String("config", "", "Config file with the ACL of the server, see server.Config")
+	maxSize = flag.Int64("max-upload", 0, "Largest upload in bytes, no limit when 0")
+	quota   = flag.Int64("quota", 0, "Bytes a client IP may upload within the quota window, no limit when 0")
+	window  = flag.Duration("quota-window", 24*time.Hour, "Rolling window of the upload quota")
+	minFree = flag.Int64("min-free", 0, "Bytes that uploads have to leave free on the disk, no limit when 0")
+	reqRate = flag.Int("request-rate", 0, "Datagrams per second a client IP may send to the server, no limit when 0")
+	banMax  = flag.Int("ban-threshold", 0, "Offences of a client IP within the ban window that ban it, no ban when 0")
+	banWin  = flag.Duration("ban-window", time.Minute, "Window of the ban threshold")
+	banTime = flag.Duration("ban-duration", 10*time.Minute, "How long a client IP stays banned")
+	allowed = flag.String("whitelist", "", "Comma separated networks never limited nor banned, e.g. 10.0.0.0/8")
+	reflect = flag.Bool("anti-reflection", false, "Limit what is sent to clients that did not acknowledge a packet yet and their replies per second")
+	replies = flag.Int("reply-rate", 5, "Replies per second to a client IP with -anti-reflection")
+	admin   = flag.String("admin", "", "Address of the HTTP administration listener, e.g. 127.0.0.1:6970, none by default")
+	metrics = flag.String("metrics", "", "Address of the HTTP listener of the Prometheus metrics, e.g. 127.0.0.1:9169, none by default")
+	single  = flag.Bool("single-port", false, "Run every transfer over the port of the server, not RFC 1350 compliant")
 )
 
+// fatal logs an error and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
 func main() {
+	var (
+		ports       server.PortRange
+		writePolicy server.WritePolicy
+		writeRules  server.WriteRules
+		rate        throttle.Rate
+		sessionRate throttle.Rate
+		networkRate server.NetworkRates
+		logConfig   logging.Config
+	)
+	flag.Var(&ports, "ports", "Range of ports to open the transfers on, e.g. 50000-50100, any free port by default")
+	flag.Var(&writePolicy, "write", "What to do with uploads: overwrite, disabled, create or versioned")
+	flag.Var(&writeRules, "write-rule", "Write policy of the uploads matching a pattern, e.g. backups/*=versioned, can be repeated")
+	flag.Var(&rate, "rate", "Bandwidth shared by all the transfers in bytes per second, e.g. 100m, no limit by default")
+	flag.Var(&sessionRate, "session-rate", "Bandwidth of every transfer in bytes per second, no limit by default")
+	flag.Var(&networkRate, "network-rate", "Bandwidth shared by the clients of a network, e.g. 10.1.0.0/16=10m, can be repeated")
+	logConfig.RegisterFlags(flag.CommandLine)
 	flag.Parse()
+	logger := logConfig.New(os.Stderr)
+	slog.SetDefault(logger)
 
 	s := server.Server{
-		Timeout: 10 * time.Second,
-		Retries: 10,
+		Timeout:    10 * time.Second,
+		Retries:    10,
+		Root:       *root,
+		CreateDirs: *mkdir,
+		SinglePort: *single,
+		PortRange:  ports,
+		Logger:     logger,
+
+		MetricsListen: *metrics,
+
+		WritePolicy: writePolicy,
+		WriteRules:  writeRules,
+
+		MaxUploadSize: *maxSize,
+		ClientQuota:   *quota,
+		QuotaWindow:   *window,
+		MinFreeSpace:  *minFree,
+
+		RateLimit:        rate,
+		SessionRateLimit: sessionRate,
+		NetworkRates:     networkRate,
+
+		RequestRate:  *reqRate,
+		BanThreshold: *banMax,
+		BanWindow:    *banWin,
+		BanDuration:  *banTime,
+
+		AntiReflection: *reflect,
+		ReplyRate:      *replies,
+	}
+
+	if *allowed != "" {
+		for _, network := range strings.Split(*allowed, ",") {
+			prefix, err := netip.ParsePrefix(strings.TrimSpace(network))
+			if err != nil {
+				fatal("invalid whitelist", "error", err)
+			}
+			s.Whitelist = append(s.Whitelist, prefix)
+		}
+	}
+
+	if *config != "" {
+		c, err := server.LoadConfig(*config)
+		if err != nil {
+			fatal("loading the config failed", "config", *config, "error", err)
+		}
+		c.Apply(&s)
+	}
+
+	if *admin != "" {
+		go func() {
+			err := http.ListenAndServe(*admin, s.AdminHandler())
+			fatal("serving the administration failed", "error", err)
+		}()
 	}
 
 	err := s.ListenAndServe(*address)
 	if err != nil {
-		fmt.Println("Error starting server:", err)
-		return
+		fatal("serving failed", "error", err)
 	}
-
 }
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Operation is what a request asks to do with a file.
+type Operation int
+
+const (
+	OpRead Operation = 1 << iota
+	OpWrite
+
+	OpAll = OpRead | OpWrite
+)
+
+func (op Operation) String() string {
+	switch op {
+	case OpRead:
+		return "read"
+	case OpWrite:
+		return "write"
+	case OpAll:
+		return "read,write"
+	}
+	return fmt.Sprintf("Operation(%d)", int(op))
+}
+
+func (op Operation) MarshalText() ([]byte, error) {
+	return []byte(op.String()), nil
+}
+
+// UnmarshalText reads "read", "write" or both separated by a comma.
+func (op *Operation) UnmarshalText(text []byte) error {
+	var parsed Operation
+	for _, name := range strings.Split(string(text), ",") {
+		switch strings.TrimSpace(name) {
+		case "read":
+			parsed |= OpRead
+		case "write":
+			parsed |= OpWrite
+		default:
+			return fmt.Errorf("Invalid operation %q", name)
+		}
+	}
+	*op = parsed
+	return nil
+}
+
+// Rule allows, or denies, the operations of the clients of a network on the files that match a pattern.
+type Rule struct {
+	Network netip.Prefix `json:"network"`         // clients the rule applies to, e.g. 10.1.0.0/16
+	Ops     Operation    `json:"ops,omitempty"`   // operations the rule applies to, all of them when zero
+	Files   string       `json:"files,omitempty"` // path.Match pattern of the file names under the root, every file when empty
+	Deny    bool         `json:"deny,omitempty"`  // the rule denies instead of allowing
+}
+
+// matches tells whether the rule applies to the operation of client on the file name.
+// As in path.Match a * does not match a /, "pxelinux/*" matches the files of pxelinux only.
+func (r Rule) matches(client netip.Addr, op Operation, name string) bool {
+	if !r.Network.Contains(client) {
+		return false
+	}
+	if r.Ops != 0 && r.Ops&op == 0 {
+		return false
+	}
+	if r.Files == "" {
+		return true
+	}
+	matched, err := path.Match(r.Files, name)
+	return err == nil && matched
+}
+
+// ACL is a list of rules, the first rule that matches a request decides whether it is allowed.
+// A request no rule matches is denied, unless the list is empty: then everything is allowed.
+type ACL []Rule
+
+// Allows tells whether the client may do op on the file name, a path relative to the root.
+func (acl ACL) Allows(client net.Addr, op Operation, name string) bool {
+	if len(acl) == 0 {
+		return true
+	}
+
+	addr, ok := clientIP(client)
+	if !ok {
+		return false
+	}
+	name = path.Clean(filepath.ToSlash(name))
+	for _, rule := range acl {
+		if rule.matches(addr, op, name) {
+			return !rule.Deny
+		}
+	}
+	return false
+}
+
+// validate checks that every rule has a network, a rule without one would match nothing.
+func (acl ACL) validate() error {
+	for i, rule := range acl {
+		if !rule.Network.IsValid() {
+			return fmt.Errorf("Rule %d of the ACL has no network", i+1)
+		}
+		if _, err := path.Match(rule.Files, ""); err != nil {
+			return fmt.Errorf("Rule %d of the ACL has an invalid pattern %q", i+1, rule.Files)
+		}
+	}
+	return nil
+}
+
+// clientIP returns the IP address of a client, IPv4 clients of a dual stack socket as IPv4.
+func clientIP(client net.Addr) (netip.Addr, bool) {
+	if udp, ok := client.(*net.UDPAddr); ok {
+		return udp.AddrPort().Addr().Unmap(), true
+	}
+	addrPort, err := netip.ParseAddrPort(client.String())
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addrPort.Addr().Unmap(), true
+}
+
+// readable returns whether the client may read a file, by its path under the root.
+// It is nil when there is no ACL, every file is readable then.
+func (s *Server) readable(client net.Addr) func(path string) bool {
+	if len(s.ACL) == 0 {
+		return nil
+	}
+	return func(path string) bool {
+		name, err := filepath.Rel(filepath.Join(s.Root, "."), path)
+		return err == nil && s.ACL.Allows(client, OpRead, name)
+	}
+}
@@ -0,0 +1,191 @@
+package server
+
+import (
+	"TFTP/packets"
+	"encoding/json"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func clientAddr(ip string) net.Addr {
+	return net.UDPAddrFromAddrPort(netip.AddrPortFrom(netip.MustParseAddr(ip), 1024))
+}
+
+func TestACLAllows(t *testing.T) {
+	acl := ACL{
+		{Network: netip.MustParsePrefix("10.1.0.0/16"), Ops: OpRead, Files: "pxelinux/*"},
+		{Network: netip.MustParsePrefix("10.9.9.0/24"), Ops: OpWrite, Files: "backups/*"},
+		{Network: netip.MustParsePrefix("192.168.0.0/24"), Files: "secret/*", Deny: true},
+		{Network: netip.MustParsePrefix("192.168.0.0/24")},
+	}
+
+	for _, c := range []struct {
+		client  string
+		op      Operation
+		name    string
+		allowed bool
+	}{
+		{"10.1.2.3", OpRead, "pxelinux/default", true},
+		{"10.1.2.3", OpRead, "pxelinux/./default", true},
+		{"10.1.2.3", OpRead, "pxelinux/sub/default", false}, // * does not match a /
+		{"10.1.2.3", OpRead, "backups/db", false},
+		{"10.1.2.3", OpWrite, "pxelinux/default", false},
+		{"10.9.9.9", OpWrite, "backups/db", true},
+		{"10.9.9.9", OpRead, "backups/db", false},
+		{"192.168.0.7", OpWrite, "anything", true},
+		{"192.168.0.7", OpRead, "secret/key", false}, // the first rule that matches decides
+		{"::ffff:10.1.0.1", OpRead, "pxelinux/default", true},
+		{"172.16.0.1", OpRead, "pxelinux/default", false}, // no rule matches
+	} {
+		if allowed := acl.Allows(clientAddr(c.client), c.op, c.name); allowed != c.allowed {
+			t.Errorf("Expected %s of %s by %s allowed to be %t", c.op, c.name, c.client, c.allowed)
+		}
+	}
+
+	if !ACL(nil).Allows(clientAddr("172.16.0.1"), OpWrite, "anything") {
+		t.Errorf("Expected everything to be allowed without an ACL")
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server.json")
+	err := os.WriteFile(path, []byte(`{"acl": [
+		{"network": "10.1.0.0/16", "ops": "read", "files": "pxelinux/*"},
+		{"network": "10.9.9.0/24", "ops": "read,write", "deny": true}
+	]}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("Error loading config: %v", err)
+	}
+	expected := ACL{
+		{Network: netip.MustParsePrefix("10.1.0.0/16"), Ops: OpRead, Files: "pxelinux/*"},
+		{Network: netip.MustParsePrefix("10.9.9.0/24"), Ops: OpAll, Deny: true},
+	}
+	if len(config.ACL) != len(expected) || config.ACL[0] != expected[0] || config.ACL[1] != expected[1] {
+		t.Errorf("Expected %+v, got %+v", expected, config.ACL)
+	}
+
+	for _, content := range []string{
+		`{"acl": [{"network": "10.1.0.0/16", "ops": "delete"}]}`,
+		`{"acl": [{"network": "10.1.0.300/16"}]}`,
+		`{"acl": [{"ops": "read"}]}`,
+		`{"acl": [{"network": "10.1.0.0/16", "files": "[pxelinux"}]}`,
+		`{"acls": []}`,
+	} {
+		if err = os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = LoadConfig(path); err == nil {
+			t.Errorf("Expected %s to be rejected", content)
+		}
+	}
+}
+
+func TestIndexRespectsACL(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{"pxelinux/default", "pxelinux/sub/other", "backups/db"} {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := Server{Root: root, IndexName: ".index", ListName: ".list", ACL: ACL{
+		{Network: netip.MustParsePrefix("10.1.0.0/16"), Ops: OpRead, Files: "pxelinux/*"},
+		{Network: netip.MustParsePrefix("10.1.0.0/16"), Ops: OpRead, Files: ".index"},
+	}}
+	index, err := readAll(s.openFile(filepath.Join(root, ".index"), s.readable(clientAddr("10.1.2.3"))))
+	if err != nil {
+		t.Fatalf("Error reading index: %v", err)
+	}
+	if expected := "pxelinux/default\n"; string(index) != expected {
+		t.Errorf("Expected %q, got %q", expected, index)
+	}
+
+	listing, err := readAll(s.openFile(filepath.Join(root, "backups", ".list"), s.readable(clientAddr("10.1.2.3"))))
+	if err != nil {
+		t.Fatalf("Error reading listing: %v", err)
+	}
+	if string(listing) != "[]" {
+		t.Errorf("Expected an empty listing, got %s", listing)
+	}
+
+	// a directory is listed when its own listing is readable
+	listing, err = readAll(s.openFile(filepath.Join(root, ".list"), s.readable(clientAddr("10.1.2.3"))))
+	if err != nil {
+		t.Fatalf("Error reading listing: %v", err)
+	}
+	var entries []packets.ListEntry
+	if err = json.Unmarshal(listing, &entries); err != nil || len(entries) != 1 || entries[0].Name != "pxelinux" {
+		t.Errorf("Expected only the readable directory, got %s (%v)", listing, err)
+	}
+}
+
+func TestACLDeniesRequests(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "fw.bin"), []byte("firmware"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	// the loopback may read, but not write
+	s := &Server{Root: root, Timeout: conformanceTimeout, Retries: 3, ACL: ACL{
+		{Network: netip.MustParsePrefix("127.0.0.0/8"), Ops: OpRead},
+	}}
+	go s.Serve(conn)
+	addr := conn.LocalAddr()
+
+	p := newPeer(t, addr)
+	p.request(rrq("fw.bin"))
+	if data := p.expectData(1); string(data) != "firmware" {
+		t.Errorf("Expected the file, got %q", data)
+	}
+	p.send(nil, packets.Ack{BlockNumber: 1})
+
+	// the request is refused before a transfer starts
+	p.request(wrq("fw.bin"))
+	p.tid = addr
+	p.expectError(packets.ErrAccessViolation)
+	if content, _ := os.ReadFile(filepath.Join(root, "received/fw.bin")); content != nil {
+		t.Errorf("Expected no upload, got %q", content)
+	}
+}
+
+func TestACLMatchesCleanName(t *testing.T) {
+	root := t.TempDir()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	s := &Server{Root: root, Timeout: conformanceTimeout, Retries: 3, ACL: ACL{
+		{Network: netip.MustParsePrefix("127.0.0.0/8"), Ops: OpWrite, Files: "secret/*", Deny: true},
+		{Network: netip.MustParsePrefix("127.0.0.0/8")},
+	}}
+	go s.Serve(conn)
+	addr := conn.LocalAddr()
+
+	// the name is matched as it is written, a detour does not get around the rule
+	p := newPeer(t, addr)
+	p.request(wrq("public/../secret/fw.bin"))
+	p.tid = addr
+	p.expectError(packets.ErrAccessViolation)
+	if _, err := os.Stat(filepath.Join(root, UploadDir, "secret", "fw.bin")); err == nil {
+		t.Errorf("Expected no upload")
+	}
+}
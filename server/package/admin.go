@@ -0,0 +1,33 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/netip"
+)
+
+// AdminHandler serves the administration of the server over HTTP, it should only be reachable by the
+// administrators:
+//
+//	GET /bans          lists the banned clients as a JSON array of Ban
+//	DELETE /bans/{ip}  lifts the ban of a client
+func (s *Server) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /bans", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(s.Bans())
+	})
+	mux.HandleFunc("DELETE /bans/{ip}", func(w http.ResponseWriter, r *http.Request) {
+		addr, err := netip.ParseAddr(r.PathValue("ip"))
+		if err != nil {
+			http.Error(w, "Invalid IP address", http.StatusBadRequest)
+			return
+		}
+		if !s.Unban(addr) {
+			http.Error(w, "Not banned", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	return mux
+}
@@ -0,0 +1,207 @@
+package server
+
+import (
+	"TFTP/throttle"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBanWindow   = time.Minute      // window of BanThreshold when BanWindow is zero
+	defaultBanDuration = 10 * time.Minute // duration of a ban when BanDuration is zero
+
+	// idleClient is how long the request rate of a client that sends nothing is remembered.
+	idleClient = time.Minute
+)
+
+// Reasons of the offences that lead to a ban.
+const (
+	OffenceInvalidPacket   = "invalid packet"
+	OffenceNotFound        = "file not found"
+	OffenceAccessViolation = "access violation"
+)
+
+// Ban is a client IP whose datagrams are dropped until a time.
+type Ban struct {
+	Addr   netip.Addr `json:"addr"`
+	Until  time.Time  `json:"until"`
+	Reason string     `json:"reason"` // offence that led to the ban
+}
+
+// banList holds the request and reply rates, offences and bans of the client IPs.
+type banList struct {
+	mu        sync.Mutex
+	requests  map[netip.Addr]*requestRate
+	replies   map[netip.Addr]*requestRate // see AntiReflection
+	offences  map[netip.Addr][]time.Time
+	bans      map[netip.Addr]Ban
+	lastSweep time.Time
+}
+
+type requestRate struct {
+	bucket *throttle.Bucket
+	seen   time.Time
+	logged bool // the client was reported for going over the rate
+}
+
+// rateOf returns the rate of a client in rates, with a new bucket of perSecond when it is not known yet.
+// A second of them may come at once. The lock has to be held.
+func rateOf(rates *map[netip.Addr]*requestRate, addr netip.Addr, perSecond int, now time.Time) *requestRate {
+	r, ok := (*rates)[addr]
+	if !ok {
+		if *rates == nil {
+			*rates = make(map[netip.Addr]*requestRate)
+		}
+		r = &requestRate{bucket: throttle.NewBucket(int64(perSecond), int64(max(perSecond, 1)))}
+		(*rates)[addr] = r
+	}
+	r.seen = now
+	return r
+}
+
+// sweep forgets the clients that were idle for a while and the bans that are over, at most once
+// a minute. The lock has to be held.
+func (b *banList) sweep(now time.Time, window time.Duration) {
+	if now.Sub(b.lastSweep) < idleClient {
+		return
+	}
+	b.lastSweep = now
+
+	for _, rates := range []map[netip.Addr]*requestRate{b.requests, b.replies} {
+		for addr, rate := range rates {
+			if now.Sub(rate.seen) >= idleClient {
+				delete(rates, addr)
+			}
+		}
+	}
+	for addr, times := range b.offences {
+		if now.Sub(times[len(times)-1]) >= window {
+			delete(b.offences, addr)
+		}
+	}
+	for addr, ban := range b.bans {
+		if !now.Before(ban.Until) {
+			delete(b.bans, addr)
+		}
+	}
+}
+
+func (s *Server) banWindow() time.Duration {
+	if s.BanWindow == 0 {
+		return defaultBanWindow
+	}
+	return s.BanWindow
+}
+
+func (s *Server) banDuration() time.Duration {
+	if s.BanDuration == 0 {
+		return defaultBanDuration
+	}
+	return s.BanDuration
+}
+
+// whitelisted tells whether the client is never limited nor banned.
+func (s *Server) whitelisted(addr netip.Addr) bool {
+	return slices.ContainsFunc(s.Whitelist, func(network netip.Prefix) bool { return network.Contains(addr) })
+}
+
+// admit tells whether a datagram of the client read by Serve is handled: it is dropped when the client is
+// banned or sends more requests than RequestRate.
+func (s *Server) admit(client net.Addr) bool {
+	if s.RequestRate <= 0 && s.BanThreshold <= 0 {
+		return true
+	}
+	addr, ok := clientIP(client)
+	if !ok || s.whitelisted(addr) {
+		return true
+	}
+
+	b := &s.bans
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.sweep(now, s.banWindow())
+
+	if ban, ok := b.bans[addr]; ok {
+		if now.Before(ban.Until) {
+			return false
+		}
+		delete(b.bans, addr)
+	}
+
+	if s.RequestRate <= 0 {
+		return true
+	}
+	return rateOf(&b.requests, addr, s.RequestRate, now).bucket.Allow(1)
+}
+
+// offence counts an offence of the client, which is banned for BanDuration once it made BanThreshold of
+// them within BanWindow.
+func (s *Server) offence(client net.Addr, reason string) {
+	if s.BanThreshold <= 0 {
+		return
+	}
+	addr, ok := clientIP(client)
+	if !ok || s.whitelisted(addr) {
+		return
+	}
+
+	b := &s.bans
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	window := s.banWindow()
+
+	times := b.offences[addr]
+	for len(times) > 0 && now.Sub(times[0]) >= window {
+		times = times[1:]
+	}
+	times = append(times, now)
+	if len(times) < s.BanThreshold {
+		if b.offences == nil {
+			b.offences = make(map[netip.Addr][]time.Time)
+		}
+		b.offences[addr] = times
+		return
+	}
+
+	delete(b.offences, addr)
+	if b.bans == nil {
+		b.bans = make(map[netip.Addr]Ban)
+	}
+	b.bans[addr] = Ban{Addr: addr, Until: now.Add(s.banDuration()), Reason: reason}
+	s.logger().Warn("client banned", "client", addr.String(), "duration", s.banDuration(), "offences", len(times), "reason", reason)
+}
+
+// Bans returns the clients that are banned, sorted by address.
+func (s *Server) Bans() []Ban {
+	b := &s.bans
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	bans := make([]Ban, 0, len(b.bans))
+	for _, ban := range b.bans {
+		if now.Before(ban.Until) {
+			bans = append(bans, ban)
+		}
+	}
+	slices.SortFunc(bans, func(a, b Ban) int { return a.Addr.Compare(b.Addr) })
+	return bans
+}
+
+// Unban lifts the ban of a client and forgets its offences, it reports whether the client was banned.
+func (s *Server) Unban(addr netip.Addr) bool {
+	b := &s.bans
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	addr = addr.Unmap()
+	_, banned := b.bans[addr]
+	delete(b.bans, addr)
+	delete(b.offences, addr)
+	return banned
+}
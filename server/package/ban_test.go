@@ -0,0 +1,127 @@
+package server
+
+import (
+	"TFTP/packets"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+var loopback = netip.MustParseAddr("127.0.0.1")
+
+// expectNotFound requests a missing file and expects the server to answer it.
+func expectNotFound(p *peer) {
+	p.t.Helper()
+	p.request(rrq("missing.bin"))
+	p.expectError(packets.ErrNotFound)
+}
+
+func TestRequestRate(t *testing.T) {
+	addr, _ := configuredServer(t, &Server{RequestRate: 2})
+
+	// a second of requests is allowed at once, the rest is dropped
+	p := newPeer(t, addr)
+	expectNotFound(p)
+	expectNotFound(p)
+	p.request(rrq("missing.bin"))
+	p.expectNothing(conformanceTimeout)
+
+	time.Sleep(time.Second / 2)
+	expectNotFound(p)
+}
+
+func TestBanAfterProbes(t *testing.T) {
+	s := &Server{BanThreshold: 3}
+	addr, _ := configuredServer(t, s)
+
+	p := newPeer(t, addr)
+	for i := 0; i < 3; i++ {
+		expectNotFound(p)
+	}
+
+	// the datagrams of the banned client are dropped
+	p.request(rrq("missing.bin"))
+	p.expectNothing(conformanceTimeout)
+
+	bans := s.Bans()
+	if len(bans) != 1 || bans[0].Addr != loopback || bans[0].Reason != OffenceNotFound || time.Until(bans[0].Until) < 9*time.Minute {
+		t.Fatalf("Expected the loopback to be banned for 10 minutes, got %+v", bans)
+	}
+
+	if !s.Unban(loopback) {
+		t.Errorf("Expected the ban to be lifted")
+	}
+	expectNotFound(p)
+	if bans = s.Bans(); len(bans) != 0 {
+		t.Errorf("Expected no ban, got %+v", bans)
+	}
+}
+
+func TestBanExpires(t *testing.T) {
+	s := &Server{BanThreshold: 1, BanDuration: conformanceTimeout}
+	addr, _ := configuredServer(t, s)
+
+	p := newPeer(t, addr)
+	p.tid = addr
+	p.sendRaw(nil, []byte{0, 9})
+	p.expectError(packets.ErrIllegalOp)
+	p.sendRaw(nil, []byte{0, 9})
+	p.expectNothing(conformanceTimeout / 2)
+
+	time.Sleep(conformanceTimeout)
+	p.sendRaw(nil, []byte{0, 9})
+	p.expectError(packets.ErrIllegalOp)
+}
+
+func TestWhitelist(t *testing.T) {
+	s := &Server{RequestRate: 1, BanThreshold: 1, Whitelist: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}}
+	addr, _ := configuredServer(t, s)
+
+	p := newPeer(t, addr)
+	for i := 0; i < 3; i++ {
+		expectNotFound(p)
+	}
+	if bans := s.Bans(); len(bans) != 0 {
+		t.Errorf("Expected no ban, got %+v", bans)
+	}
+}
+
+func TestAdminHandler(t *testing.T) {
+	s := &Server{BanThreshold: 1}
+	s.offence(clientAddr("10.0.0.1"), OffenceAccessViolation)
+	admin := httptest.NewServer(s.AdminHandler())
+	defer admin.Close()
+
+	response, err := http.Get(admin.URL + "/bans")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bans []Ban
+	err = json.NewDecoder(response.Body).Decode(&bans)
+	response.Body.Close()
+	if err != nil || len(bans) != 1 || bans[0].Addr != netip.MustParseAddr("10.0.0.1") {
+		t.Fatalf("Expected the ban of 10.0.0.1, got %+v (%v)", bans, err)
+	}
+
+	for _, c := range []struct {
+		ip     string
+		status int
+	}{
+		{"10.0.0.1", http.StatusNoContent},
+		{"10.0.0.1", http.StatusNotFound},
+		{"not-an-ip", http.StatusBadRequest},
+	} {
+		request, _ := http.NewRequest(http.MethodDelete, admin.URL+"/bans/"+c.ip, nil)
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		if response.StatusCode != c.status {
+			t.Errorf("Expected %d lifting the ban of %s, got %d", c.status, c.ip, response.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	client "TFTP/client/package"
+	"TFTP/packets"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+// BenchmarkConcurrentDownloads downloads a large file in many sessions at once. Files are streamed, so the
+// peak heap (peak-heap-MB) stays flat when the files grow, it only depends on the number of sessions.
+func BenchmarkConcurrentDownloads(b *testing.B) {
+	for _, size := range []int64{16 << 20, 128 << 20} {
+		b.Run(fmt.Sprintf("%dMB", size>>20), func(b *testing.B) {
+			benchmarkDownloads(b, size, 16)
+		})
+	}
+}
+
+func benchmarkDownloads(b *testing.B, size int64, sessions int) {
+	root := b.TempDir()
+	file, err := os.Create(filepath.Join(root, "image.bin"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	// a sparse file, the content does not matter
+	if err = file.Truncate(size); err != nil {
+		b.Fatal(err)
+	}
+	file.Close()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+	go (&Server{Root: root, Timeout: time.Second, Retries: 10}).Serve(conn)
+	serverAddr := conn.LocalAddr().String()
+
+	peak, stop := samplePeakHeap()
+	b.SetBytes(size * int64(sessions))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		var wg sync.WaitGroup
+		for j := 0; j < sessions; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				req := packets.ReadRequest{
+					FileName: "image.bin",
+					Mode:     packets.OCTET,
+					Options:  map[string]string{packets.OptBlockSize: "8192", packets.OptWindowSize: "8"},
+				}
+				conn, err := client.SendRequest(req, &serverAddr)
+				if err != nil {
+					b.Error(err)
+					return
+				}
+				defer conn.Close()
+
+				handler := client.NewHandler(conn, 10*time.Second)
+				if err = handler.ReadTo(io.Discard); err != nil {
+					b.Error(err)
+				} else if handler.Stats.Bytes != size {
+					b.Errorf("Expected %d bytes, got %d", size, handler.Stats.Bytes)
+				}
+			}()
+		}
+		wg.Wait()
+	}
+
+	b.StopTimer()
+	stop()
+	b.ReportMetric(float64(*peak)/(1<<20), "peak-heap-MB")
+}
+
+// samplePeakHeap records the largest heap in use until stop is called.
+func samplePeakHeap() (*uint64, func()) {
+	var (
+		peak  uint64
+		done  = make(chan struct{})
+		ended = make(chan struct{})
+	)
+	go func() {
+		defer close(ended)
+		var stats runtime.MemStats
+		for {
+			runtime.ReadMemStats(&stats)
+			peak = max(peak, stats.HeapInuse)
+			select {
+			case <-done:
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}()
+	return &peak, func() {
+		close(done)
+		<-ended
+	}
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// maxHashing is how many files are hashed at the same time.
+const maxHashing = 2
+
+// checksums caches the SHA-256 of the listed files, a file is only hashed again once its size or
+// modification time changed. The files are hashed in the background, so that a listing never waits
+// for them, and only once however many listings ask for them.
+type checksums struct {
+	mu      sync.Mutex
+	files   map[string]cachedChecksum // by path
+	hashing map[string]bool           // paths being hashed
+	slots   chan struct{}             // bounds the files hashed at the same time to maxHashing
+	running sync.WaitGroup
+
+	hash func(path string) (string, error) // hashes a file, checksum when nil
+}
+
+type cachedChecksum struct {
+	size    int64
+	modTime time.Time
+	sum     string
+}
+
+// get returns the checksum of the file at path, info describes it as it is listed. It is empty until
+// the file is hashed, which is started in the background when the checksum is not cached yet.
+func (c *checksums) get(path string, info fs.FileInfo) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cached, ok := c.files[path]
+	if ok && cached.size == info.Size() && cached.modTime.Equal(info.ModTime()) {
+		return cached.sum
+	}
+	if c.hashing[path] {
+		return ""
+	}
+
+	if c.hashing == nil {
+		c.hashing = make(map[string]bool)
+		c.slots = make(chan struct{}, maxHashing)
+	}
+	c.hashing[path] = true
+	c.running.Add(1)
+	go c.update(path, info)
+	return ""
+}
+
+// update hashes the file at path and caches its checksum for the size and modification time of info.
+// A file that cannot be read is not cached, it is hashed again when it is listed again.
+func (c *checksums) update(path string, info fs.FileInfo) {
+	defer c.running.Done()
+	hash := c.hash
+	if hash == nil {
+		hash = checksum
+	}
+
+	c.slots <- struct{}{}
+	sum, err := hash(path)
+	<-c.slots
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.hashing, path)
+	if err != nil {
+		return
+	}
+	if c.files == nil {
+		c.files = make(map[string]cachedChecksum)
+	}
+	c.files[path] = cachedChecksum{size: info.Size(), modTime: info.ModTime(), sum: sum}
+}
+
+// forget drops the checksums of the files of dir that are not listed anymore.
+func (c *checksums) forget(dir string, listed map[string]bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for path := range c.files {
+		if filepath.Dir(path) == dir && !listed[path] {
+			delete(c.files, path)
+		}
+	}
+}
+
+func checksum(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// Config is the server config file, a JSON object such as:
+//
+//	{
+//		"acl": [
+//			{"network": "10.1.0.0/16", "ops": "read", "files": "pxelinux/*"},
+//			{"network": "10.9.9.0/24", "ops": "write", "files": "backups/*"}
+//		]
+//	}
+type Config struct {
+	ACL ACL `json:"acl"`
+}
+
+// LoadConfig reads the config file at path, unknown fields are rejected so that typos do not go unnoticed.
+func LoadConfig(path string) (*Config, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var config Config
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(&config)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid config file %s: %v", path, err)
+	}
+
+	err = config.ACL.validate()
+	if err != nil {
+		return nil, fmt.Errorf("Invalid config file %s: %v", path, err)
+	}
+	return &config, nil
+}
+
+// Apply sets the settings of the config file on the server.
+func (c *Config) Apply(s *Server) {
+	s.ACL = c.ACL
+}
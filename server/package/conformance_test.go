@@ -0,0 +1,377 @@
+package server
+
+import (
+	"TFTP/packets"
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// The conformance tests drive the server with raw packets and check the behavior RFC 1350 requires.
+
+const conformanceTimeout = 300 * time.Millisecond
+
+// conformanceServer serves files from a temporary root and returns the address of the server and the root.
+func conformanceServer(t *testing.T, files map[string][]byte) (net.Addr, string) {
+	t.Helper()
+	root := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	s := &Server{Root: root, Timeout: conformanceTimeout, Retries: 3}
+	go s.Serve(conn)
+	return conn.LocalAddr(), root
+}
+
+// peer is the client side of a transfer, it sends and expects raw packets.
+type peer struct {
+	t      *testing.T
+	conn   net.PacketConn
+	server net.Addr // address the requests are sent to
+	tid    net.Addr // address of the transfer, set by the first packet the server sends
+}
+
+func newPeer(t *testing.T, server net.Addr) *peer {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &peer{t: t, conn: conn, server: server}
+}
+
+// request sends a request to the server, a new transfer starts.
+func (p *peer) request(req encoding.BinaryMarshaler) {
+	p.t.Helper()
+	p.tid = nil
+	p.send(p.server, req)
+}
+
+// send sends a packet, to the transfer when to is nil.
+func (p *peer) send(to net.Addr, packet encoding.BinaryMarshaler) {
+	p.t.Helper()
+	data, err := packet.MarshalBinary()
+	if err != nil {
+		p.t.Fatalf("Error marshaling packet: %v", err)
+	}
+	p.sendRaw(to, data)
+}
+
+func (p *peer) sendRaw(to net.Addr, data []byte) {
+	p.t.Helper()
+	if to == nil {
+		to = p.tid
+	}
+	if _, err := p.conn.WriteTo(data, to); err != nil {
+		p.t.Fatalf("Error sending packet: %v", err)
+	}
+}
+
+// receive returns the next packet of the transfer, the first one has to come from a new port.
+func (p *peer) receive(timeout time.Duration) []byte {
+	p.t.Helper()
+	buf := make([]byte, 65536)
+	p.conn.SetReadDeadline(time.Now().Add(timeout))
+	n, addr, err := p.conn.ReadFrom(buf)
+	if err != nil {
+		p.t.Fatalf("Expected a packet, got %v", err)
+	}
+
+	if p.tid == nil {
+		if addr.String() == p.server.String() {
+			p.t.Fatalf("Expected the transfer to use a new port, got %s", addr)
+		}
+		p.tid = addr
+	} else if addr.String() != p.tid.String() {
+		p.t.Fatalf("Expected a packet from %s, got one from %s", p.tid, addr)
+	}
+	return buf[:n]
+}
+
+// expectNothing fails when a packet arrives within wait.
+func (p *peer) expectNothing(wait time.Duration) {
+	p.t.Helper()
+	buf := make([]byte, packets.DatagramSize)
+	p.conn.SetReadDeadline(time.Now().Add(wait))
+	if n, addr, err := p.conn.ReadFrom(buf); err == nil {
+		p.t.Fatalf("Expected no packet, got %v from %s", buf[:n], addr)
+	}
+}
+
+func (p *peer) expectData(block uint16) []byte {
+	p.t.Helper()
+	packet := p.receive(2 * conformanceTimeout)
+	if len(packet) < 4 || opcode(packet) != packets.DATA || binary.BigEndian.Uint16(packet[2:]) != block {
+		p.t.Fatalf("Expected DATA %d, got %v", block, packet)
+	}
+	return packet[4:]
+}
+
+func (p *peer) expectAck(block uint16) {
+	p.t.Helper()
+	packet := p.receive(2 * conformanceTimeout)
+	if len(packet) != 4 || opcode(packet) != packets.ACK || binary.BigEndian.Uint16(packet[2:]) != block {
+		p.t.Fatalf("Expected ACK %d, got %v", block, packet)
+	}
+}
+
+func (p *peer) expectError(code packets.ErrCode) {
+	p.t.Helper()
+	var errorPacket packets.Error
+	packet := p.receive(2 * conformanceTimeout)
+	if errorPacket.UnmarshalBinary(packet) != nil || errorPacket.ErrCode != code {
+		p.t.Fatalf("Expected ERROR %d, got %v", code, packet)
+	}
+}
+
+// download acknowledges every block of a transfer and returns the data.
+func (p *peer) download() []byte {
+	p.t.Helper()
+	var received []byte
+	for block := uint16(1); ; block++ {
+		data := p.expectData(block)
+		received = append(received, data...)
+		p.send(nil, packets.Ack{BlockNumber: block})
+		if len(data) < packets.BlockSize {
+			return received
+		}
+	}
+}
+
+// upload sends content block by block and waits for every ACK.
+func (p *peer) upload(content []byte) {
+	p.t.Helper()
+	for block := uint16(1); ; block++ {
+		n := min(len(content), packets.BlockSize)
+		p.send(nil, packets.Data{BlockNumber: block, Payload: bytes.NewReader(content[:n])})
+		p.expectAck(block)
+		content = content[n:]
+		if n < packets.BlockSize {
+			return
+		}
+	}
+}
+
+func opcode(packet []byte) packets.OpCode {
+	return packets.OpCode(binary.BigEndian.Uint16(packet))
+}
+
+func rrq(name string) packets.ReadRequest {
+	return packets.ReadRequest{FileName: name, Mode: packets.OCTET}
+}
+
+func wrq(name string) packets.WriteRequest {
+	return packets.WriteRequest{FileName: name, Mode: packets.OCTET}
+}
+
+func TestConformanceReadRequest(t *testing.T) {
+	files := map[string][]byte{
+		"partial.bin":  bytes.Repeat([]byte("p"), 2*packets.BlockSize+100),
+		"multiple.bin": bytes.Repeat([]byte("m"), 2*packets.BlockSize), // ends with an empty block
+		"empty.bin":    {},
+	}
+	addr, _ := conformanceServer(t, files)
+
+	for name, content := range files {
+		p := newPeer(t, addr)
+		p.request(rrq(name))
+		if received := p.download(); !bytes.Equal(received, content) {
+			t.Errorf("Expected %d bytes of %s, got %d", len(content), name, len(received))
+		}
+		// the last ACK ends the transfer
+		p.expectNothing(2 * conformanceTimeout)
+	}
+}
+
+func TestConformanceWriteRequest(t *testing.T) {
+	addr, root := conformanceServer(t, nil)
+
+	for name, content := range map[string][]byte{
+		"partial.bin":  bytes.Repeat([]byte("p"), 2*packets.BlockSize+100),
+		"multiple.bin": bytes.Repeat([]byte("m"), 2*packets.BlockSize),
+		"empty.bin":    {},
+	} {
+		p := newPeer(t, addr)
+		p.request(wrq(name))
+		p.expectAck(0)
+		p.upload(content)
+
+		uploaded, err := os.ReadFile(filepath.Join(root, UploadDir, name))
+		if err != nil || !bytes.Equal(uploaded, content) {
+			t.Errorf("Expected %d bytes in %s, got %d (%v)", len(content), name, len(uploaded), err)
+		}
+	}
+}
+
+func TestConformanceBlockSize(t *testing.T) {
+	content := bytes.Repeat([]byte("b"), 2500)
+	addr, _ := conformanceServer(t, map[string][]byte{"fw.bin": content})
+
+	req := rrq("fw.bin")
+	req.Options = map[string]string{packets.OptBlockSize: "1024", packets.OptWindowSize: "2"}
+	p := newPeer(t, addr)
+	p.request(req)
+
+	var oack packets.OptionAck
+	if err := oack.UnmarshalBinary(p.receive(2 * conformanceTimeout)); err != nil || len(oack.Options) != 2 ||
+		oack.Options[packets.OptBlockSize] != "1024" || oack.Options[packets.OptWindowSize] != "2" {
+		t.Fatalf("Expected the options to be accepted, got %v (%v)", oack.Options, err)
+	}
+	p.send(nil, packets.Ack{BlockNumber: 0})
+
+	// two blocks are sent before the server waits for an ACK (RFC 7440)
+	first, second := p.expectData(1), p.expectData(2)
+	if len(first) != 1024 || len(second) != 1024 {
+		t.Fatalf("Expected blocks of 1024 bytes, got %d and %d", len(first), len(second))
+	}
+	p.expectNothing(conformanceTimeout / 2)
+	p.send(nil, packets.Ack{BlockNumber: 2})
+	if last := p.expectData(3); len(last) != len(content)-2048 {
+		t.Errorf("Expected a last block of %d bytes, got %d", len(content)-2048, len(last))
+	}
+	p.send(nil, packets.Ack{BlockNumber: 3})
+}
+
+func TestConformanceFileNotFound(t *testing.T) {
+	addr, _ := conformanceServer(t, nil)
+
+	p := newPeer(t, addr)
+	p.request(rrq("missing.bin"))
+	p.expectError(packets.ErrNotFound)
+}
+
+func TestConformanceIllegalOpcode(t *testing.T) {
+	addr, _ := conformanceServer(t, nil)
+
+	// only requests are legal on the port of the server
+	for _, packet := range [][]byte{
+		{0, 9, 0, 1},
+		{0, byte(packets.ACK), 0, 1},
+		{0, byte(packets.DATA), 0, 1, 'x'},
+	} {
+		p := newPeer(t, addr)
+		p.sendRaw(addr, packet)
+		p.tid = addr
+		p.expectError(packets.ErrIllegalOp)
+	}
+}
+
+func TestConformanceIllegalOpcodeDuringTransfer(t *testing.T) {
+	addr, _ := conformanceServer(t, map[string][]byte{"fw.bin": bytes.Repeat([]byte("x"), 2000)})
+
+	p := newPeer(t, addr)
+	p.request(rrq("fw.bin"))
+	p.expectData(1)
+	p.sendRaw(nil, []byte{0, 9, 0, 1})
+	p.expectError(packets.ErrIllegalOp)
+}
+
+func TestConformanceDuplicateAck(t *testing.T) {
+	addr, _ := conformanceServer(t, map[string][]byte{"fw.bin": bytes.Repeat([]byte("x"), 3*packets.BlockSize)})
+
+	p := newPeer(t, addr)
+	p.request(rrq("fw.bin"))
+	p.expectData(1)
+
+	// a delayed duplicate of ACK 1 must not make the server send block 2 again (Sorcerer's Apprentice)
+	p.send(nil, packets.Ack{BlockNumber: 1})
+	p.send(nil, packets.Ack{BlockNumber: 1})
+	p.expectData(2)
+	p.expectNothing(conformanceTimeout / 2)
+
+	p.send(nil, packets.Ack{BlockNumber: 2})
+	p.expectData(3)
+	p.send(nil, packets.Ack{BlockNumber: 3})
+	if data := p.expectData(4); len(data) != 0 {
+		t.Errorf("Expected an empty last block, got %d bytes", len(data))
+	}
+	p.send(nil, packets.Ack{BlockNumber: 4})
+}
+
+func TestConformanceDuplicateData(t *testing.T) {
+	addr, root := conformanceServer(t, nil)
+	content := bytes.Repeat([]byte("d"), packets.BlockSize+10)
+
+	p := newPeer(t, addr)
+	p.request(wrq("dup.bin"))
+	p.expectAck(0)
+
+	// the duplicate is acknowledged again, but only written once
+	first := packets.Data{BlockNumber: 1, Payload: bytes.NewReader(content[:packets.BlockSize])}
+	data, _ := first.MarshalBinary()
+	p.sendRaw(nil, data)
+	p.expectAck(1)
+	p.sendRaw(nil, data)
+	p.expectAck(1)
+	p.send(nil, packets.Data{BlockNumber: 2, Payload: bytes.NewReader(content[packets.BlockSize:])})
+	p.expectAck(2)
+
+	uploaded, err := os.ReadFile(filepath.Join(root, "received/dup.bin"))
+	if err != nil || !bytes.Equal(uploaded, content) {
+		t.Errorf("Expected %d bytes, got %d (%v)", len(content), len(uploaded), err)
+	}
+}
+
+func TestConformanceUnknownTransferID(t *testing.T) {
+	addr, _ := conformanceServer(t, map[string][]byte{"fw.bin": bytes.Repeat([]byte("x"), 2000)})
+
+	p := newPeer(t, addr)
+	p.request(rrq("fw.bin"))
+	p.expectData(1)
+
+	// a packet from another port is answered with an ERROR, the transfer goes on
+	stranger := newPeer(t, addr)
+	stranger.sendRaw(p.tid, []byte{0, byte(packets.ACK), 0, 1})
+	stranger.tid = p.tid
+	stranger.expectError(packets.ErrUnknownID)
+
+	p.send(nil, packets.Ack{BlockNumber: 1})
+	p.expectData(2)
+}
+
+func TestConformanceReadTimeout(t *testing.T) {
+	addr, _ := conformanceServer(t, map[string][]byte{"fw.bin": bytes.Repeat([]byte("x"), 2000)})
+
+	p := newPeer(t, addr)
+	p.request(rrq("fw.bin"))
+	first := p.expectData(1)
+
+	// without an ACK the block is sent again, until the server gives up
+	if again := p.expectData(1); !bytes.Equal(first, again) {
+		t.Errorf("Expected the same block again")
+	}
+	p.expectData(1)
+	p.expectNothing(2 * conformanceTimeout)
+}
+
+func TestConformanceWriteTimeout(t *testing.T) {
+	addr, _ := conformanceServer(t, nil)
+
+	p := newPeer(t, addr)
+	p.request(wrq("slow.bin"))
+	p.expectAck(0)
+
+	// without DATA the last ACK is sent again
+	p.expectAck(0)
+	p.send(nil, packets.Data{BlockNumber: 1, Payload: bytes.NewReader([]byte("late"))})
+	p.expectAck(1)
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"TFTP/transfer"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// demux routes the datagrams read from the socket of the server to the transfers, by the address of the
+// client, when all transfers share that socket (see Server.SinglePort).
+type demux struct {
+	conn     net.PacketConn
+	mu       sync.Mutex
+	sessions map[string]*sessionConn
+}
+
+func newDemux(conn net.PacketConn) *demux {
+	return &demux{conn: conn, sessions: make(map[string]*sessionConn)}
+}
+
+// open returns the socket of a new transfer with client.
+func (d *demux) open(client net.Addr) *sessionConn {
+	session := &sessionConn{
+		demux:  d,
+		client: client,
+		// room for a whole window of blocks, like the buffer of a socket
+		packets: make(chan []byte, 2*transfer.MaxWindowSize),
+		closed:  make(chan struct{}),
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.sessions[client.String()] = session
+	return session
+}
+
+// active tells whether a transfer with client is running.
+func (d *demux) active(client net.Addr) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_, ok := d.sessions[client.String()]
+	return ok
+}
+
+// deliver passes a datagram to the transfer with client and reports whether there is one.
+// The datagram is dropped when the transfer does not keep up, as a full socket buffer would.
+func (d *demux) deliver(client net.Addr, packet []byte) bool {
+	d.mu.Lock()
+	session, ok := d.sessions[client.String()]
+	d.mu.Unlock()
+	if !ok {
+		return false
+	}
+
+	select {
+	case session.packets <- append([]byte(nil), packet...):
+	default:
+	}
+	return true
+}
+
+// closeAll ends the reads of every transfer, the socket they share is closed.
+func (d *demux) closeAll() {
+	d.mu.Lock()
+	sessions := d.sessions
+	d.sessions = make(map[string]*sessionConn)
+	d.mu.Unlock()
+
+	for _, session := range sessions {
+		session.Close()
+	}
+}
+
+// sessionConn is the socket of a transfer in single port mode: it reads the datagrams of its client
+// passed by the demux and writes to the socket of the server.
+type sessionConn struct {
+	demux   *demux
+	client  net.Addr
+	packets chan []byte
+
+	mu        sync.Mutex
+	deadline  time.Time
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func (c *sessionConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.mu.Lock()
+	deadline := c.deadline
+	c.mu.Unlock()
+
+	var expired <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case <-c.closed:
+		return 0, nil, c.opError("read", net.ErrClosed)
+	default:
+	}
+
+	select {
+	case packet := <-c.packets:
+		return copy(b, packet), c.client, nil
+	case <-c.closed:
+		return 0, nil, c.opError("read", net.ErrClosed)
+	case <-expired:
+		return 0, nil, c.opError("read", os.ErrDeadlineExceeded)
+	}
+}
+
+func (c *sessionConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, c.opError("write", net.ErrClosed)
+	default:
+	}
+	return c.demux.conn.WriteTo(b, addr)
+}
+
+// Close ends the transfer, the following datagrams of the client are handled by the server again.
+func (c *sessionConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.demux.mu.Lock()
+		defer c.demux.mu.Unlock()
+		if c.demux.sessions[c.client.String()] == c {
+			delete(c.demux.sessions, c.client.String())
+		}
+	})
+	return nil
+}
+
+func (c *sessionConn) LocalAddr() net.Addr {
+	return c.demux.conn.LocalAddr()
+}
+
+// SetDeadline only sets the read deadline, the write deadline would apply to every transfer.
+func (c *sessionConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *sessionConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	return nil
+}
+
+func (c *sessionConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *sessionConn) opError(op string, err error) error {
+	return &net.OpError{Op: op, Net: "session", Source: c.LocalAddr(), Addr: c.client, Err: err}
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"TFTP/packets"
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// singlePortServer serves files from a temporary root with every transfer on the port of the server.
+func singlePortServer(t *testing.T, files map[string][]byte) (net.Addr, string) {
+	t.Helper()
+	root := t.TempDir()
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(root, name), content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	s := &Server{Root: root, Timeout: conformanceTimeout, Retries: 3, SinglePort: true}
+	go s.Serve(conn)
+	return conn.LocalAddr(), root
+}
+
+// request sends a request in single port mode, the transfer answers from the port of the server.
+func singlePortRequest(p *peer, req packets.Request) {
+	p.t.Helper()
+	p.request(req)
+	p.tid = p.server
+}
+
+func TestSinglePortConcurrentDownloads(t *testing.T) {
+	files := map[string][]byte{
+		"first.bin":  bytes.Repeat([]byte("1"), 3*packets.BlockSize+10),
+		"second.bin": bytes.Repeat([]byte("2"), 2*packets.BlockSize+20),
+	}
+	addr, _ := singlePortServer(t, files)
+
+	first, second := newPeer(t, addr), newPeer(t, addr)
+	singlePortRequest(first, rrq("first.bin"))
+	singlePortRequest(second, rrq("second.bin"))
+
+	// the blocks of both transfers alternate on the same port
+	var received [2][]byte
+	done := [2]bool{}
+	for block := uint16(1); !done[0] || !done[1]; block++ {
+		for i, p := range []*peer{first, second} {
+			if done[i] {
+				continue
+			}
+			data := p.expectData(block)
+			received[i] = append(received[i], data...)
+			p.send(nil, packets.Ack{BlockNumber: block})
+			done[i] = len(data) < packets.BlockSize
+		}
+	}
+
+	if !bytes.Equal(received[0], files["first.bin"]) || !bytes.Equal(received[1], files["second.bin"]) {
+		t.Errorf("Expected every client to get its file, got %d and %d bytes", len(received[0]), len(received[1]))
+	}
+}
+
+func TestSinglePortUpload(t *testing.T) {
+	addr, root := singlePortServer(t, nil)
+	content := bytes.Repeat([]byte("u"), 2*packets.BlockSize+30)
+
+	p := newPeer(t, addr)
+	singlePortRequest(p, wrq("upload.bin"))
+	p.expectAck(0)
+	// the request sent again while the transfer runs is dropped
+	p.send(addr, wrq("upload.bin"))
+	p.upload(content)
+
+	uploaded, err := os.ReadFile(filepath.Join(root, "received/upload.bin"))
+	if err != nil || !bytes.Equal(uploaded, content) {
+		t.Errorf("Expected %d bytes uploaded, got %d (%v)", len(content), len(uploaded), err)
+	}
+}
+
+func TestSinglePortUnknownTransfer(t *testing.T) {
+	addr, _ := singlePortServer(t, nil)
+
+	// a block from a client without a transfer
+	p := newPeer(t, addr)
+	p.tid = addr
+	p.send(nil, packets.Ack{BlockNumber: 1})
+	p.expectError(packets.ErrUnknownID)
+}
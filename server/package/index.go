@@ -0,0 +1,149 @@
+package server
+
+import (
+	"TFTP/packets"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// UploadDir is the directory under the root the uploads are stored in, a WRQ of name writes UploadDir/name.
+const UploadDir = "received"
+
+// localName cleans a requested file name into a slash separated path, names that are absolute or climb out
+// of the directory they are relative to are rejected, and so are the temporary files of uploads, which are
+// neither served nor written by another upload.
+func localName(name string) (string, error) {
+	local := filepath.FromSlash(name)
+	if !filepath.IsLocal(local) || isTemp(filepath.Base(filepath.Clean(local))) {
+		return "", errors.New("Access violation")
+	}
+	return filepath.ToSlash(filepath.Clean(local)), nil
+}
+
+// resolve maps a requested file name to a path under the server root,
+// names that are absolute or climb out of the root are rejected.
+func (s *Server) resolve(name string) (string, error) {
+	name, err := localName(name)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(s.Root, filepath.FromSlash(name)), nil
+}
+
+// openFile opens the file to send to the client. It is read block by block as the transfer goes,
+// so that large files are not loaded into memory. When the file is the index or the listing
+// of a directory and does not exist on disk, it is generated from the directory.
+// The generated files only list the files readable tells, every file when it is nil.
+// The returned function closes the file.
+func (s *Server) openFile(path string, readable func(path string) bool) (*io.SectionReader, func(), error) {
+	file, err := os.Open(path)
+	if err == nil {
+		info, err := file.Stat()
+		if err == nil && !info.Mode().IsRegular() {
+			err = errors.New("Not a regular file")
+		}
+		if err != nil {
+			file.Close()
+			return nil, nil, err
+		}
+		return io.NewSectionReader(file, 0, info.Size()), func() { file.Close() }, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, nil, err
+	}
+
+	var generated []byte
+	switch filepath.Base(path) {
+	case s.IndexName:
+		generated, err = buildIndex(filepath.Dir(path), s.IndexName, readable)
+	case s.ListName:
+		generated, err = s.buildListing(filepath.Dir(path), readable)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return io.NewSectionReader(bytes.NewReader(generated), 0, int64(len(generated))), func() {}, nil
+}
+
+// buildIndex lists the regular files of the directory tree, one path relative to dir
+// (with forward slashes) per line, so that clients can download the whole tree.
+func buildIndex(dir string, indexName string, readable func(path string) bool) ([]byte, error) {
+	var index bytes.Buffer
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !entry.Type().IsRegular() || entry.Name() == indexName || isTemp(entry.Name()) || (readable != nil && !readable(path)) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		index.WriteString(filepath.ToSlash(rel))
+		index.WriteByte('\n')
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return index.Bytes(), nil
+}
+
+// buildListing describes the entries of the directory as a JSON array of packets.ListEntry, the checksums
+// of the files are cached until they change, a file that is still being hashed is listed without one.
+// Only regular files and directories are listed, so symlinks cannot reveal anything outside of the root,
+// and a directory only when its own listing is readable.
+func (s *Server) buildListing(dir string, readable func(path string) bool) ([]byte, error) {
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	listing := make([]packets.ListEntry, 0, len(dirEntries))
+	listed := make(map[string]bool, len(dirEntries))
+	for _, dirEntry := range dirEntries {
+		if !dirEntry.IsDir() && (!dirEntry.Type().IsRegular() || isTemp(dirEntry.Name())) {
+			continue
+		}
+		path := filepath.Join(dir, dirEntry.Name())
+		checked := path
+		if dirEntry.IsDir() {
+			checked = filepath.Join(path, s.ListName)
+		}
+		if readable != nil && !readable(checked) {
+			continue
+		}
+
+		info, err := dirEntry.Info()
+		if err != nil {
+			return nil, err
+		}
+
+		entry := packets.ListEntry{
+			Name:    dirEntry.Name(),
+			Size:    info.Size(),
+			ModTime: info.ModTime().UTC(),
+			IsDir:   dirEntry.IsDir(),
+		}
+
+		if !entry.IsDir {
+			entry.SHA256 = s.checksums.get(path, info)
+			listed[path] = true
+		}
+		listing = append(listing, entry)
+	}
+
+	// the files that are gone are not hashed anymore
+	s.checksums.forget(dir, listed)
+	return json.Marshal(listing)
+}
@@ -0,0 +1,310 @@
+package server
+
+import (
+	"TFTP/packets"
+	"TFTP/transfer"
+	"cmp"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Outcomes of the requests, see MetricsHandler.
+const (
+	OutcomeCompleted = "completed" // the transfer ended with the last block
+	OutcomeFailed    = "failed"    // the transfer started but was aborted
+	OutcomeDenied    = "denied"    // the ACL denied the request
+	OutcomeDropped   = "dropped"   // the client is banned or over its rate, nothing was answered
+	OutcomeInvalid   = "invalid"   // not a valid request
+)
+
+// durationBuckets are the upper bounds in seconds of the buckets of the transfer duration histograms.
+var durationBuckets = []float64{0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60, 300}
+
+type requestKey struct {
+	opcode  string
+	outcome string
+}
+
+type errorKey struct {
+	code      packets.ErrCode
+	direction string // "sent" or "received"
+}
+
+type histogram struct {
+	counts []uint64 // one per bucket of durationBuckets, not cumulative
+	count  uint64
+	sum    float64
+}
+
+func (h *histogram) observe(seconds float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(durationBuckets))
+	}
+	if i, _ := slices.BinarySearch(durationBuckets, seconds); i < len(durationBuckets) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += seconds
+}
+
+// metrics counts what the server does, the zero value is ready to use.
+type metrics struct {
+	mu            sync.Mutex
+	active        int
+	requests      map[requestKey]uint64
+	errors        map[errorKey]uint64
+	bytesSent     int64
+	bytesReceived int64
+	retransmits   int
+	timeouts      int
+	durations     map[Operation]*histogram
+}
+
+// request counts a datagram read from the port of the server that did not start a transfer.
+func (m *metrics) request(opcode, outcome string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.countRequest(opcode, outcome)
+}
+
+func (m *metrics) countRequest(opcode, outcome string) {
+	if m.requests == nil {
+		m.requests = make(map[requestKey]uint64)
+	}
+	m.requests[requestKey{opcode, outcome}]++
+}
+
+func (m *metrics) started() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.active++
+}
+
+// progress counts what a transfer of op added to its stats, as it goes.
+func (m *metrics) progress(op Operation, delta transfer.Stats) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if op == OpWrite {
+		m.bytesReceived += delta.Bytes
+	} else {
+		m.bytesSent += delta.Bytes
+	}
+	m.retransmits += delta.Retransmits
+	m.timeouts += delta.Timeouts
+}
+
+// finished counts a transfer that ended, its stats were counted by progress.
+func (m *metrics) finished(op Operation, completed bool, duration time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.active--
+
+	outcome := OutcomeFailed
+	if completed {
+		outcome = OutcomeCompleted
+	}
+	m.countRequest(requestOpcode(op), outcome)
+
+	if m.durations == nil {
+		m.durations = make(map[Operation]*histogram)
+	}
+	h, ok := m.durations[op]
+	if !ok {
+		h = &histogram{}
+		m.durations[op] = h
+	}
+	h.observe(duration.Seconds())
+}
+
+func (m *metrics) errorPacket(packet []byte, direction string) {
+	code, _, err := packets.ParseError(packet)
+	if err != nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.errors == nil {
+		m.errors = make(map[errorKey]uint64)
+	}
+	m.errors[errorKey{code, direction}]++
+}
+
+// wrap returns conn counting the ERROR packets sent and received through it. A UDP socket keeps the
+// methods the transfers use to send and read without allocating.
+func (m *metrics) wrap(conn net.PacketConn) net.PacketConn {
+	wrapped := &metricsConn{PacketConn: conn, m: m}
+	if udp, ok := conn.(transfer.UDPConn); ok {
+		return &metricsUDPConn{metricsConn: wrapped, udp: udp}
+	}
+	return wrapped
+}
+
+type metricsConn struct {
+	net.PacketConn
+	m *metrics
+}
+
+type metricsUDPConn struct {
+	*metricsConn
+	udp transfer.UDPConn
+}
+
+func (c *metricsUDPConn) ReadFromUDPAddrPort(p []byte) (int, netip.AddrPort, error) {
+	n, addr, err := c.udp.ReadFromUDPAddrPort(p)
+	if err == nil && isError(p[:n]) {
+		c.m.errorPacket(p[:n], "received")
+	}
+	return n, addr, err
+}
+
+func (c *metricsUDPConn) WriteToUDPAddrPort(p []byte, addr netip.AddrPort) (int, error) {
+	n, err := c.udp.WriteToUDPAddrPort(p, addr)
+	if err == nil && isError(p) {
+		c.m.errorPacket(p, "sent")
+	}
+	return n, err
+}
+
+func (c *metricsConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(p)
+	if err == nil && isError(p[:n]) {
+		c.m.errorPacket(p[:n], "received")
+	}
+	return n, addr, err
+}
+
+func (c *metricsConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	n, err := c.PacketConn.WriteTo(p, addr)
+	if err == nil && isError(p) {
+		c.m.errorPacket(p, "sent")
+	}
+	return n, err
+}
+
+func isError(packet []byte) bool {
+	return len(packet) >= 2 && packet[0] == 0 && packets.OpCode(packet[1]) == packets.ERROR
+}
+
+// requestOpcode returns the name of the opcode of the requests of op.
+func requestOpcode(op Operation) string {
+	if op == OpWrite {
+		return "WRQ"
+	}
+	return "RRQ"
+}
+
+// opcodeName returns the name of the opcode of a datagram, "unknown" when it is not one.
+func opcodeName(data []byte) string {
+	if len(data) < 2 || data[0] != 0 {
+		return "unknown"
+	}
+	switch packets.OpCode(data[1]) {
+	case packets.PRQ:
+		return "RRQ"
+	case packets.WRQ:
+		return "WRQ"
+	case packets.DATA:
+		return "DATA"
+	case packets.ACK:
+		return "ACK"
+	case packets.ERROR:
+		return "ERROR"
+	case packets.OACK:
+		return "OACK"
+	}
+	return "unknown"
+}
+
+// writeTo writes the metrics in the Prometheus text format.
+func (m *metrics) writeTo(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP tftp_active_sessions Transfers running.")
+	fmt.Fprintln(w, "# TYPE tftp_active_sessions gauge")
+	fmt.Fprintf(w, "tftp_active_sessions %d\n", m.active)
+
+	fmt.Fprintln(w, "# HELP tftp_requests_total Datagrams read from the port of the server, by opcode and outcome.")
+	fmt.Fprintln(w, "# TYPE tftp_requests_total counter")
+	requests := make([]requestKey, 0, len(m.requests))
+	for key := range m.requests {
+		requests = append(requests, key)
+	}
+	slices.SortFunc(requests, func(a, b requestKey) int {
+		return cmp.Or(cmp.Compare(a.opcode, b.opcode), cmp.Compare(a.outcome, b.outcome))
+	})
+	for _, key := range requests {
+		fmt.Fprintf(w, "tftp_requests_total{opcode=%q,outcome=%q} %d\n", key.opcode, key.outcome, m.requests[key])
+	}
+
+	fmt.Fprintln(w, "# HELP tftp_bytes_sent_total Bytes of data sent by the transfers, without retransmissions.")
+	fmt.Fprintln(w, "# TYPE tftp_bytes_sent_total counter")
+	fmt.Fprintf(w, "tftp_bytes_sent_total %d\n", m.bytesSent)
+	fmt.Fprintln(w, "# HELP tftp_bytes_received_total Bytes of data received by the transfers, without duplicates.")
+	fmt.Fprintln(w, "# TYPE tftp_bytes_received_total counter")
+	fmt.Fprintf(w, "tftp_bytes_received_total %d\n", m.bytesReceived)
+	fmt.Fprintln(w, "# HELP tftp_retransmissions_total Packets sent again by the transfers.")
+	fmt.Fprintln(w, "# TYPE tftp_retransmissions_total counter")
+	fmt.Fprintf(w, "tftp_retransmissions_total %d\n", m.retransmits)
+	fmt.Fprintln(w, "# HELP tftp_timeouts_total Times a client did not answer a transfer in time.")
+	fmt.Fprintln(w, "# TYPE tftp_timeouts_total counter")
+	fmt.Fprintf(w, "tftp_timeouts_total %d\n", m.timeouts)
+
+	fmt.Fprintln(w, "# HELP tftp_error_packets_total ERROR packets, by error code and direction.")
+	fmt.Fprintln(w, "# TYPE tftp_error_packets_total counter")
+	errors := make([]errorKey, 0, len(m.errors))
+	for key := range m.errors {
+		errors = append(errors, key)
+	}
+	slices.SortFunc(errors, func(a, b errorKey) int {
+		return cmp.Or(cmp.Compare(a.code, b.code), cmp.Compare(a.direction, b.direction))
+	})
+	for _, key := range errors {
+		fmt.Fprintf(w, "tftp_error_packets_total{code=\"%d\",direction=%q} %d\n", key.code, key.direction, m.errors[key])
+	}
+
+	fmt.Fprintln(w, "# HELP tftp_transfer_duration_seconds Duration of the transfers, by operation.")
+	fmt.Fprintln(w, "# TYPE tftp_transfer_duration_seconds histogram")
+	for _, op := range []Operation{OpRead, OpWrite} {
+		h, ok := m.durations[op]
+		if !ok {
+			continue
+		}
+		var cumulative uint64
+		for i, bound := range durationBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(w, "tftp_transfer_duration_seconds_bucket{op=%q,le=%q} %d\n", op, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(w, "tftp_transfer_duration_seconds_bucket{op=%q,le=\"+Inf\"} %d\n", op, h.count)
+		fmt.Fprintf(w, "tftp_transfer_duration_seconds_sum{op=%q} %s\n", op, strconv.FormatFloat(h.sum, 'g', -1, 64))
+		fmt.Fprintf(w, "tftp_transfer_duration_seconds_count{op=%q} %d\n", op, h.count)
+	}
+}
+
+// MetricsHandler serves the metrics of the server in the Prometheus text format: the running transfers,
+// the requests by opcode and outcome, the bytes of data sent and received, the retransmissions and timeouts,
+// the ERROR packets by code, and histograms of the transfer durations. See MetricsListen.
+func (s *Server) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		s.metrics.writeTo(w)
+	})
+}
+
+// serveMetrics starts the HTTP listener of MetricsListen, it is closed with the returned function.
+func (s *Server) serveMetrics() (func(), error) {
+	listener, err := net.Listen("tcp", s.MetricsListen)
+	if err != nil {
+		return nil, fmt.Errorf("Error listening for metrics: %w", err)
+	}
+	server := &http.Server{Handler: s.MetricsHandler(), ReadHeaderTimeout: 10 * time.Second}
+	go func() { _ = server.Serve(listener) }()
+	return func() { _ = server.Close() }, nil
+}
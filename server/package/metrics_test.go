@@ -0,0 +1,123 @@
+package server
+
+import (
+	client "TFTP/client/package"
+	"TFTP/packets"
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// scrape returns the metrics served by url.
+func scrape(t *testing.T, url string) string {
+	t.Helper()
+	response, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+// expectMetrics fails when one of the lines is missing from the scraped metrics.
+func expectMetrics(t *testing.T, metrics string, lines ...string) {
+	t.Helper()
+	for _, line := range lines {
+		if !strings.Contains(metrics, line+"\n") {
+			t.Errorf("Expected %q in the metrics:\n%s", line, metrics)
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	s := &Server{}
+	addr, root := configuredServer(t, s)
+	content := bytes.Repeat([]byte("firmware"), 200)
+	if err := os.WriteFile(filepath.Join(root, "fw.bin"), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	metrics := httptest.NewServer(s.MetricsHandler())
+	defer metrics.Close()
+
+	// the transfer waits for the ACK of the first block while it is scraped
+	p := newPeer(t, addr)
+	p.request(rrq("fw.bin"))
+	p.expectData(1)
+	expectMetrics(t, scrape(t, metrics.URL), "tftp_active_sessions 1")
+	p.send(nil, packets.Ack{BlockNumber: 1})
+
+	// the data is counted as it is acknowledged, not once the transfer ends
+	p.expectData(2)
+	expectMetrics(t, scrape(t, metrics.URL), "tftp_bytes_sent_total "+strconv.Itoa(packets.BlockSize))
+	p.send(nil, packets.Ack{BlockNumber: 2})
+	for block := uint16(3); ; block++ {
+		data := p.expectData(block)
+		p.send(nil, packets.Ack{BlockNumber: block})
+		if len(data) < packets.BlockSize {
+			break
+		}
+	}
+	expectNotFound(p)
+	p.tid = addr
+	p.sendRaw(nil, []byte{0, 9})
+	p.expectError(packets.ErrIllegalOp)
+
+	// the transfers are counted once they return
+	var scraped string
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		scraped = scrape(t, metrics.URL)
+		if strings.Contains(scraped, "tftp_active_sessions 0\n") {
+			break
+		}
+	}
+	expectMetrics(t, scraped,
+		"tftp_active_sessions 0",
+		`tftp_requests_total{opcode="RRQ",outcome="completed"} 1`,
+		`tftp_requests_total{opcode="RRQ",outcome="failed"} 1`,
+		`tftp_requests_total{opcode="unknown",outcome="invalid"} 1`,
+		"tftp_bytes_sent_total "+strconv.Itoa(len(content)),
+		`tftp_error_packets_total{code="1",direction="sent"} 1`,
+		`tftp_error_packets_total{code="4",direction="sent"} 1`,
+		`tftp_transfer_duration_seconds_bucket{op="read",le="+Inf"} 2`,
+		`tftp_transfer_duration_seconds_count{op="read"} 2`,
+	)
+}
+
+func TestMetricsKeepUDPFastPath(t *testing.T) {
+	if raceEnabled {
+		t.Skip("The race detector makes allocations of its own")
+	}
+	addr, root := configuredServer(t, &Server{})
+	const blocks = 1000
+	if err := os.WriteFile(filepath.Join(root, "fw.bin"), make([]byte, blocks*packets.BlockSize), 0644); err != nil {
+		t.Fatal(err)
+	}
+	serverAddr := addr.String()
+
+	// the sockets of the transfers count the ERROR packets, they still send and read without allocating
+	allocs := testing.AllocsPerRun(5, func() {
+		conn, err := client.SendRequest(packets.ReadRequest{FileName: "fw.bin", Mode: packets.OCTET}, &serverAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		handler := client.NewHandler(conn, 10*conformanceTimeout)
+		if err = handler.ReadTo(io.Discard); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs > blocks/4 {
+		t.Errorf("Expected far less than an allocation per block, got %v for %d blocks", allocs, blocks)
+	}
+}
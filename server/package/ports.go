@@ -0,0 +1,83 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ErrNoPorts is returned when every port of the PortRange is taken by a transfer.
+var ErrNoPorts = errors.New("No free port for the transfer")
+
+// PortRange is an inclusive range of ports, e.g. the ports a firewall lets through.
+// It implements flag.Value, it is written as "first-last".
+type PortRange struct {
+	First, Last int
+}
+
+func (r PortRange) empty() bool {
+	return r.First == 0 && r.Last == 0
+}
+
+func (r PortRange) validate() error {
+	if r.First < 1 || r.Last > 65535 || r.First > r.Last {
+		return fmt.Errorf("Invalid port range %d-%d", r.First, r.Last)
+	}
+	return nil
+}
+
+func (r *PortRange) String() string {
+	if r == nil || r.empty() {
+		return ""
+	}
+	return fmt.Sprintf("%d-%d", r.First, r.Last)
+}
+
+func (r *PortRange) Set(value string) error {
+	first, last, ok := strings.Cut(value, "-")
+	if !ok {
+		last = first
+	}
+
+	var parsed PortRange
+	var err error
+	parsed.First, err = strconv.Atoi(first)
+	if err == nil {
+		parsed.Last, err = strconv.Atoi(last)
+	}
+	if err != nil {
+		return fmt.Errorf("Invalid port range %q", value)
+	}
+	if err = parsed.validate(); err != nil {
+		return err
+	}
+
+	*r = parsed
+	return nil
+}
+
+// portAllocator opens the sockets of the transfers on the ports of a range. A port is free again once its
+// socket is closed, the kernel tells which ones are taken, so ports used by other programs are skipped too.
+type portAllocator struct {
+	mu   sync.Mutex
+	next int // offset in the range of the next port to try, so a port just released is reused last
+}
+
+func (p *portAllocator) listen(host string, r PortRange) (net.PacketConn, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	size := r.Last - r.First + 1
+	for i := 0; i < size; i++ {
+		port := r.First + (p.next+i)%size
+		conn, err := net.ListenPacket("udp", net.JoinHostPort(host, strconv.Itoa(port)))
+		if err == nil {
+			p.next = (p.next + i + 1) % size
+			return conn, nil
+		}
+	}
+	return nil, ErrNoPorts
+}
@@ -0,0 +1,183 @@
+package server
+
+import (
+	"TFTP/packets"
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// freePorts returns a range of size ports that are not taken on the loopback.
+func freePorts(t *testing.T, size int) PortRange {
+	t.Helper()
+	for attempt := 0; attempt < 20; attempt++ {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		first := conn.LocalAddr().(*net.UDPAddr).Port
+		conn.Close()
+		if first+size-1 > 65535 {
+			continue
+		}
+
+		var taken []net.PacketConn
+		for port := first; port < first+size; port++ {
+			conn, err := net.ListenPacket("udp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+			if err != nil {
+				break
+			}
+			taken = append(taken, conn)
+		}
+		for _, conn := range taken {
+			conn.Close()
+		}
+		if len(taken) == size {
+			return PortRange{First: first, Last: first + size - 1}
+		}
+	}
+	t.Fatalf("No %d free ports in a row", size)
+	return PortRange{}
+}
+
+func TestPortRangeSet(t *testing.T) {
+	for value, expected := range map[string]PortRange{
+		"50000-50100": {First: 50000, Last: 50100},
+		"6969":        {First: 6969, Last: 6969},
+	} {
+		var r PortRange
+		if err := r.Set(value); err != nil || r != expected {
+			t.Errorf("Expected %s to be %+v, got %+v (%v)", value, expected, r, err)
+		}
+	}
+
+	r := PortRange{First: 50000, Last: 50100}
+	if r.String() != "50000-50100" {
+		t.Errorf("Expected 50000-50100, got %s", r.String())
+	}
+
+	for _, value := range []string{"", "abc", "50100-50000", "0-10", "1-70000", "1-2-3"} {
+		var r PortRange
+		if err := r.Set(value); err == nil {
+			t.Errorf("Expected %q to be rejected, got %+v", value, r)
+		}
+	}
+}
+
+func TestPortAllocatorConcurrency(t *testing.T) {
+	const size = 4
+	r := freePorts(t, size)
+	var allocator portAllocator
+
+	var (
+		wg                  sync.WaitGroup
+		open, most, refused atomic.Int32
+	)
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				conn, err := allocator.listen("127.0.0.1", r)
+				if errors.Is(err, ErrNoPorts) {
+					refused.Add(1)
+					continue
+				}
+				if err != nil {
+					t.Errorf("Expected a port or ErrNoPorts, got %v", err)
+					return
+				}
+
+				if port := conn.LocalAddr().(*net.UDPAddr).Port; port < r.First || port > r.Last {
+					t.Errorf("Expected a port in %+v, got %d", r, port)
+				}
+				n := open.Add(1)
+				for m := most.Load(); n > m && !most.CompareAndSwap(m, n); m = most.Load() {
+				}
+				time.Sleep(time.Millisecond)
+				open.Add(-1)
+				conn.Close()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if most.Load() > size {
+		t.Errorf("Expected at most %d sockets at once, got %d", size, most.Load())
+	}
+	if refused.Load() == 0 {
+		t.Errorf("Expected some sessions to find every port taken")
+	}
+
+	// every port was released
+	var conns []net.PacketConn
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	for i := 0; i < size; i++ {
+		conn, err := allocator.listen("127.0.0.1", r)
+		if err != nil {
+			t.Fatalf("Expected port %d of %d to be free, got %v", i+1, size, err)
+		}
+		conns = append(conns, conn)
+	}
+	if _, err := allocator.listen("127.0.0.1", r); !errors.Is(err, ErrNoPorts) {
+		t.Errorf("Expected ErrNoPorts, got %v", err)
+	}
+}
+
+func TestPortRangeExhausted(t *testing.T) {
+	content := bytes.Repeat([]byte("r"), 2*packets.BlockSize+10)
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "fw.bin"), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	r := freePorts(t, 1)
+	s := &Server{Root: root, Timeout: conformanceTimeout, Retries: 3, PortRange: r}
+	go s.Serve(conn)
+	addr := conn.LocalAddr()
+
+	first := newPeer(t, addr)
+	first.request(rrq("fw.bin"))
+	first.expectData(1)
+	if port := first.tid.(*net.UDPAddr).Port; port != r.First {
+		t.Errorf("Expected the transfer on port %d, got %d", r.First, port)
+	}
+
+	// the only port is taken, the server itself answers
+	second := newPeer(t, addr)
+	second.request(rrq("fw.bin"))
+	second.tid = addr
+	second.expectError(packets.ErrUnknown)
+
+	// the port is released once the first transfer ends
+	first.send(nil, packets.Ack{BlockNumber: 1})
+	for block := uint16(2); ; block++ {
+		data := first.expectData(block)
+		first.send(nil, packets.Ack{BlockNumber: block})
+		if len(data) < packets.BlockSize {
+			break
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	second.request(rrq("fw.bin"))
+	if received := second.download(); !bytes.Equal(received, content) {
+		t.Errorf("Expected %d bytes, got %d", len(content), len(received))
+	}
+}
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"TFTP/packets"
+	"TFTP/transfer"
+	"errors"
+	"io"
+	"net/netip"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// defaultQuotaWindow is the window of ClientQuota when QuotaWindow is zero.
+const defaultQuotaWindow = 24 * time.Hour
+
+// freeSpaceInterval is how many bytes are received between two checks of the free space.
+const freeSpaceInterval = 1 << 20
+
+var (
+	errTooLarge      = &transfer.Error{Code: packets.ErrDiskFull, Message: "File too large"}
+	errQuotaExceeded = &transfer.Error{Code: packets.ErrDiskFull, Message: "Upload quota exceeded"}
+	errDiskFull      = &transfer.Error{Code: packets.ErrDiskFull, Message: "Disk full"}
+)
+
+// quotas counts the bytes uploaded by every client IP over a rolling window.
+type quotas struct {
+	mu      sync.Mutex
+	clients map[netip.Addr][]usage
+}
+
+// usage is the bytes uploaded from a time on, the uploads of a short interval share one.
+type usage struct {
+	since time.Time
+	bytes int64
+}
+
+// used returns the bytes uploaded by the client within window, the older uploads are forgotten.
+// The lock has to be held.
+func (q *quotas) used(client netip.Addr, window time.Duration, now time.Time) int64 {
+	usages := q.clients[client]
+	for len(usages) > 0 && now.Sub(usages[0].since) >= window {
+		usages = usages[1:]
+	}
+	if len(usages) == 0 {
+		delete(q.clients, client)
+		return 0
+	}
+	q.clients[client] = usages
+
+	var total int64
+	for _, u := range usages {
+		total += u.bytes
+	}
+	return total
+}
+
+// remaining returns how many bytes the client may still upload within window.
+func (q *quotas) remaining(client netip.Addr, quota int64, window time.Duration) int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return quota - q.used(client, window, time.Now())
+}
+
+// take counts n bytes uploaded by the client, unless they exceed its quota.
+func (q *quotas) take(client netip.Addr, n int64, quota int64, window time.Duration) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	if q.used(client, window, now)+n > quota {
+		return false
+	}
+
+	if q.clients == nil {
+		q.clients = make(map[netip.Addr][]usage)
+	}
+	usages := q.clients[client]
+	if last := len(usages) - 1; last >= 0 && now.Sub(usages[last].since) < window/100 {
+		usages[last].bytes += n
+	} else {
+		q.clients[client] = append(usages, usage{since: now, bytes: n})
+	}
+	return true
+}
+
+// refund forgets n bytes counted for the client, from the latest uploads on, e.g. when they were discarded.
+func (q *quotas) refund(client netip.Addr, n int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	usages := q.clients[client]
+	for i := len(usages) - 1; i >= 0 && n > 0; i-- {
+		k := min(n, usages[i].bytes)
+		usages[i].bytes -= k
+		n -= k
+	}
+}
+
+func (s *Server) quotaWindow() time.Duration {
+	if s.QuotaWindow == 0 {
+		return defaultQuotaWindow
+	}
+	return s.QuotaWindow
+}
+
+// checkUploadSize rejects an upload of size bytes, as announced with the tsize option, that does not fit
+// the limits of the server.
+func (s *Server) checkUploadSize(client netip.Addr, size int64, dir string) error {
+	if s.MaxUploadSize > 0 && size > s.MaxUploadSize {
+		return errTooLarge
+	}
+	if s.ClientQuota > 0 && size > s.quotas.remaining(client, s.ClientQuota, s.quotaWindow()) {
+		return errQuotaExceeded
+	}
+	if s.MinFreeSpace > 0 {
+		if free, ok := freeSpace(dir); ok && free-size < s.MinFreeSpace {
+			return errDiskFull
+		}
+	}
+	return nil
+}
+
+// limitWriter enforces the limits of the server on the data of an upload as it is received.
+type limitWriter struct {
+	w       io.Writer
+	s       *Server
+	client  netip.Addr
+	dir     string // directory of the upload, for the free space
+	written int64
+	checked int64 // bytes written when the free space was last checked
+	charged int64 // bytes counted in the quota of the client
+}
+
+func (l *limitWriter) Write(p []byte) (int, error) {
+	n := int64(len(p))
+	if l.s.MaxUploadSize > 0 && l.written+n > l.s.MaxUploadSize {
+		return 0, errTooLarge
+	}
+	if l.s.MinFreeSpace > 0 && (l.written == 0 || l.written-l.checked >= freeSpaceInterval) {
+		if free, ok := freeSpace(l.dir); ok && free-n < l.s.MinFreeSpace {
+			return 0, errDiskFull
+		}
+		l.checked = l.written
+	}
+	if l.s.ClientQuota > 0 {
+		if !l.s.quotas.take(l.client, n, l.s.ClientQuota, l.s.quotaWindow()) {
+			return 0, errQuotaExceeded
+		}
+		l.charged += n
+	}
+
+	written, err := l.w.Write(p)
+	l.written += int64(written)
+	if errors.Is(err, syscall.ENOSPC) {
+		return written, errDiskFull
+	}
+	return written, err
+}
+
+// refund gives the bytes charged to the quota of the client back, for an upload whose data is deleted.
+func (l *limitWriter) refund() {
+	if l.charged > 0 {
+		l.s.quotas.refund(l.client, l.charged)
+		l.charged = 0
+	}
+}
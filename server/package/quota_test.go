@@ -0,0 +1,138 @@
+package server
+
+import (
+	"TFTP/packets"
+	"bytes"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestQuotasRollingWindow(t *testing.T) {
+	var q quotas
+	client, other := netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.2")
+	const window = 100 * time.Millisecond
+
+	if !q.take(client, 60, 100, window) || !q.take(client, 40, 100, window) {
+		t.Fatalf("Expected the quota to allow 100 bytes")
+	}
+	if q.take(client, 1, 100, window) {
+		t.Errorf("Expected the quota to be exhausted")
+	}
+	if !q.take(other, 100, 100, window) {
+		t.Errorf("Expected every client to have its own quota")
+	}
+
+	time.Sleep(window)
+	if remaining := q.remaining(client, 100, window); remaining != 100 {
+		t.Errorf("Expected the uploads to be forgotten after the window, %d bytes remain", remaining)
+	}
+}
+
+// expectRemoved fails when the upload left a file behind.
+func expectRemoved(t *testing.T, root string, name string) {
+	t.Helper()
+	if _, err := os.Stat(filepath.Join(root, name)); err == nil {
+		t.Errorf("Expected %s to be removed", name)
+	}
+	if temp := tempFiles(t, filepath.Join(root, UploadDir)); len(temp) != 0 {
+		t.Errorf("Expected no temporary file, got %v", temp)
+	}
+}
+
+func TestUploadSizeFromTransferSize(t *testing.T) {
+	addr, root := configuredServer(t, &Server{MaxUploadSize: 1000})
+
+	p := newPeer(t, addr)
+	req := wrq("fw.bin")
+	req.Options = map[string]string{packets.OptTransferSize: "1001"}
+	p.request(req)
+	p.expectError(packets.ErrDiskFull)
+	expectRemoved(t, root, "received/fw.bin")
+}
+
+func TestUploadSizeWhileReceiving(t *testing.T) {
+	addr, root := configuredServer(t, &Server{MaxUploadSize: 600})
+
+	p := newPeer(t, addr)
+	p.request(wrq("fw.bin"))
+	p.expectAck(0)
+	p.send(nil, packets.Data{BlockNumber: 1, Payload: bytes.NewReader(make([]byte, packets.BlockSize))})
+	p.expectAck(1)
+	p.send(nil, packets.Data{BlockNumber: 2, Payload: bytes.NewReader(make([]byte, 100))})
+	p.expectError(packets.ErrDiskFull)
+
+	time.Sleep(conformanceTimeout / 10)
+	expectRemoved(t, root, "received/fw.bin")
+}
+
+func TestClientQuota(t *testing.T) {
+	addr, root := configuredServer(t, &Server{ClientQuota: 700})
+
+	p := newPeer(t, addr)
+	p.request(wrq("first.bin"))
+	p.expectAck(0)
+	p.upload(make([]byte, 600))
+
+	// the second upload exceeds what is left of the quota of the loopback
+	p = newPeer(t, addr)
+	p.request(wrq("second.bin"))
+	p.expectAck(0)
+	p.send(nil, packets.Data{BlockNumber: 1, Payload: bytes.NewReader(make([]byte, 200))})
+	p.expectError(packets.ErrDiskFull)
+
+	time.Sleep(conformanceTimeout / 10)
+	expectRemoved(t, root, "received/second.bin")
+	if _, err := os.Stat(filepath.Join(root, "received/first.bin")); err != nil {
+		t.Errorf("Expected the first upload to be kept, got %v", err)
+	}
+}
+
+func TestClientQuotaRefund(t *testing.T) {
+	s := &Server{ClientQuota: 1000}
+	addr, root := configuredServer(t, s)
+
+	// the client aborts the upload, its data is deleted and no longer counts
+	p := newPeer(t, addr)
+	p.request(wrq("first.bin"))
+	p.expectAck(0)
+	p.send(nil, packets.Data{BlockNumber: 1, Payload: bytes.NewReader(make([]byte, packets.BlockSize))})
+	p.expectAck(1)
+	p.send(nil, packets.Error{ErrCode: packets.ErrUnknown, Message: "Aborted"})
+
+	deadline := time.Now().Add(10 * conformanceTimeout)
+	for s.quotas.remaining(loopback, s.ClientQuota, s.quotaWindow()) != s.ClientQuota && time.Now().Before(deadline) {
+		time.Sleep(conformanceTimeout / 10)
+	}
+	if remaining := s.quotas.remaining(loopback, s.ClientQuota, s.quotaWindow()); remaining != s.ClientQuota {
+		t.Fatalf("Expected the aborted upload to be refunded, %d bytes remain", remaining)
+	}
+	expectRemoved(t, root, "received/first.bin")
+
+	p = newPeer(t, addr)
+	p.request(wrq("second.bin"))
+	p.expectAck(0)
+	p.upload(make([]byte, 900))
+	if _, err := os.Stat(filepath.Join(root, "received/second.bin")); err != nil {
+		t.Errorf("Expected the second upload to fit the quota, got %v", err)
+	}
+}
+
+func TestMinFreeSpace(t *testing.T) {
+	if _, ok := freeSpace(t.TempDir()); !ok {
+		t.Skip("The free space is unknown on this platform")
+	}
+	// more than any disk has
+	addr, root := configuredServer(t, &Server{MinFreeSpace: 1 << 62})
+
+	p := newPeer(t, addr)
+	p.request(wrq("fw.bin"))
+	p.expectAck(0)
+	p.send(nil, packets.Data{BlockNumber: 1, Payload: bytes.NewReader([]byte("firmware"))})
+	p.expectError(packets.ErrDiskFull)
+
+	time.Sleep(conformanceTimeout / 10)
+	expectRemoved(t, root, "received/fw.bin")
+}
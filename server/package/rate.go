@@ -0,0 +1,97 @@
+package server
+
+import (
+	"TFTP/throttle"
+	"TFTP/transfer"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// NetworkRate is the bandwidth in bytes per second that the transfers of the clients of a network share.
+type NetworkRate struct {
+	Network netip.Prefix
+	Rate    throttle.Rate
+}
+
+// NetworkRates are the bandwidths of networks, the first network that contains a client applies to it.
+// It implements flag.Value, every value adds a network written as "network=rate", e.g. "10.1.0.0/16=10m".
+type NetworkRates []NetworkRate
+
+func (n *NetworkRates) String() string {
+	if n == nil {
+		return ""
+	}
+	rates := make([]string, len(*n))
+	for i, rate := range *n {
+		rates[i] = rate.Network.String() + "=" + rate.Rate.String()
+	}
+	return strings.Join(rates, ",")
+}
+
+func (n *NetworkRates) Set(value string) error {
+	network, rate, ok := strings.Cut(value, "=")
+	if !ok {
+		return fmt.Errorf("Invalid network rate %q, expected network=rate", value)
+	}
+
+	var parsed NetworkRate
+	var err error
+	parsed.Network, err = netip.ParsePrefix(network)
+	if err != nil {
+		return fmt.Errorf("Invalid network in %q", value)
+	}
+	parsed.Rate, err = throttle.ParseRate(rate)
+	if err != nil {
+		return err
+	}
+
+	*n = append(*n, parsed)
+	return nil
+}
+
+// bandwidth holds the buckets of the bandwidth limits shared by the transfers.
+type bandwidth struct {
+	global   *throttle.Bucket
+	networks []*throttle.Bucket // one for every entry of NetworkRates
+}
+
+// initBandwidth creates the buckets of the limits, once before the first transfer.
+func (s *Server) initBandwidth() {
+	if s.RateLimit > 0 {
+		s.bandwidth.global = throttle.NewBucket(int64(s.RateLimit), 0)
+	}
+	s.bandwidth.networks = make([]*throttle.Bucket, len(s.NetworkRates))
+	for i, rate := range s.NetworkRates {
+		if rate.Rate > 0 {
+			s.bandwidth.networks[i] = throttle.NewBucket(int64(rate.Rate), 0)
+		}
+	}
+}
+
+// limiter returns the bandwidth limits of a new transfer with client, nil when there are none.
+func (s *Server) limiter(client net.Addr) transfer.Limiter {
+	var limiter throttle.Limiter
+	if s.bandwidth.global != nil {
+		limiter = append(limiter, s.bandwidth.global)
+	}
+	if s.SessionRateLimit > 0 {
+		limiter = append(limiter, throttle.NewBucket(int64(s.SessionRateLimit), 0))
+	}
+	if addr, ok := clientIP(client); ok {
+		for i, rate := range s.NetworkRates {
+			if rate.Network.Contains(addr) {
+				if s.bandwidth.networks[i] != nil {
+					limiter = append(limiter, s.bandwidth.networks[i])
+				}
+				break
+			}
+		}
+	}
+
+	if len(limiter) == 0 {
+		return nil
+	}
+	return limiter
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"TFTP/packets"
+	"TFTP/throttle"
+	"bytes"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNetworkRatesSet(t *testing.T) {
+	var rates NetworkRates
+	for _, value := range []string{"10.1.0.0/16=10m", "192.168.0.0/24=500k"} {
+		if err := rates.Set(value); err != nil {
+			t.Fatalf("Error setting %s: %v", value, err)
+		}
+	}
+	if rates.String() != "10.1.0.0/16=10485760,192.168.0.0/24=512000" {
+		t.Errorf("Unexpected rates %s", rates.String())
+	}
+
+	for _, value := range []string{"10.1.0.0/16", "10.1.0.0=1m", "10.1.0.0/16=fast"} {
+		if err := rates.Set(value); err == nil {
+			t.Errorf("Expected %q to be rejected", value)
+		}
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	s := Server{SessionRateLimit: 1000, NetworkRates: NetworkRates{
+		{Network: netip.MustParsePrefix("10.1.0.0/16"), Rate: 5000},
+	}}
+	s.initBandwidth()
+
+	if limiter := s.limiter(clientAddr("10.1.2.3")).(throttle.Limiter); len(limiter) != 2 || limiter[1] != s.bandwidth.networks[0] {
+		t.Errorf("Expected a session and a network bucket, got %v", limiter)
+	}
+	if limiter := s.limiter(clientAddr("10.2.0.1")).(throttle.Limiter); len(limiter) != 1 {
+		t.Errorf("Expected a session bucket, got %v", limiter)
+	}
+	if limiter := (&Server{}).limiter(clientAddr("10.2.0.1")); limiter != nil {
+		t.Errorf("Expected no limit, got %v", limiter)
+	}
+}
+
+func TestSessionRateLimit(t *testing.T) {
+	content := bytes.Repeat([]byte("r"), 16*packets.BlockSize)
+	addr, root := configuredServer(t, &Server{SessionRateLimit: 32 * (4 + packets.BlockSize)})
+	if err := os.WriteFile(filepath.Join(root, "fw.bin"), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// 17 packets at 32 packets per second, a tenth of a second of them is the burst
+	start := time.Now()
+	p := newPeer(t, addr)
+	p.request(rrq("fw.bin"))
+	if received := p.download(); !bytes.Equal(received, content) {
+		t.Errorf("Expected %d bytes, got %d", len(content), len(received))
+	}
+	if elapsed := time.Since(start); elapsed < 350*time.Millisecond {
+		t.Errorf("Expected the transfer to take about half a second, took %v", elapsed)
+	}
+}
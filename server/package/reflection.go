@@ -0,0 +1,59 @@
+package server
+
+import (
+	"TFTP/packets"
+	"net"
+	"time"
+)
+
+const (
+	// defaultUnverifiedBytes is UnverifiedBytes when it is zero, a DATA packet of the default block size.
+	defaultUnverifiedBytes = 4 + packets.BlockSize
+
+	// defaultReplyRate is ReplyRate when it is zero.
+	defaultReplyRate = 5
+)
+
+func (s *Server) unverifiedBytes() int {
+	if !s.AntiReflection {
+		return 0
+	}
+	if s.UnverifiedBytes == 0 {
+		return defaultUnverifiedBytes
+	}
+	return s.UnverifiedBytes
+}
+
+// mayReply tells whether the server may answer a datagram of the client read by Serve, in
+// AntiReflection mode a client gets at most ReplyRate answers per second. The address of the datagram
+// may be spoofed, the answers would flood the victim behind it, so going over the rate is reported.
+func (s *Server) mayReply(client net.Addr) bool {
+	if !s.AntiReflection {
+		return true
+	}
+	addr, ok := clientIP(client)
+	if !ok || s.whitelisted(addr) {
+		return true
+	}
+	perSecond := s.ReplyRate
+	if perSecond == 0 {
+		perSecond = defaultReplyRate
+	}
+
+	b := &s.bans
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.sweep(now, s.banWindow())
+
+	rate := rateOf(&b.replies, addr, perSecond, now)
+	if rate.bucket.Allow(1) {
+		rate.logged = false
+		return true
+	}
+	if !rate.logged {
+		rate.logged = true
+		s.logger().Warn("suspected reflection: not answering the client over its reply rate", "client", addr.String(), "rate", perSecond)
+	}
+	return false
+}
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAntiReflectionUnverified(t *testing.T) {
+	addr, root := configuredServer(t, &Server{AntiReflection: true})
+	content := bytes.Repeat([]byte("firmware"), 1000)
+	if err := os.WriteFile(filepath.Join(root, "fw.bin"), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// a spoofed request is never acknowledged, only the first block is sent, once per attempt
+	p := newPeer(t, addr)
+	p.request(rrq("fw.bin"))
+	for i := 0; i < 3; i++ {
+		p.expectData(1)
+	}
+	p.expectNothing(3 * conformanceTimeout)
+
+	// the ACK proves the address, the rest is sent
+	p = newPeer(t, addr)
+	p.request(rrq("fw.bin"))
+	if received := p.download(); !bytes.Equal(received, content) {
+		t.Errorf("Expected %d bytes, got %d", len(content), len(received))
+	}
+}
+
+func TestAntiReflectionReplyRate(t *testing.T) {
+	addr, _ := configuredServer(t, &Server{AntiReflection: true, ReplyRate: 2})
+
+	p := newPeer(t, addr)
+	expectNotFound(p)
+	expectNotFound(p)
+	p.request(rrq("missing.bin"))
+	p.expectNothing(conformanceTimeout)
+
+	time.Sleep(time.Second / 2)
+	expectNotFound(p)
+}
@@ -2,12 +2,20 @@ package server
 
 import (
 	"TFTP/packets"
-	"bytes"
+	"TFTP/resume"
+	"TFTP/throttle"
+	"TFTP/transfer"
 	"errors"
-	"fmt"
-	"log"
+	"io"
+	"io/fs"
+	"log/slog"
 	"net"
+	"net/netip"
 	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -19,8 +27,95 @@ const (
 )
 
 type Server struct {
-	Timeout time.Duration
-	Retries int
+	Timeout    time.Duration
+	Retries    int
+	Root       string // directory files are served from and uploaded to (under UploadDir), the working directory when empty
+	CreateDirs bool   // create the missing directories of uploaded files under the root
+	IndexName  string // name of the generated directory index, packets.IndexFileName when empty
+	ListName   string // name of the generated directory listing, packets.ListFileName when empty
+
+	// Listen opens the socket of a transfer, a UDP socket on a new port of the served address when nil.
+	// It lets transfers run over another transport, e.g. the simulated network of the netsim package.
+	Listen func() (net.PacketConn, error)
+
+	// ACL decides which clients may read and write which files, everything is allowed when it is empty.
+	// Its patterns match the cleaned names of the requests: downloads under the root, uploads under UploadDir.
+	// See LoadConfig to load it from the config file.
+	ACL ACL
+
+	// WritePolicy is what is done with uploads, WriteRules override it for some paths.
+	WritePolicy WritePolicy
+	WriteRules  WriteRules
+
+	// Limits of the uploads, a violation aborts the upload with ErrDiskFull and its file is removed.
+	// The size announced with the tsize option is checked before the upload starts, the data of a failed
+	// upload no longer counts in the ClientQuota once it is removed.
+	MaxUploadSize int64         // largest file in bytes, no limit when zero
+	ClientQuota   int64         // bytes a client IP may upload within QuotaWindow, no limit when zero
+	QuotaWindow   time.Duration // rolling window of ClientQuota, 24 hours when zero
+	MinFreeSpace  int64         // bytes that have to stay free on the disk of the root, no limit when zero
+
+	// Bandwidth limits in bytes per second, no limit when zero. RateLimit is shared by all the transfers,
+	// SessionRateLimit applies to every transfer on its own, and the transfers of the clients of a network
+	// of NetworkRates share its rate.
+	RateLimit        throttle.Rate
+	SessionRateLimit throttle.Rate
+	NetworkRates     NetworkRates
+
+	// RequestRate is how many datagrams per second a client IP may send to the port of the server,
+	// no limit when zero. The datagrams over it are dropped.
+	RequestRate int
+
+	// BanThreshold is how many offences (invalid packets, requests of missing files, access violations)
+	// a client IP may make within BanWindow before its datagrams are dropped for BanDuration, no ban when
+	// zero. See Bans and Unban.
+	BanThreshold int
+	BanWindow    time.Duration // one minute when zero
+	BanDuration  time.Duration // ten minutes when zero
+
+	// Whitelist are the networks never limited by RequestRate nor banned.
+	Whitelist []netip.Prefix
+
+	// AntiReflection keeps the server from being abused as a reflector by requests with the spoofed
+	// address of a victim: until a client acknowledges a packet, which proves the address is its own, a
+	// transfer sends it at most UnverifiedBytes of new packets, which are retransmitted as usual when they
+	// are lost, and a client gets at most ReplyRate answers per second
+	// to what it sends to the port of the server. Suspected reflection attempts are logged.
+	AntiReflection  bool
+	UnverifiedBytes int // a DATA packet of the default block size (516 bytes) when zero
+	ReplyRate       int // 5 when zero
+
+	// PortRange is where the sockets of the transfers are opened, any free port when zero. A request that
+	// comes while every port of the range is taken is answered with an ERROR.
+	PortRange PortRange
+
+	// SinglePort makes every transfer use the socket of the server instead of a new port, for firewalls and
+	// NATs that only let the port of the server through. The datagrams are passed to the transfers by the
+	// address of the client. This deviates from RFC 1350, where the port of the server is the ID of a transfer:
+	// a client can only run one transfer at a time from a given port, and repeated requests are dropped
+	// while their transfer runs. Listen is not used.
+	SinglePort bool
+
+	// MetricsListen is the TCP address of an HTTP listener serving MetricsHandler, e.g. "127.0.0.1:9169",
+	// none when empty. It is opened by Serve and closed when Serve returns.
+	MetricsListen string
+
+	// Logger logs what the server does, slog.Default() when nil. Every transfer logs with the attributes of
+	// its session: an ID, the address of the client, the operation, the file name and the mode.
+	Logger *slog.Logger
+
+	conn   net.PacketConn // socket the requests are read from
+	addr   net.Addr       // address the requests are read from
+	demux  *demux         // passes the datagrams to the transfers in single port mode
+	ports  portAllocator  // opens the sockets of the transfers in the PortRange
+	quotas quotas         // bytes uploaded by every client IP
+
+	bandwidth bandwidth     // buckets of the bandwidth limits shared by the transfers
+	checksums checksums     // SHA-256 of the listed files
+	bans      banList       // request rates, offences and bans of the clients
+	metrics   metrics       // counters of MetricsHandler
+	sessions  atomic.Uint64 // ID of the last session
+	partials  sync.Map      // destinations of the resumable uploads running, their partial file is shared
 }
 
 func (s *Server) ListenAndServe(addr string) error {
@@ -29,7 +124,7 @@ func (s *Server) ListenAndServe(addr string) error {
 		return errors.New("Error listening on address")
 	}
 	defer func() { _ = conn.Close() }()
-	log.Printf("Listening on %s ...\n", conn.LocalAddr())
+	s.logger().Info("listening", "addr", conn.LocalAddr().String())
 
 	return s.Serve(conn)
 }
@@ -46,262 +141,487 @@ func (s *Server) Serve(conn net.PacketConn) error {
 	if s.Timeout == 0 {
 		s.Timeout = time.Second * 10
 	}
+
+	if s.IndexName == "" {
+		s.IndexName = packets.IndexFileName
+	}
+
+	if s.ListName == "" {
+		s.ListName = packets.ListFileName
+	}
+
+	if !s.PortRange.empty() {
+		if err := s.PortRange.validate(); err != nil {
+			return err
+		}
+	}
+	if err := s.ACL.validate(); err != nil {
+		return err
+	}
+	s.initBandwidth()
+
+	if s.MetricsListen != "" {
+		stop, err := s.serveMetrics()
+		if err != nil {
+			return err
+		}
+		defer stop()
+	}
+
+	conn = s.metrics.wrap(conn)
+	s.conn, s.addr = conn, conn.LocalAddr()
+	if s.SinglePort {
+		s.demux = newDemux(conn)
+		defer s.demux.closeAll()
+	}
+
 	var readReq packets.ReadRequest
 	var writeReq packets.WriteRequest
+	// large enough for DATA packets of any block size in single port mode
+	buf := make([]byte, 4+transfer.MaxBlockSize+1)
 
 	for {
-		buf := make([]byte, 1024)
-		_, client_addr, err := conn.ReadFrom(buf)
+		n, client_addr, err := conn.ReadFrom(buf)
 		if err != nil {
 			return errors.New("Error reading from connection")
 		}
-		fmt.Printf("Received request from: %v", string(buf))
+		data := buf[:n]
+
+		// in single port mode the datagrams of a running transfer are passed to it,
+		// a request sent again while its transfer runs is dropped
+		if s.demux != nil && s.demux.active(client_addr) {
+			if isRequest(data) {
+				s.metrics.request(opcodeName(data), OutcomeDropped)
+			} else {
+				s.demux.deliver(client_addr, data)
+			}
+			continue
+		}
+		if !s.admit(client_addr) || !s.mayReply(client_addr) {
+			s.metrics.request(opcodeName(data), OutcomeDropped)
+			continue
+		}
+		s.logger().Debug("datagram received", "client", client_addr.String(), "opcode", opcodeName(data), "bytes", n)
 
-		err = readReq.UnmarshalBinary(buf)
+		err = readReq.UnmarshalBinary(data)
 		if err == nil {
-			go s.handle(readReq, client_addr)
+			s.start(readReq, client_addr)
 			continue
 		}
-		err = readReq.UnmarshalNetascii(buf)
+		err = readReq.UnmarshalNetascii(data)
 		if err == nil {
-			go s.handle(readReq, client_addr)
+			s.start(readReq, client_addr)
 			continue
 		}
 
-		err = writeReq.UnmarshalBinary(buf)
+		err = writeReq.UnmarshalBinary(data)
 		if err == nil {
-			go s.handle(writeReq, client_addr)
+			s.start(writeReq, client_addr)
 			continue
 		}
 
-		err = writeReq.UnmarshalNetascii(buf)
+		err = writeReq.UnmarshalNetascii(data)
 		if err == nil {
-			go s.handle(writeReq, client_addr)
+			s.start(writeReq, client_addr)
 			continue
 		}
 
-		// log.Printf("Invalid request: %v, buffer: %s", err, buf)
-		// return err //returning error beacuse we do not want to continue the server if we have an invalid request
+		//only requests start a transfer, anything else sent to this port is illegal (RFC 1350)
+		//in single port mode it most likely belongs to a transfer that ended
+		s.metrics.request(opcodeName(data), OutcomeInvalid)
+		switch {
+		case isRequest(data):
+			s.offence(client_addr, OffenceInvalidPacket)
+		case s.demux != nil && n >= 2 && data[0] == 0 && packets.OpCode(data[1]) <= packets.OACK:
+			s.sendError(s.logger(), conn, client_addr, packets.ErrUnknownID, "Unknown transfer ID")
+		default:
+			s.offence(client_addr, OffenceInvalidPacket)
+			s.sendError(s.logger(), conn, client_addr, packets.ErrIllegalOp, "Illegal TFTP operation")
+		}
 	}
 }
 
-func (s *Server) handle(rrq packets.Request, client_addr net.Addr) {
-	switch rrq.(type) {
+// isRequest tells whether a datagram has the opcode of a RRQ or a WRQ.
+func isRequest(data []byte) bool {
+	return len(data) >= 2 && data[0] == 0 && (packets.OpCode(data[1]) == packets.PRQ || packets.OpCode(data[1]) == packets.WRQ)
+}
+
+// start starts the transfer of a request. In single port mode its socket is opened right away,
+// so that the next datagrams of the client are passed to the transfer.
+// A request the ACL denies is answered from the port of the server, no transfer starts.
+func (s *Server) start(req packets.Request, client_addr net.Addr) {
+	var (
+		name, mode string
+		op         Operation
+	)
+	switch req := req.(type) {
 	case packets.ReadRequest:
-		s.handleReadRequest(rrq.(packets.ReadRequest), client_addr)
+		name, mode, op = req.FileName, req.Mode, OpRead
 	case packets.WriteRequest:
-		s.handleWriteRequest(rrq.(packets.WriteRequest), client_addr)
+		name, mode, op = req.FileName, req.Mode, OpWrite
 	}
+	// the ACL matches the name that is actually read or written, e.g. a/../b as b, invalid names are
+	// rejected by the transfer
+	if local, err := localName(name); err == nil {
+		name = local
+	}
+	// the logger of the session goes with the request, so a transfer can be followed from start to end
+	logger := s.logger().With("session", s.sessions.Add(1), "client", client_addr.String(), "op", op.String(), "file", name, "mode", mode)
+
+	if !s.ACL.Allows(client_addr, op, name) {
+		logger.Warn("denied by the ACL")
+		s.offence(client_addr, OffenceAccessViolation)
+		s.metrics.request(requestOpcode(op), OutcomeDenied)
+		s.sendError(logger, s.conn, client_addr, packets.ErrAccessViolation, "Access violation")
+		return
+	}
+
+	var session net.PacketConn
+	if s.demux != nil {
+		session = s.demux.open(client_addr)
+	}
+	go s.handle(req, client_addr, session, logger)
 }
 
-func (s *Server) handleReadRequest(rrq packets.ReadRequest, client_addr net.Addr) {
-	log.Printf("[%s] requested file: %s", client_addr, rrq.FileName)
+func (s *Server) handle(rrq packets.Request, client_addr net.Addr, conn net.PacketConn, logger *slog.Logger) {
+	var (
+		start     = time.Now()
+		op        = OpRead
+		completed bool
+	)
+	if _, ok := rrq.(packets.WriteRequest); ok {
+		op = OpWrite
+	}
+	s.metrics.started()
+	defer func() { s.metrics.finished(op, completed, time.Since(start)) }()
+
 	//we create a new connection to the client, beacuse by creating a new connection we can send a file to the correct client
 	//and we do not need to worry about synchronization issues with the "connection" from net.ListenPacket in the Serve method
-	conn, err := net.Dial("udp", client_addr.String())
-	if err != nil {
-		log.Printf("Error connecting to client: %v", err)
-		return
+	//the new port is the transfer ID of the server (RFC 1350)
+	if conn == nil {
+		var err error
+		conn, err = s.listen()
+		if err != nil {
+			logger.Error("opening the socket of the transfer failed", "error", err)
+			// there is no socket for the transfer, the error comes from the port of the server
+			s.sendError(logger, s.conn, client_addr, packets.ErrUnknown, err.Error())
+			return
+		}
+		conn = s.metrics.wrap(conn)
 	}
-
 	defer func() { _ = conn.Close() }()
 
+	switch rrq.(type) {
+	case packets.ReadRequest:
+		completed = s.handleReadRequest(conn, rrq.(packets.ReadRequest), client_addr, logger)
+	case packets.WriteRequest:
+		completed = s.handleWriteRequest(conn, rrq.(packets.WriteRequest), client_addr, logger)
+	}
+}
+
+// handleReadRequest sends the file of a RRQ, it returns whether the transfer completed.
+func (s *Server) handleReadRequest(conn net.PacketConn, rrq packets.ReadRequest, client_addr net.Addr, logger *slog.Logger) (completed bool) {
+	logger.Info("file requested")
+
 	if rrq.Compress {
 		//TODO: implement file compression
 	}
 
-	payload, err := os.ReadFile(rrq.FileName)
+	path, err := s.resolve(rrq.FileName)
 	if err != nil {
-		fmt.Println("Error reading payload file")
+		logger.Warn("invalid file name", "error", err)
+		s.offence(client_addr, OffenceAccessViolation)
+		s.sendError(logger, conn, client_addr, packets.ErrAccessViolation, err.Error())
 		return
 	}
 
-	var (
-		ackPacket   packets.Ack
-		errorPacket packets.Error
-		dataPacket  = packets.Data{Payload: bytes.NewReader(payload)}
-		buf         = make([]byte, packets.DatagramSize)
-	)
-
-NEXT:
-	//keep sending data packets until we reach the end of the file
-	//so until n == DatagramSize beacuse when n gets smaller that means we reached the end of the file
-	for n := packets.DatagramSize; n == packets.DatagramSize; {
-		data, err := dataPacket.MarshalBinary()
-		if err != nil {
-			log.Printf("Error marshaling data packet: %v", err)
-			return
+	content, closeFile, err := s.openFile(path, s.readable(client_addr))
+	if err != nil {
+		logger.Warn("opening the file failed", "error", err)
+		if errors.Is(err, fs.ErrNotExist) {
+			s.offence(client_addr, OffenceNotFound)
+			s.sendError(logger, conn, client_addr, packets.ErrNotFound, "File not found")
+		} else {
+			s.sendError(logger, conn, client_addr, packets.ErrAccessViolation, "Cannot read file")
 		}
+		return
+	}
+	defer closeFile()
 
-	RETRY:
-		for i := 0; i < s.Retries; i++ {
-			n, err = conn.Write(data)
-			if err != nil {
-				log.Printf("Error sending data packet: %v", err)
-				return
-			}
-
-			_ = conn.SetReadDeadline(time.Now().Add(s.Timeout))
+	offset, resuming, err := resume.ParseOffset(rrq.Options)
+	if err == nil && offset > content.Size() {
+		err = errors.New("Offset beyond the end of the file")
+	}
+	if err != nil {
+		logger.Warn("cannot resume", "error", err)
+		s.sendError(logger, conn, client_addr, packets.ErrUnknown, err.Error())
+		return
+	}
 
-			//we read the ACK packet from the client
-			_, err = conn.Read(buf)
-			if err != nil {
-				if nErr, ok := err.(net.Error); ok && nErr.Timeout() {
-					log.Printf("Timeout reading ack packet: %v", err)
-					continue RETRY
-				}
-				log.Printf("Error unmarshaling ack packet: %v", err)
-				return
-			}
+	accepted := make(map[string]string)
+	if _, ok := rrq.Options[packets.OptTransferSize]; ok {
+		accepted[packets.OptTransferSize] = strconv.FormatInt(content.Size(), 10)
+	}
 
-			ackErr := ackPacket.UnmarshalBinary(buf)
-			errorErr := errorPacket.UnmarshalBinary(buf)
-
-			switch {
-			case ackErr == nil:
-				if uint16(ackPacket.BlockNumber) == dataPacket.BlockNumber {
-					continue NEXT
-				} else {
-					log.Printf("Unexpected ACK block number: got %d, expected %d", ackPacket.BlockNumber, dataPacket.BlockNumber)
-					break
-				}
-			case errorErr == nil:
-				log.Printf("Error packet received: %v", errorPacket)
-				return
-			default:
-				log.Printf("Invalid packet received: %v", buf)
-			}
+	if resuming {
+		//the client already has everything before the offset, so block 1 starts there
+		content = io.NewSectionReader(content, offset, content.Size()-offset)
+		accepted[packets.OptOffset] = strconv.FormatInt(offset, 10)
+		logger.Info("resuming", "offset", offset)
+	}
 
-			log.Printf("Max retries reached for: %s", client_addr)
-			return
+	sender := transfer.Sender{Conn: conn, Peer: client_addr, Timeout: s.Timeout, Retries: s.Retries, Limit: s.limiter(client_addr), Logger: logger}
+	sender.Options = transfer.Negotiate(rrq.Options, accepted)
+	sender.Unverified = s.unverifiedBytes()
+	sender.Progress = func(delta transfer.Stats) { s.metrics.progress(OpRead, delta) }
+	if len(accepted) > 0 {
+		err = sender.SendOptionAck(accepted)
+		if errors.Is(err, transfer.ErrUnverified) {
+			logger.Warn("suspected reflection: the OACK was never acknowledged")
+			return false
+		}
+		if err != nil {
+			logger.Warn("option negotiation failed", "error", err, "stats", sender.Stats)
+			return false
 		}
-
 	}
-	log.Printf("[%s] file sent", client_addr)
 
+	err = sender.Send(content)
+	if errors.Is(err, transfer.ErrUnverified) {
+		logger.Warn("suspected reflection: the first block was never acknowledged")
+		return false
+	}
+	if err != nil {
+		logger.Warn("sending the file failed", "error", err, "stats", sender.Stats)
+		return false
+	}
+	logger.Info("file sent", "stats", sender.Stats)
+	return true
 }
 
-func (s *Server) handleWriteRequest(wrq packets.WriteRequest, client_addr net.Addr) {
+// handleWriteRequest receives the file of a WRQ, it returns whether the transfer completed.
+func (s *Server) handleWriteRequest(conn net.PacketConn, wrq packets.WriteRequest, client_addr net.Addr, logger *slog.Logger) (completed bool) {
+	logger.Info("upload requested")
+	logger.Debug("transfer socket opened", "addr", conn.LocalAddr().String())
 
-	log.Printf("[%s] adding file: %s", client_addr, wrq.FileName)
-	// we create a new connection to the client, beacuse by creating a new connection we can send a file to the correct client
-	// and we do not need to worry about synchronization issues with the "connection" from net.ListenPacket in the Serve method
-	// Bind to a local ephemeral port
-	conn, err := net.Dial("udp", client_addr.String())
-	if err != nil {
-		log.Printf("Error connecting to client: %v", err)
-		return
+	if wrq.Compress {
+		// TODO: implement file compression
 	}
 
-	defer func() { _ = conn.Close() }()
+	var (
+		output  io.Writer
+		resumed *resume.Writer
+	)
 
-	// Send initial packet to client
-	// This is to let the client know the new port to connect to
-	_, err = conn.Write([]byte{0})
+	name, err := localName(wrq.FileName)
 	if err != nil {
-		log.Printf("Error sending initial packet: %v", err)
+		logger.Warn("invalid file name", "error", err)
+		s.offence(client_addr, OffenceAccessViolation)
+		s.sendError(logger, conn, client_addr, packets.ErrAccessViolation, err.Error())
 		return
 	}
+	fileName := filepath.Join(s.Root, UploadDir, filepath.FromSlash(name))
 
-	log.Printf("Local connection created on %s", conn.LocalAddr())
+	_, resuming, err := resume.ParseOffset(wrq.Options)
+	if err != nil {
+		logger.Warn("cannot resume", "error", err)
+		s.sendError(logger, conn, client_addr, packets.ErrUnknown, err.Error())
+		return
+	}
 
-	defer func() { _ = conn.Close() }()
+	//the policy is enforced before anything is written, a refused upload leaves no trace on the disk
+	policy := s.writePolicy(name)
+	if policy == WriteDisabled {
+		logger.Warn("uploads are disabled")
+		s.offence(client_addr, OffenceAccessViolation)
+		s.sendError(logger, conn, client_addr, packets.ErrAccessViolation, "Uploads are disabled")
+		return
+	}
+	if policy == WriteCreate {
+		//a resumed upload continues a file, which a create only path may not have
+		if resuming {
+			logger.Warn("cannot resume a create only upload")
+			s.sendError(logger, conn, client_addr, packets.ErrFileExists, "Cannot resume a create only upload")
+			return
+		}
+		if _, err = os.Lstat(fileName); err == nil {
+			logger.Warn("file already exists")
+			s.sendError(logger, conn, client_addr, packets.ErrFileExists, "File already exists")
+			return
+		}
+	}
 
-	if wrq.Compress {
-		// TODO: implement file compression
+	accepted := make(map[string]string)
+	if size, ok := wrq.Options[packets.OptTransferSize]; ok {
+		accepted[packets.OptTransferSize] = size
 	}
 
-	var (
-		ackPacket   packets.Ack
-		errorPacket packets.Error
-		dataPacket  packets.Data
-		buf         = make([]byte, packets.DatagramSize)
-	)
+	//the size the client announced has to fit in the limits, the data is checked again as it is received.
+	//The directories of the upload may not exist yet, the free space is the one of the root
+	client, _ := clientIP(client_addr)
+	if size, err := strconv.ParseInt(accepted[packets.OptTransferSize], 10, 64); err == nil {
+		err = s.checkUploadSize(client, size, filepath.Join(s.Root, "."))
+		if err != nil {
+			logger.Warn("upload refused", "bytes", size, "error", err)
+			s.sendError(logger, conn, client_addr, packets.ErrDiskFull, err.Error())
+			return
+		}
+	}
 
-	//create a file to write to
-	//in case of error we close and destroy the file
-	file, err := os.Create("received" + wrq.FileName)
+	//the upload directory is created by the first upload, the directories under it only with CreateDirs
+	dir := filepath.Join(s.Root, UploadDir)
+	if s.CreateDirs {
+		dir = filepath.Dir(fileName)
+	}
+	err = os.MkdirAll(dir, 0755)
 	if err != nil {
-		log.Printf("Error creating file: %v", err)
+		logger.Error("creating the directory failed", "error", err)
+		s.sendError(logger, conn, client_addr, packets.ErrAccessViolation, "Cannot create directory")
 		return
 	}
 
-	//Ensure file is closed and deleted on failure
-	defer func() {
-		if file != nil {
-			file.Close()
-			if err != nil {
-				if removeErr := os.Remove(wrq.FileName); removeErr != nil {
-					log.Printf("Failed to delete incomplete file '%s': %v", wrq.FileName, removeErr)
-				} else {
-					log.Printf("Incomplete file '%s' deleted due to errors.", wrq.FileName)
-				}
-			}
+	//the upload is written to a hidden temporary file next to the destination, which is renamed once the
+	//whole file is received, so readers never see a partial file. A failed upload leaves nothing behind,
+	//unless the client asked for an offset: the data received is kept to be resumed by the next request
+	var upload *upload
+	if resuming {
+		if _, running := s.partials.LoadOrStore(fileName, nil); running {
+			logger.Warn("the upload is already running")
+			s.sendError(logger, conn, client_addr, packets.ErrUnknown, "Upload already in progress")
+			return
 		}
-	}()
-
-GET_NEXT:
-	for {
-		err = conn.SetReadDeadline(time.Now().Add(s.Timeout))
+		defer s.partials.Delete(fileName)
+		upload, err = resumeUpload(fileName)
+	} else {
+		upload, err = newUpload(fileName)
+	}
+	if err != nil {
+		logger.Error("creating the file failed", "error", err)
+		s.sendError(logger, conn, client_addr, packets.ErrAccessViolation, "Cannot create file")
+		return
+	}
+	defer upload.discard(logger)
+	output = upload.file
+
+	var offset, stored int64
+	if resuming {
+		//the upload continues the partial file, or else the file at the destination, we report how much
+		//of it we already have, minus the overlap we want to verify
+		stored, err = upload.copyExisting()
 		if err != nil {
-			log.Printf("Error setting read deadline: %v", err)
+			logger.Error("reading the partial file failed", "error", err)
+			s.sendError(logger, conn, client_addr, packets.ErrAccessViolation, "Cannot read partial file")
 			return
 		}
 
-		n, err := conn.Read(buf)
+		offset = resume.Offset(stored)
+		resumed, err = resume.NewWriter(upload.file, offset)
 		if err != nil {
-			if nErr, ok := err.(net.Error); ok && nErr.Timeout() {
-				log.Printf("Timeout reading data packet: %v", err)
-				//might need to break out after a certain number of retries
-				continue GET_NEXT
-			}
-			log.Printf("Error reading data packet: %v", err)
+			logger.Error("preparing the partial file failed", "error", err)
+			s.sendError(logger, conn, client_addr, packets.ErrUnknown, err.Error())
 			return
 		}
+		output = resumed
+		accepted[packets.OptOffset] = strconv.FormatInt(offset, 10)
+		logger.Info("resuming", "offset", offset)
+	}
+	limit := &limitWriter{w: output, s: s, client: client, dir: filepath.Dir(fileName), written: offset}
+	output = limit
+	//the data of a failed upload no longer counts in the quota once it is deleted, a partial file kept
+	//to be resumed still does
+	defer func() {
+		if !upload.committed && !upload.keep {
+			limit.refund()
+		}
+	}()
 
-		dataErr := dataPacket.UnmarshalBinary(buf)
-		errorErr := errorPacket.UnmarshalBinary(buf)
-		switch {
-		case dataErr == nil:
-			{
-				fmt.Printf("Data packet received: %v\n", dataPacket)
-
-				dataSize := n - 4
-
-				_, err = file.Write(buf[4 : 4+dataSize])
-				if err != nil {
-					log.Printf("Error writing to file: %v", err)
-					return
-				}
-
-				ackPacket.BlockNumber = dataPacket.BlockNumber
+	receiver := transfer.Receiver{Conn: conn, Peer: client_addr, Timeout: s.Timeout, Retries: s.Retries, Limit: s.limiter(client_addr), Logger: logger}
+	receiver.Options = transfer.Negotiate(wrq.Options, accepted)
+	receiver.Progress = func(delta transfer.Stats) { s.metrics.progress(OpWrite, delta) }
 
-			}
+	// the OACK or the ACK of block 0 also lets the client know the new port to send to
+	err = receiver.Acknowledge(accepted)
+	if err != nil {
+		logger.Warn("accepting the request failed", "error", err)
+		return false
+	}
 
-		case errorErr == nil:
-			{
-				err = file.Close()
-				if err != nil {
-					log.Printf("Error closing file: %v", err)
-					return
-				}
-				log.Printf("Error packet received: %v", errorPacket)
-				return
+	//once the last block is received the file takes the place of the destination, before it is acknowledged
+	//so that the client knows the upload is stored
+	receiver.Complete = func() error {
+		if resumed != nil {
+			err := resumed.Verify()
+			if err != nil {
+				return err
 			}
 		}
 
-		marshaledAck, err := ackPacket.MarshalBinary()
-		if err != nil {
-			log.Printf("Error marshaling ack packet: %v", err)
-			return
+		version, err := upload.commit(policy)
+		if errors.Is(err, fs.ErrExist) {
+			return &transfer.Error{Code: packets.ErrFileExists, Message: "File already exists"}
+		}
+		if version != "" {
+			logger.Info("previous version kept", "version", filepath.Base(version))
 		}
+		return err
+	}
 
-		_, err = conn.Write(marshaledAck)
-		if err != nil {
-			log.Printf("Error sending ack packet: %v", err)
-			return
+	err = receiver.Receive(output)
+	if err != nil {
+		var (
+			limitErr  *transfer.Error
+			remoteErr *transfer.RemoteError
+		)
+		switch {
+		case errors.Is(err, resume.ErrMismatch), errors.As(err, &limitErr) && limitErr.Code == packets.ErrDiskFull:
+			//the partial file is not the one the client sends, or the upload is over the limits: resuming it
+			//again would fail the same way
+			upload.keep = false
+		case errors.As(err, &remoteErr) && limit.written <= stored:
+			//the client gave up before sending anything new, e.g. it cannot skip to the offset because its file
+			//is shorter than ours, the next request would be offered the same offset
+			upload.keep = false
 		}
+		logger.Warn("receiving the file failed", "error", err, "stats", receiver.Stats)
+		return false
+	}
+	logger.Info("file received", "stats", receiver.Stats)
+
+	// the client sends the last block again if our last ACK gets lost
+	receiver.Dally()
+	return true
+}
+
+// listen opens the socket of a transfer, see Listen.
+func (s *Server) listen() (net.PacketConn, error) {
+	if s.Listen != nil {
+		return s.Listen()
+	}
 
+	// the client expects the answer from the address it sent the request to
+	host := ""
+	if addr, ok := s.addr.(*net.UDPAddr); ok && !addr.IP.IsUnspecified() {
+		host = addr.IP.String()
+	}
+	if !s.PortRange.empty() {
+		return s.ports.listen(host, s.PortRange)
 	}
+	return net.ListenPacket("udp", net.JoinHostPort(host, "0"))
+}
 
+// sendError lets the client know why the transfer is aborted.
+func (s *Server) sendError(logger *slog.Logger, conn net.PacketConn, client net.Addr, code packets.ErrCode, message string) {
+	_, err := conn.WriteTo(packets.AppendError(nil, code, message), client)
+	if err != nil {
+		logger.Warn("sending the ERROR packet failed", "code", code, "error", err)
+		return
+	}
+	logger.Debug("ERROR sent", "code", code, "message", message)
+}
+
+func (s *Server) logger() *slog.Logger {
+	if s.Logger == nil {
+		return slog.Default()
+	}
+	return s.Logger
 }
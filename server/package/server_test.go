@@ -1 +1,283 @@
 package server
+
+import (
+	"TFTP/packets"
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// readAll reads a file opened with openFile.
+func readAll(content *io.SectionReader, closeFile func(), err error) ([]byte, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer closeFile()
+	return io.ReadAll(content)
+}
+
+func TestResolve(t *testing.T) {
+	s := Server{Root: "/srv/tftp"}
+
+	path, err := s.resolve("pxelinux/default")
+	if err != nil {
+		t.Fatalf("Error resolving: %v", err)
+	}
+	if path != filepath.Join("/srv/tftp", "pxelinux", "default") {
+		t.Errorf("Expected path under the root, got %s", path)
+	}
+
+	for _, name := range []string{"/etc/passwd", "../secret", "a/../../secret", ""} {
+		_, err = s.resolve(name)
+		if err == nil {
+			t.Errorf("Expected %q to be rejected", name)
+		}
+	}
+}
+
+func TestLocalName(t *testing.T) {
+	for name, expected := range map[string]string{"fw.bin": "fw.bin", "dir/sub/fw.bin": "dir/sub/fw.bin", "dir/../fw.bin": "fw.bin"} {
+		if local, err := localName(name); err != nil || local != expected {
+			t.Errorf("Expected %q for %q, got %q (%v)", expected, name, local, err)
+		}
+	}
+
+	// the upload directory is no way out of the root
+	for _, name := range []string{"../fw.bin", "dir/../../fw.bin", "/fw.bin", "", "dir/.fw.bin.partial.upload", ".fw.bin.upload/."} {
+		if _, err := localName(name); err == nil {
+			t.Errorf("Expected %q to be rejected", name)
+		}
+	}
+}
+
+func TestReadFileGeneratesIndex(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{"conf/a.txt", "conf/sub/b.txt", "other.txt"} {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := Server{Root: root, IndexName: ".index"}
+	path, err := s.resolve("conf/.index")
+	if err != nil {
+		t.Fatalf("Error resolving: %v", err)
+	}
+
+	index, err := readAll(s.openFile(path, nil))
+	if err != nil {
+		t.Fatalf("Error reading index: %v", err)
+	}
+
+	expected := "a.txt\nsub/b.txt\n"
+	if string(index) != expected {
+		t.Errorf("Expected %q, got %q", expected, index)
+	}
+}
+
+func TestReadFileGeneratesListing(t *testing.T) {
+	root := t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "hello.txt"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/etc/passwd", filepath.Join(root, "passwd")); err != nil {
+		t.Fatal(err)
+	}
+
+	s := Server{Root: root, ListName: ".list"}
+	list := func() []packets.ListEntry {
+		t.Helper()
+		data, err := readAll(s.openFile(filepath.Join(root, ".list"), nil))
+		if err != nil {
+			t.Fatalf("Error reading listing: %v", err)
+		}
+		var listing []packets.ListEntry
+		if err = json.Unmarshal(data, &listing); err != nil {
+			t.Fatalf("Error decoding listing: %v", err)
+		}
+		if len(listing) != 2 {
+			t.Fatalf("Expected 2 entries without the symlink, got %v", listing)
+		}
+		return listing
+	}
+
+	// the file is hashed in the background, the listing does not wait for it
+	if file := list()[0]; file.SHA256 != "" {
+		t.Errorf("Expected no checksum before the file is hashed, got %s", file.SHA256)
+	}
+	s.checksums.running.Wait()
+
+	listing := list()
+	file, dir := listing[0], listing[1]
+	if file.Name != "hello.txt" || file.Size != 5 || file.IsDir {
+		t.Errorf("Unexpected file entry %v", file)
+	}
+	// sha256 of "hello"
+	if file.SHA256 != "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824" {
+		t.Errorf("Unexpected checksum %s", file.SHA256)
+	}
+	if dir.Name != "sub" || !dir.IsDir || dir.SHA256 != "" {
+		t.Errorf("Unexpected directory entry %v", dir)
+	}
+}
+
+func TestListingCachesChecksums(t *testing.T) {
+	root := t.TempDir()
+	path := filepath.Join(root, "hello.txt")
+	if err := os.WriteFile(path, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := Server{Root: root, ListName: ".list"}
+	// the checksum once the file is hashed, if it has to be
+	list := func() string {
+		t.Helper()
+		var listing []packets.ListEntry
+		for i := 0; i < 2; i++ {
+			data, err := readAll(s.openFile(filepath.Join(root, ".list"), nil))
+			if err != nil {
+				t.Fatalf("Error reading listing: %v", err)
+			}
+			if err = json.Unmarshal(data, &listing); err != nil || len(listing) != 1 {
+				t.Fatalf("Expected one entry, got %v (%v)", listing, err)
+			}
+			s.checksums.running.Wait()
+		}
+		return listing[0].SHA256
+	}
+	first := list()
+
+	// same size and modification time, the file is not hashed again
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(path, []byte("jello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chtimes(path, info.ModTime(), info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	if sum := list(); sum != first {
+		t.Errorf("Expected the cached checksum %s, got %s", first, sum)
+	}
+
+	// a new modification time invalidates it
+	if err = os.Chtimes(path, info.ModTime(), info.ModTime().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if sum := list(); sum == first {
+		t.Errorf("Expected a new checksum once the file changed")
+	}
+}
+
+func TestListingHashesOnce(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "hello.txt"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := Server{Root: root, ListName: ".list"}
+	release := make(chan struct{})
+	var hashed atomic.Int32
+	s.checksums.hash = func(path string) (string, error) {
+		hashed.Add(1)
+		<-release
+		return checksum(path)
+	}
+
+	// the listings do not wait for the hash, and do not start another one
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := readAll(s.openFile(filepath.Join(root, ".list"), nil)); err != nil {
+				t.Errorf("Error reading listing: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	close(release)
+	s.checksums.running.Wait()
+
+	if n := hashed.Load(); n != 1 {
+		t.Errorf("Expected the file to be hashed once, got %d", n)
+	}
+	data, err := readAll(s.openFile(filepath.Join(root, ".list"), nil))
+	if err != nil || !bytes.Contains(data, []byte("2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824")) {
+		t.Errorf("Expected the checksum in the listing, got %s (%v)", data, err)
+	}
+}
+
+// syncBuffer is a bytes.Buffer the transfers may log to while the test reads it.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestSessionLogger(t *testing.T) {
+	var logs syncBuffer
+	s := &Server{Logger: slog.New(slog.NewJSONHandler(&logs, nil))}
+	addr, root := configuredServer(t, s)
+	content := bytes.Repeat([]byte("firmware"), 100)
+	if err := os.WriteFile(filepath.Join(root, "fw.bin"), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	p := newPeer(t, addr)
+	p.request(rrq("fw.bin"))
+	p.download()
+
+	// every record of the transfer has the attributes of its session, the last one its stats
+	var records []map[string]any
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		records = nil
+		for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+			var record map[string]any
+			if err := json.Unmarshal([]byte(line), &record); err != nil {
+				t.Fatalf("Expected JSON records, got %q: %v", line, err)
+			}
+			records = append(records, record)
+		}
+		if records[len(records)-1]["msg"] == "file sent" {
+			break
+		}
+	}
+
+	for _, record := range records {
+		if record["session"] != 1.0 || record["file"] != "fw.bin" || record["op"] != "read" || record["mode"] != packets.OCTET || !strings.HasPrefix(record["client"].(string), "127.0.0.1:") {
+			t.Errorf("Expected the attributes of the session, got %v", record)
+		}
+	}
+	last := records[len(records)-1]
+	stats, _ := last["stats"].(map[string]any)
+	if last["msg"] != "file sent" || stats["bytes"] != float64(len(content)) {
+		t.Errorf("Expected the stats of the transfer, got %v", last)
+	}
+}
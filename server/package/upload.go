@@ -0,0 +1,133 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// upload is a file being received. It is written to a hidden temporary file in the directory of the
+// destination and renamed into place by commit, so that the destination is replaced in one step.
+type upload struct {
+	path      string // destination
+	file      *os.File
+	committed bool
+	keep      bool // the temporary file holds the partial data of a resumable upload, discard leaves it
+}
+
+// newUpload creates the temporary file of an upload to path.
+func newUpload(path string) (*upload, error) {
+	file, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*"+tempSuffix)
+	if err != nil {
+		return nil, err
+	}
+	return &upload{path: path, file: file}, nil
+}
+
+// resumeUpload opens the partial file of a resumable upload to path. Its name only depends on the
+// destination, so that an upload interrupted earlier is continued from the data it left.
+func resumeUpload(path string) (*upload, error) {
+	name := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+partialSuffix)
+	file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &upload{path: path, file: file, keep: true}, nil
+}
+
+// partialSuffix ends the names of the partial files of resumable uploads, they are temporary files too.
+const partialSuffix = ".partial" + tempSuffix
+
+// tempSuffix ends the names of the temporary files of uploads, see isTemp.
+const tempSuffix = ".upload"
+
+// isTemp tells whether a file name is the one of the temporary file of an upload.
+func isTemp(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.HasSuffix(name, tempSuffix)
+}
+
+// copyExisting copies the destination into the temporary file, so that a resumed upload continues it,
+// and returns its size. Nothing is copied when there is no destination yet, or when the temporary file
+// already holds the data of an interrupted upload, which is continued instead.
+func (u *upload) copyExisting() (int64, error) {
+	info, err := u.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if info.Size() > 0 {
+		return info.Size(), nil
+	}
+
+	existing, err := os.Open(u.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer existing.Close()
+
+	return io.Copy(u.file, existing)
+}
+
+// commit flushes the file to disk and moves it to the destination. With WriteVersioned the previous
+// destination is kept first and its name returned, with WriteCreate an existing destination is left
+// alone and fs.ErrExist returned.
+func (u *upload) commit(policy WritePolicy) (string, error) {
+	err := u.file.Sync()
+	if err == nil {
+		err = u.file.Close()
+	}
+	if err != nil {
+		return "", err
+	}
+
+	var version string
+	switch policy {
+	case WriteCreate:
+		// unlike a rename, a link does not replace a file that was uploaded meanwhile
+		err = os.Link(u.file.Name(), u.path)
+		if err == nil {
+			_ = os.Remove(u.file.Name())
+		}
+	case WriteVersioned:
+		version, err = keepVersion(u.path)
+		if err == nil {
+			err = os.Rename(u.file.Name(), u.path)
+		}
+	default:
+		err = os.Rename(u.file.Name(), u.path)
+	}
+	if err != nil {
+		return "", err
+	}
+	u.committed = true
+
+	// the new name is only durable once the directory is
+	if dir, err := os.Open(filepath.Dir(u.path)); err == nil {
+		_ = dir.Sync()
+		dir.Close()
+	}
+	return version, nil
+}
+
+// discard deletes the temporary file unless the upload was committed, or it is kept to be resumed.
+func (u *upload) discard(logger *slog.Logger) {
+	if u.committed {
+		return
+	}
+	u.file.Close()
+	if u.keep {
+		logger.Info("partial upload kept to be resumed", "temp", filepath.Base(u.file.Name()))
+		return
+	}
+	if err := os.Remove(u.file.Name()); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		logger.Error("deleting the incomplete upload failed", "temp", u.file.Name(), "error", err)
+	} else {
+		logger.Info("incomplete upload deleted")
+	}
+}
@@ -0,0 +1,310 @@
+package server
+
+import (
+	"TFTP/packets"
+	"TFTP/resume"
+	"bytes"
+	"errors"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// tempFiles returns the temporary files of the uploads in dir.
+func tempFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		t.Fatal(err)
+	}
+	var temp []string
+	for _, entry := range entries {
+		if isTemp(entry.Name()) {
+			temp = append(temp, entry.Name())
+		}
+	}
+	return temp
+}
+
+func TestUploadIsAtomic(t *testing.T) {
+	addr, root := conformanceServer(t, map[string][]byte{"received/fw.bin": []byte("old")})
+	s := Server{Root: root, IndexName: ".index"}
+
+	p := newPeer(t, addr)
+	p.request(wrq("fw.bin"))
+	p.expectAck(0)
+	p.send(nil, packets.Data{BlockNumber: 1, Payload: bytes.NewReader(bytes.Repeat([]byte("n"), packets.BlockSize))})
+	p.expectAck(1)
+
+	// the upload is not visible before it is complete, not even in the index
+	if content, err := os.ReadFile(filepath.Join(root, "received/fw.bin")); err != nil || string(content) != "old" {
+		t.Errorf("Expected the old file during the upload, got %q (%v)", content, err)
+	}
+	if temp := tempFiles(t, filepath.Join(root, UploadDir)); len(temp) != 1 {
+		t.Errorf("Expected a temporary file, got %v", temp)
+	}
+	index, err := readAll(s.openFile(filepath.Join(root, ".index"), nil))
+	if err != nil || string(index) != "received/fw.bin\n" {
+		t.Errorf("Expected the index to hide the upload, got %q (%v)", index, err)
+	}
+
+	// the client is gone, the server gives up and deletes the temporary file
+	deadline := time.Now().Add(10 * conformanceTimeout)
+	for len(tempFiles(t, filepath.Join(root, UploadDir))) > 0 && time.Now().Before(deadline) {
+		time.Sleep(conformanceTimeout / 10)
+	}
+	if temp := tempFiles(t, filepath.Join(root, UploadDir)); len(temp) != 0 {
+		t.Errorf("Expected the temporary file to be deleted, got %v", temp)
+	}
+	if content, err := os.ReadFile(filepath.Join(root, "received/fw.bin")); err != nil || string(content) != "old" {
+		t.Errorf("Expected the old file to be kept, got %q (%v)", content, err)
+	}
+}
+
+func TestUploadReplacesFile(t *testing.T) {
+	addr, root := conformanceServer(t, map[string][]byte{"received/fw.bin": []byte("old")})
+	content := bytes.Repeat([]byte("n"), packets.BlockSize+10)
+
+	p := newPeer(t, addr)
+	p.request(wrq("fw.bin"))
+	p.expectAck(0)
+	p.upload(content)
+
+	uploaded, err := os.ReadFile(filepath.Join(root, "received/fw.bin"))
+	if err != nil || !bytes.Equal(uploaded, content) {
+		t.Errorf("Expected %d bytes, got %d (%v)", len(content), len(uploaded), err)
+	}
+	if temp := tempFiles(t, filepath.Join(root, UploadDir)); len(temp) != 0 {
+		t.Errorf("Expected no temporary file, got %v", temp)
+	}
+}
+
+// interruptedUpload sends the first blocks of content in an upload with an offset, then stops answering
+// until the server gives up. It returns the temporary files left in the upload directory.
+func interruptedUpload(t *testing.T, s *Server, addr net.Addr, name string, content []byte, blocks int) []string {
+	t.Helper()
+	p := newPeer(t, addr)
+	req := wrq(name)
+	req.Options = map[string]string{packets.OptOffset: "0"}
+	p.request(req)
+	p.receive(2 * conformanceTimeout)
+	for block := 1; block <= blocks; block++ {
+		payload := content[(block-1)*packets.BlockSize : block*packets.BlockSize]
+		p.send(nil, packets.Data{BlockNumber: uint16(block), Payload: bytes.NewReader(payload)})
+		p.expectAck(uint16(block))
+	}
+
+	path := filepath.Join(s.Root, UploadDir, name)
+	deadline := time.Now().Add(10 * conformanceTimeout)
+	for time.Now().Before(deadline) {
+		if _, running := s.partials.Load(path); !running {
+			break
+		}
+		time.Sleep(conformanceTimeout / 10)
+	}
+	if _, running := s.partials.Load(path); running {
+		t.Fatalf("Expected the server to give up the upload")
+	}
+	return tempFiles(t, filepath.Join(s.Root, UploadDir))
+}
+
+func TestUploadResume(t *testing.T) {
+	s := &Server{}
+	addr, root := configuredServer(t, s)
+	content := bytes.Repeat([]byte("0123456789"), 300)
+
+	// the data received before the client went away is kept, the destination is not created yet
+	temp := interruptedUpload(t, s, addr, "fw.bin", content, 3)
+	if len(temp) != 1 {
+		t.Fatalf("Expected the partial file to be kept, got %v", temp)
+	}
+	if info, err := os.Stat(filepath.Join(root, UploadDir, temp[0])); err != nil || info.Size() != 3*packets.BlockSize {
+		t.Fatalf("Expected %d bytes in the partial file, got %v (%v)", 3*packets.BlockSize, info, err)
+	}
+	if _, err := os.Stat(filepath.Join(root, UploadDir, "fw.bin")); err == nil {
+		t.Errorf("Expected no file before the upload is complete")
+	}
+
+	// the next request with an offset continues from the partial file
+	p := newPeer(t, addr)
+	req := wrq("fw.bin")
+	req.Options = map[string]string{packets.OptOffset: "0"}
+	p.request(req)
+
+	var oack packets.OptionAck
+	if err := oack.UnmarshalBinary(p.receive(2 * conformanceTimeout)); err != nil {
+		t.Fatalf("Expected an OACK, got %v", err)
+	}
+	offset := resume.Offset(3 * packets.BlockSize)
+	if oack.Options[packets.OptOffset] != strconv.FormatInt(offset, 10) {
+		t.Fatalf("Expected offset %d, got %v", offset, oack.Options)
+	}
+	p.upload(content[offset:])
+
+	uploaded, err := os.ReadFile(filepath.Join(root, UploadDir, "fw.bin"))
+	if err != nil || !bytes.Equal(uploaded, content) {
+		t.Errorf("Expected the resumed file, got %d of %d bytes (%v)", len(uploaded), len(content), err)
+	}
+	if temp := tempFiles(t, filepath.Join(root, UploadDir)); len(temp) != 0 {
+		t.Errorf("Expected the partial file to be committed, got %v", temp)
+	}
+}
+
+func TestUploadResumeMismatch(t *testing.T) {
+	s := &Server{}
+	addr, root := configuredServer(t, s)
+	content := bytes.Repeat([]byte("0123456789"), 300)
+	interruptedUpload(t, s, addr, "fw.bin", content, 3)
+
+	// the client resumes another file, the partial file is useless and deleted
+	p := newPeer(t, addr)
+	req := wrq("fw.bin")
+	req.Options = map[string]string{packets.OptOffset: "0"}
+	p.request(req)
+	p.receive(2 * conformanceTimeout)
+	p.send(nil, packets.Data{BlockNumber: 1, Payload: bytes.NewReader(bytes.Repeat([]byte("x"), packets.BlockSize))})
+	p.expectError(packets.ErrUnknown)
+
+	deadline := time.Now().Add(10 * conformanceTimeout)
+	for len(tempFiles(t, filepath.Join(root, UploadDir))) > 0 && time.Now().Before(deadline) {
+		time.Sleep(conformanceTimeout / 10)
+	}
+	if temp := tempFiles(t, filepath.Join(root, UploadDir)); len(temp) != 0 {
+		t.Errorf("Expected the partial file to be deleted, got %v", temp)
+	}
+}
+
+func TestUploadResumeTooLarge(t *testing.T) {
+	addr, root := configuredServer(t, &Server{MaxUploadSize: 2 * packets.BlockSize})
+	content := bytes.Repeat([]byte("0123456789"), 300)
+
+	// resuming an upload over the limits would be refused the same way, its data is not kept
+	p := newPeer(t, addr)
+	req := wrq("fw.bin")
+	req.Options = map[string]string{packets.OptOffset: "0"}
+	p.request(req)
+	p.receive(2 * conformanceTimeout)
+	for block := 1; block <= 2; block++ {
+		payload := content[(block-1)*packets.BlockSize : block*packets.BlockSize]
+		p.send(nil, packets.Data{BlockNumber: uint16(block), Payload: bytes.NewReader(payload)})
+		p.expectAck(uint16(block))
+	}
+	p.send(nil, packets.Data{BlockNumber: 3, Payload: bytes.NewReader(content[2*packets.BlockSize : 3*packets.BlockSize])})
+	p.expectError(packets.ErrDiskFull)
+
+	deadline := time.Now().Add(10 * conformanceTimeout)
+	for len(tempFiles(t, filepath.Join(root, UploadDir))) > 0 && time.Now().Before(deadline) {
+		time.Sleep(conformanceTimeout / 10)
+	}
+	if temp := tempFiles(t, filepath.Join(root, UploadDir)); len(temp) != 0 {
+		t.Errorf("Expected the partial file to be deleted, got %v", temp)
+	}
+}
+
+func TestUploadResumeExisting(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 300)
+	partial := content[:2*packets.BlockSize+100]
+	addr, root := conformanceServer(t, map[string][]byte{"received/fw.bin": partial})
+
+	// without a partial file the upload continues the destination
+	p := newPeer(t, addr)
+	req := wrq("fw.bin")
+	req.Options = map[string]string{packets.OptOffset: "0"}
+	p.request(req)
+
+	var oack packets.OptionAck
+	if err := oack.UnmarshalBinary(p.receive(2 * conformanceTimeout)); err != nil {
+		t.Fatalf("Expected an OACK, got %v", err)
+	}
+	offset := resume.Offset(int64(len(partial)))
+	if oack.Options[packets.OptOffset] != strconv.FormatInt(offset, 10) {
+		t.Fatalf("Expected offset %d, got %v", offset, oack.Options)
+	}
+	p.upload(content[offset:])
+
+	uploaded, err := os.ReadFile(filepath.Join(root, "received/fw.bin"))
+	if err != nil || !bytes.Equal(uploaded, content) {
+		t.Errorf("Expected the resumed file, got %d of %d bytes (%v)", len(uploaded), len(content), err)
+	}
+}
+
+func TestUploadResumeRejectedOffset(t *testing.T) {
+	addr, root := conformanceServer(t, map[string][]byte{"received/fw.bin": bytes.Repeat([]byte("old"), 1000)})
+
+	// the file of the client is shorter than the destination, it cannot skip to the offset and aborts
+	p := newPeer(t, addr)
+	req := wrq("fw.bin")
+	req.Options = map[string]string{packets.OptOffset: "0"}
+	p.request(req)
+	p.receive(2 * conformanceTimeout)
+	p.send(nil, packets.Error{ErrCode: packets.ErrUnknown, Message: "Invalid offset"})
+
+	// the copy of the destination would be offered again, it is deleted
+	deadline := time.Now().Add(10 * conformanceTimeout)
+	for len(tempFiles(t, filepath.Join(root, UploadDir))) > 0 && time.Now().Before(deadline) {
+		time.Sleep(conformanceTimeout / 10)
+	}
+	if temp := tempFiles(t, filepath.Join(root, UploadDir)); len(temp) != 0 {
+		t.Errorf("Expected the partial file to be deleted, got %v", temp)
+	}
+	if content, err := os.ReadFile(filepath.Join(root, "received/fw.bin")); err != nil || len(content) != 3000 {
+		t.Errorf("Expected the destination to be kept, got %d bytes (%v)", len(content), err)
+	}
+}
+
+func TestUploadTraversal(t *testing.T) {
+	addr, root := conformanceServer(t, map[string][]byte{"boot.bin": []byte("served")})
+
+	// a name that climbs out of the upload directory is refused, even when it stays under the root
+	for _, name := range []string{"../boot.bin", "../../boot.bin", "dir/../../boot.bin", "/boot.bin"} {
+		p := newPeer(t, addr)
+		p.request(wrq(name))
+		p.expectError(packets.ErrAccessViolation)
+	}
+	if content, err := os.ReadFile(filepath.Join(root, "boot.bin")); err != nil || string(content) != "served" {
+		t.Errorf("Expected the served file to be kept, got %q (%v)", content, err)
+	}
+}
+
+func TestUploadMirrorsTree(t *testing.T) {
+	addr, root := configuredServer(t, &Server{CreateDirs: true})
+	content := []byte("firmware")
+
+	p := newPeer(t, addr)
+	p.request(wrq("dir/sub/fw.bin"))
+	p.expectAck(0)
+	p.upload(content)
+
+	uploaded, err := os.ReadFile(filepath.Join(root, UploadDir, "dir", "sub", "fw.bin"))
+	if err != nil || !bytes.Equal(uploaded, content) {
+		t.Errorf("Expected the tree to be mirrored under the upload directory, got %q (%v)", uploaded, err)
+	}
+}
+
+func TestUploadTempFilesHidden(t *testing.T) {
+	s := &Server{}
+	addr, root := configuredServer(t, s)
+	content := bytes.Repeat([]byte("0123456789"), 300)
+	temp := interruptedUpload(t, s, addr, "fw.bin", content, 2)
+	if len(temp) != 1 {
+		t.Fatalf("Expected the partial file to be kept, got %v", temp)
+	}
+
+	// the half written file is not served
+	p := newPeer(t, addr)
+	p.request(rrq(UploadDir + "/" + temp[0]))
+	p.expectError(packets.ErrAccessViolation)
+
+	// nor written by another upload, which would be resumed by the next request for fw.bin
+	p = newPeer(t, addr)
+	p.request(wrq(temp[0]))
+	p.expectError(packets.ErrAccessViolation)
+
+	if info, err := os.Stat(filepath.Join(root, UploadDir, temp[0])); err != nil || info.Size() != 2*packets.BlockSize {
+		t.Errorf("Expected the partial file to be left alone, got %v (%v)", info, err)
+	}
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// WritePolicy is what the server does with uploads.
+type WritePolicy int
+
+const (
+	WriteOverwrite WritePolicy = iota // an existing file is replaced, the default
+	WriteDisabled                     // uploads are refused, the server is read only
+	WriteCreate                       // only new files are accepted, an existing file is answered with ErrFileExists
+	WriteVersioned                    // an existing file is kept as name.1, name.2... before it is replaced
+)
+
+var writePolicyNames = map[WritePolicy]string{
+	WriteOverwrite: "overwrite",
+	WriteDisabled:  "disabled",
+	WriteCreate:    "create",
+	WriteVersioned: "versioned",
+}
+
+func (p WritePolicy) String() string {
+	if name, ok := writePolicyNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("WritePolicy(%d)", int(p))
+}
+
+func (p WritePolicy) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+func (p *WritePolicy) UnmarshalText(text []byte) error {
+	for policy, name := range writePolicyNames {
+		if name == string(text) {
+			*p = policy
+			return nil
+		}
+	}
+	return fmt.Errorf("Invalid write policy %q", text)
+}
+
+// Set makes a *WritePolicy a flag.Value.
+func (p *WritePolicy) Set(value string) error {
+	return p.UnmarshalText([]byte(value))
+}
+
+// WriteRule applies a write policy to the uploads whose name matches a path.Match pattern.
+type WriteRule struct {
+	Files  string      `json:"files"`
+	Policy WritePolicy `json:"policy"`
+}
+
+// WriteRules are the write policies of paths, the first rule that matches an upload applies.
+// It implements flag.Value, every value adds a rule written as "pattern=policy", e.g. "backups/*=versioned".
+type WriteRules []WriteRule
+
+func (r *WriteRules) String() string {
+	if r == nil {
+		return ""
+	}
+	rules := make([]string, len(*r))
+	for i, rule := range *r {
+		rules[i] = rule.Files + "=" + rule.Policy.String()
+	}
+	return strings.Join(rules, ",")
+}
+
+func (r *WriteRules) Set(value string) error {
+	files, policy, ok := strings.Cut(value, "=")
+	if !ok {
+		return fmt.Errorf("Invalid write rule %q, expected pattern=policy", value)
+	}
+
+	rule := WriteRule{Files: files}
+	err := rule.Policy.Set(policy)
+	if err != nil {
+		return err
+	}
+	if _, err = path.Match(files, ""); err != nil {
+		return fmt.Errorf("Invalid pattern in write rule %q", value)
+	}
+
+	*r = append(*r, rule)
+	return nil
+}
+
+// writePolicy returns the policy of an upload by its requested name.
+func (s *Server) writePolicy(name string) WritePolicy {
+	name = path.Clean(filepath.ToSlash(name))
+	for _, rule := range s.WriteRules {
+		if matched, err := path.Match(rule.Files, name); err == nil && matched {
+			return rule.Policy
+		}
+	}
+	return s.WritePolicy
+}
+
+// keepVersion links the file at path to path.N, the first N that is free, so that it is kept when an
+// upload is renamed over it. Linking fails when path.N exists, so concurrent uploads cannot take the
+// same N. Nothing is done when there is no file.
+func keepVersion(path string) (string, error) {
+	for n := 1; ; n++ {
+		version := path + "." + strconv.Itoa(n)
+		err := os.Link(path, version)
+		if errors.Is(err, fs.ErrExist) {
+			continue
+		}
+		if errors.Is(err, fs.ErrNotExist) {
+			return "", nil
+		}
+		return version, err
+	}
+}
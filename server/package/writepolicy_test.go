@@ -0,0 +1,112 @@
+package server
+
+import (
+	"TFTP/packets"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteRulesSet(t *testing.T) {
+	var rules WriteRules
+	for _, value := range []string{"backups/*=versioned", "firmware/*=create", "*=disabled"} {
+		if err := rules.Set(value); err != nil {
+			t.Fatalf("Error setting %s: %v", value, err)
+		}
+	}
+	if rules.String() != "backups/*=versioned,firmware/*=create,*=disabled" {
+		t.Errorf("Expected the rules in order, got %s", rules.String())
+	}
+
+	for _, value := range []string{"backups/*", "backups/*=append", "[=create"} {
+		if err := rules.Set(value); err == nil {
+			t.Errorf("Expected %q to be rejected", value)
+		}
+	}
+
+	s := Server{WritePolicy: WriteOverwrite, WriteRules: rules[:2]}
+	for name, expected := range map[string]WritePolicy{
+		"backups/db":      WriteVersioned,
+		"firmware/fw.bin": WriteCreate,
+		"other.txt":       WriteOverwrite,
+	} {
+		if policy := s.writePolicy(name); policy != expected {
+			t.Errorf("Expected %s for %s, got %s", expected, name, policy)
+		}
+	}
+}
+
+// configuredServer serves a temporary root with the settings of s and returns its address and the root.
+func configuredServer(t *testing.T, s *Server) (net.Addr, string) {
+	t.Helper()
+	s.Root = t.TempDir()
+	s.Timeout, s.Retries = conformanceTimeout, 3
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go s.Serve(conn)
+	return conn.LocalAddr(), s.Root
+}
+
+func TestWriteDisabled(t *testing.T) {
+	addr, root := configuredServer(t, &Server{WritePolicy: WriteDisabled, CreateDirs: true})
+
+	p := newPeer(t, addr)
+	p.request(wrq("dir/fw.bin"))
+	p.expectError(packets.ErrAccessViolation)
+	if _, err := os.Stat(filepath.Join(root, UploadDir)); err == nil {
+		t.Errorf("Expected no directory to be created")
+	}
+}
+
+func TestWriteCreateOnly(t *testing.T) {
+	addr, root := configuredServer(t, &Server{WriteRules: WriteRules{{Files: "*", Policy: WriteCreate}}})
+
+	p := newPeer(t, addr)
+	p.request(wrq("fw.bin"))
+	p.expectAck(0)
+	p.upload([]byte("first"))
+
+	// the existing file is left alone
+	p = newPeer(t, addr)
+	p.request(wrq("fw.bin"))
+	p.expectError(packets.ErrFileExists)
+
+	// resuming would continue it, the request is refused before any data is sent
+	p = newPeer(t, addr)
+	req := wrq("other.bin")
+	req.Options = map[string]string{packets.OptOffset: "0"}
+	p.request(req)
+	p.expectError(packets.ErrFileExists)
+
+	content, err := os.ReadFile(filepath.Join(root, "received/fw.bin"))
+	if err != nil || string(content) != "first" {
+		t.Errorf("Expected the first upload to be kept, got %q (%v)", content, err)
+	}
+}
+
+func TestWriteVersioned(t *testing.T) {
+	addr, root := configuredServer(t, &Server{WritePolicy: WriteVersioned})
+
+	for _, content := range []string{"first", "second", "third"} {
+		p := newPeer(t, addr)
+		p.request(wrq("fw.bin"))
+		p.expectAck(0)
+		p.upload([]byte(content))
+	}
+
+	for name, expected := range map[string]string{
+		"received/fw.bin":   "third",
+		"received/fw.bin.1": "first",
+		"received/fw.bin.2": "second",
+	} {
+		content, err := os.ReadFile(filepath.Join(root, name))
+		if err != nil || string(content) != expected {
+			t.Errorf("Expected %q in %s, got %q (%v)", expected, name, content, err)
+		}
+	}
+}
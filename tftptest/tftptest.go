@@ -0,0 +1,488 @@
+// Package tftptest provides a TFTP server for tests, like net/http/httptest does for HTTP.
+//
+// The server runs in the test process on a loopback port or on a simulated network (see netsim),
+// serves the files of a directory or the content returned by a Handler, records the requests and
+// transfers it handled and can answer requests with ERROR packets.
+package tftptest
+
+import (
+	"TFTP/netsim"
+	"TFTP/packets"
+	server "TFTP/server/package"
+	"encoding/binary"
+	"errors"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Server is a TFTP server serving the files of a temporary directory.
+type Server struct {
+	Addr    net.Addr        // address of the server, set once it is started
+	Root    string          // directory the files are served from and uploaded to
+	Network *netsim.Network // simulated network the server listens on, nil on loopback
+
+	// Config is the server, it can be changed until the server is started.
+	// Root is set to the temporary directory, Timeout and Retries are lowered for tests.
+	Config *server.Server
+
+	// Handler answers the requests before the server does, nil to only serve the files of the root.
+	// It can be set until the server is started.
+	Handler Handler
+
+	t         testing.TB
+	staging   string // directory the content of the Handler is written to before it is moved to the root
+	conn      net.PacketConn
+	listen    func() (net.PacketConn, error)
+	sessions  sync.WaitGroup
+	closeOnce sync.Once
+
+	mu        sync.Mutex
+	closed    bool
+	requests  []Request
+	transfers []*Transfer
+	pending   map[string][]*Transfer // transfers waiting for their socket, by client address
+	inject    map[string][]packets.Error
+}
+
+// Request is a read or write request received by the server.
+type Request struct {
+	Op       packets.OpCode // packets.PRQ or packets.WRQ
+	FileName string
+	Mode     string
+	Options  map[string]string
+	Client   net.Addr
+}
+
+// Handler answers a request like an http.Handler, with the content of the file for a read request, which
+// the server then serves as usual. For a write request the content is ignored, the upload is stored under
+// the root, see Uploaded. An error refuses the request with an ERROR packet: ErrNotFound when it is
+// fs.ErrNotExist, ErrAccessViolation when it is fs.ErrPermission and ErrUnknown otherwise.
+// The content is stored in the root, concurrent requests for one name should get the same content.
+type Handler func(req Request) ([]byte, error)
+
+// Transfer is what happened after a request.
+type Transfer struct {
+	Request
+	Sent     int            // datagrams sent by the server
+	Received int            // datagrams received by the server
+	Bytes    int64          // bytes of file data sent or received, every block is counted once, in order
+	Error    *packets.Error // ERROR packet sent by the server, nil when there was none
+	Injected bool           // the ERROR packet was injected with InjectError
+	Done     bool           // the server closed the socket of the transfer
+
+	lastBlock uint16
+}
+
+// NewServer starts a server on a loopback port serving a copy of files, which may be nil.
+// The server is closed when the test finishes.
+func NewServer(t testing.TB, files fs.FS) *Server {
+	t.Helper()
+	s := NewUnstartedServer(t, files)
+	s.Start()
+	return s
+}
+
+// NewHandlerServer starts a server on a loopback port answering the requests with handler.
+// The server is closed when the test finishes.
+func NewHandlerServer(t testing.TB, handler Handler) *Server {
+	t.Helper()
+	s := NewUnstartedServer(t, nil)
+	s.Handler = handler
+	s.Start()
+	return s
+}
+
+// NewUnstartedServer returns a server that can be configured before Start or StartSim is called.
+func NewUnstartedServer(t testing.TB, files fs.FS) *Server {
+	t.Helper()
+	root := t.TempDir()
+	if files != nil {
+		if err := os.CopyFS(root, files); err != nil {
+			t.Fatalf("tftptest: copying files: %v", err)
+		}
+	}
+
+	s := &Server{
+		Root:    root,
+		Config:  &server.Server{Root: root, Timeout: time.Second, Retries: 3},
+		t:       t,
+		staging: t.TempDir(),
+		pending: make(map[string][]*Transfer),
+		inject:  make(map[string][]packets.Error),
+	}
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Start serves on a loopback port.
+func (s *Server) Start() {
+	s.t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		s.t.Fatalf("tftptest: listening: %v", err)
+	}
+	s.start(conn, func() (net.PacketConn, error) { return net.ListenPacket("udp", "127.0.0.1:0") })
+}
+
+// StartSim serves on a simulated network, clients have to listen on the same network.
+func (s *Server) StartSim(network *netsim.Network) {
+	s.t.Helper()
+	conn, err := network.Listen("server:69")
+	if err != nil {
+		s.t.Fatalf("tftptest: listening: %v", err)
+	}
+	s.Network = network
+	s.start(conn, conn.Listen)
+}
+
+func (s *Server) start(conn net.PacketConn, listen func() (net.PacketConn, error)) {
+	if s.conn != nil {
+		s.t.Fatal("tftptest: server already started")
+	}
+
+	if s.Config.Listen != nil {
+		listen = s.Config.Listen
+	}
+	s.conn, s.listen, s.Addr = conn, listen, conn.LocalAddr()
+	s.Config.Listen = s.listenSession
+
+	go s.Config.Serve(&listener{PacketConn: conn, srv: s})
+}
+
+// Close stops the server and waits for the running transfers to finish.
+func (s *Server) Close() {
+	s.closeOnce.Do(func() {
+		s.mu.Lock()
+		s.closed = true
+		s.mu.Unlock()
+
+		if s.conn != nil {
+			s.conn.Close()
+		}
+		s.sessions.Wait()
+	})
+}
+
+// InjectError makes the server answer the next request for name with an ERROR packet instead of
+// serving it. An empty name matches any request, errors injected several times are sent in order.
+func (s *Server) InjectError(name string, code packets.ErrCode, message string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.inject[name] = append(s.inject[name], packets.Error{ErrCode: code, Message: message})
+}
+
+// Requests returns the requests received so far.
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Request(nil), s.requests...)
+}
+
+// Transfers returns the transfers started so far. Call Close first to wait for them to finish.
+func (s *Server) Transfers() []Transfer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	transfers := make([]Transfer, len(s.transfers))
+	for i, transfer := range s.transfers {
+		transfers[i] = *transfer
+	}
+	return transfers
+}
+
+// ReadFile returns the content of a file of the root.
+func (s *Server) ReadFile(name string) ([]byte, error) {
+	return os.ReadFile(filepath.Join(s.Root, filepath.FromSlash(name)))
+}
+
+// Uploaded returns the content of a file uploaded as name.
+func (s *Server) Uploaded(name string) ([]byte, error) {
+	// the server stores uploads in a directory of the root, see server.UploadDir
+	return s.ReadFile(server.UploadDir + "/" + name)
+}
+
+// request records a request and returns the error to answer it with, if one was injected or the Handler
+// refused it.
+func (s *Server) request(req Request) *packets.Error {
+	injected := s.injected(req.FileName)
+	var refused *packets.Error
+	if injected == nil && s.Handler != nil {
+		refused = s.handle(req)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = append(s.requests, req)
+	transfer := &Transfer{Request: req}
+	s.transfers = append(s.transfers, transfer)
+
+	answer := injected
+	if answer == nil {
+		answer = refused
+	}
+	if answer != nil {
+		transfer.Error, transfer.Injected, transfer.Done = answer, injected != nil, true
+		transfer.Sent++
+		return answer
+	}
+
+	key := req.Client.String()
+	s.pending[key] = append(s.pending[key], transfer)
+	return nil
+}
+
+// injected returns the next error injected for name, nil when there is none.
+func (s *Server) injected(name string) *packets.Error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, name := range []string{name, ""} {
+		if errs := s.inject[name]; len(errs) > 0 {
+			s.inject[name] = errs[1:]
+			return &errs[0]
+		}
+	}
+	return nil
+}
+
+// handle passes a request to the Handler and stores the content of a read request in the root,
+// it returns the ERROR to answer with when the Handler refused the request.
+func (s *Server) handle(req Request) *packets.Error {
+	content, err := s.Handler(req)
+	if err == nil && req.Op == packets.PRQ {
+		err = s.store(req.FileName, content)
+	}
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, fs.ErrNotExist):
+		return &packets.Error{ErrCode: packets.ErrNotFound, Message: err.Error()}
+	case errors.Is(err, fs.ErrPermission):
+		return &packets.Error{ErrCode: packets.ErrAccessViolation, Message: err.Error()}
+	}
+	return &packets.Error{ErrCode: packets.ErrUnknown, Message: err.Error()}
+}
+
+// store writes content to name under the root, the server rejects names that are not local by itself.
+// It is moved into place, a transfer that already opened the previous content keeps reading it.
+func (s *Server) store(name string, content []byte) error {
+	local := filepath.FromSlash(name)
+	if !filepath.IsLocal(local) {
+		return nil
+	}
+	path := filepath.Join(s.Root, local)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	file, err := os.CreateTemp(s.staging, "content")
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(content)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+	}
+	return err
+}
+
+// rejected records an ERROR the server sent from its port to client: the request read last from the
+// client was refused without a transfer, it no longer waits for its socket.
+func (s *Server) rejected(p []byte, client net.Addr) {
+	var errorPacket packets.Error
+	if errorPacket.UnmarshalBinary(p) != nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := client.String()
+	pending := s.pending[key]
+	if len(pending) == 0 {
+		return
+	}
+	transfer := pending[len(pending)-1]
+	s.pending[key] = pending[:len(pending)-1]
+	if len(s.pending[key]) == 0 {
+		delete(s.pending, key)
+	}
+	transfer.Error, transfer.Done = &errorPacket, true
+	transfer.Sent++
+}
+
+// listenSession opens the socket of a transfer and records what is sent over it.
+func (s *Server) listenSession() (net.PacketConn, error) {
+	conn, err := s.listen()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		conn.Close()
+		return nil, net.ErrClosed
+	}
+
+	s.sessions.Add(1)
+	return &session{PacketConn: conn, srv: s}, nil
+}
+
+// claim returns the transfer of the request of client, the server has to be locked.
+func (s *Server) claim(client net.Addr) *Transfer {
+	key := client.String()
+	if pending := s.pending[key]; len(pending) > 0 {
+		s.pending[key] = pending[1:]
+		if len(s.pending[key]) == 0 {
+			delete(s.pending, key)
+		}
+		return pending[0]
+	}
+
+	transfer := &Transfer{Request: Request{Client: client}}
+	s.transfers = append(s.transfers, transfer)
+	return transfer
+}
+
+// record inspects a datagram of a session, sent tells whether the server sent it.
+// The session belongs to the transfer of the first address it exchanges a datagram with.
+func (s *Server) record(c *session, p []byte, addr net.Addr, sent bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if c.transfer == nil {
+		c.transfer = s.claim(addr)
+	}
+	transfer := c.transfer
+
+	if sent {
+		transfer.Sent++
+	} else {
+		transfer.Received++
+	}
+	if len(p) < 4 {
+		return
+	}
+
+	switch packets.OpCode(binary.BigEndian.Uint16(p)) {
+	case packets.DATA:
+		// data flows from the server for reads and to the server for writes, only the block after the last
+		// one counted is new, a window sent again after a timeout or a lost block starts before it
+		block := binary.BigEndian.Uint16(p[2:])
+		if sent == (transfer.Op == packets.PRQ) && block == transfer.lastBlock+1 {
+			transfer.lastBlock = block
+			transfer.Bytes += int64(len(p) - 4)
+		}
+	case packets.ERROR:
+		if sent {
+			var errorPacket packets.Error
+			if errorPacket.UnmarshalBinary(p) == nil {
+				transfer.Error = &errorPacket
+			}
+		}
+	}
+}
+
+// listener records the requests read by the server and answers them with injected errors.
+type listener struct {
+	net.PacketConn
+	srv *Server
+}
+
+func (l *listener) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := l.PacketConn.ReadFrom(p)
+		if err != nil {
+			return n, addr, err
+		}
+
+		req, ok := parseRequest(p[:n])
+		if !ok {
+			return n, addr, nil
+		}
+		req.Client = addr
+
+		injected := l.srv.request(req)
+		if injected == nil {
+			return n, addr, nil
+		}
+
+		// answer from a new port, like the server does
+		conn, err := l.srv.listen()
+		if err != nil {
+			continue
+		}
+		data, _ := injected.MarshalBinary()
+		conn.WriteTo(data, addr)
+		conn.Close()
+	}
+}
+
+// WriteTo records the ERROR packets the server answers requests with from its port.
+func (l *listener) WriteTo(p []byte, addr net.Addr) (int, error) {
+	n, err := l.PacketConn.WriteTo(p, addr)
+	if err == nil && len(p) >= 2 && packets.OpCode(binary.BigEndian.Uint16(p)) == packets.ERROR {
+		l.srv.rejected(p, addr)
+	}
+	return n, err
+}
+
+func parseRequest(p []byte) (Request, bool) {
+	var (
+		readReq  packets.ReadRequest
+		writeReq packets.WriteRequest
+	)
+	if readReq.UnmarshalBinary(p) == nil {
+		return Request{Op: packets.PRQ, FileName: readReq.FileName, Mode: readReq.Mode, Options: readReq.Options}, true
+	}
+	if writeReq.UnmarshalBinary(p) == nil {
+		return Request{Op: packets.WRQ, FileName: writeReq.FileName, Mode: writeReq.Mode, Options: writeReq.Options}, true
+	}
+	return Request{}, false
+}
+
+// session is the socket of a transfer.
+type session struct {
+	net.PacketConn
+	srv       *Server
+	transfer  *Transfer // set by record
+	closeOnce sync.Once
+}
+
+func (c *session) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(p)
+	if err == nil {
+		c.srv.record(c, p[:n], addr, false)
+	}
+	return n, addr, err
+}
+
+func (c *session) WriteTo(p []byte, addr net.Addr) (int, error) {
+	n, err := c.PacketConn.WriteTo(p, addr)
+	if err == nil {
+		c.srv.record(c, p, addr, true)
+	}
+	return n, err
+}
+
+func (c *session) Close() error {
+	err := c.PacketConn.Close()
+	c.closeOnce.Do(func() {
+		c.srv.mu.Lock()
+		if c.transfer != nil {
+			c.transfer.Done = true
+		}
+		c.srv.mu.Unlock()
+		c.srv.sessions.Done()
+	})
+	return err
+}
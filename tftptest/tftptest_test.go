@@ -0,0 +1,235 @@
+package tftptest_test
+
+import (
+	client "TFTP/client/package"
+	"TFTP/netsim"
+	"TFTP/packets"
+	server "TFTP/server/package"
+	"TFTP/tftptest"
+	"bytes"
+	"errors"
+	"io/fs"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestServer(t *testing.T) {
+	content := strings.Repeat("kernel ", 200)
+	srv := tftptest.NewServer(t, fstest.MapFS{"boot/vmlinuz": {Data: []byte(content)}})
+
+	local := filepath.Join(t.TempDir(), "vmlinuz")
+	if err := client.Get(srv.Addr.String(), "boot/vmlinuz", local, time.Second); err != nil {
+		t.Fatalf("Error downloading: %v", err)
+	}
+	if data, err := os.ReadFile(local); err != nil || string(data) != content {
+		t.Errorf("Expected %d bytes, got %d (%v)", len(content), len(data), err)
+	}
+
+	if err := os.WriteFile(local, []byte("config"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Put(srv.Addr.String(), local, "switch.cfg", time.Second); err != nil {
+		t.Fatalf("Error uploading: %v", err)
+	}
+
+	srv.Close()
+	if data, err := srv.Uploaded("switch.cfg"); err != nil || string(data) != "config" {
+		t.Errorf("Expected the uploaded file, got %q (%v)", data, err)
+	}
+
+	transfers := srv.Transfers()
+	if len(transfers) != 2 {
+		t.Fatalf("Expected 2 transfers, got %d", len(transfers))
+	}
+
+	get, put := transfers[0], transfers[1]
+	if get.Op != packets.PRQ || get.FileName != "boot/vmlinuz" || get.Bytes != int64(len(content)) || !get.Done || get.Error != nil {
+		t.Errorf("Unexpected read transfer: %+v", get)
+	}
+	if put.Op != packets.WRQ || put.FileName != "switch.cfg" || put.Bytes != int64(len("config")) || !put.Done || put.Error != nil {
+		t.Errorf("Unexpected write transfer: %+v", put)
+	}
+	if len(srv.Requests()) != 2 {
+		t.Errorf("Expected 2 requests, got %d", len(srv.Requests()))
+	}
+}
+
+func TestServerRecordsErrors(t *testing.T) {
+	srv := tftptest.NewServer(t, nil)
+
+	err := client.Get(srv.Addr.String(), "missing.bin", filepath.Join(t.TempDir(), "missing.bin"), time.Second)
+	var remote *client.RemoteError
+	if !errors.As(err, &remote) || remote.Code != packets.ErrNotFound {
+		t.Fatalf("Expected a not found error, got %v", err)
+	}
+
+	srv.Close()
+	transfers := srv.Transfers()
+	if len(transfers) != 1 || transfers[0].Error == nil || transfers[0].Error.ErrCode != packets.ErrNotFound || transfers[0].Injected {
+		t.Errorf("Expected the error sent by the server, got %+v", transfers)
+	}
+}
+
+func TestInjectError(t *testing.T) {
+	srv := tftptest.NewServer(t, fstest.MapFS{"fw.bin": {Data: []byte("firmware")}})
+	srv.InjectError("fw.bin", packets.ErrDiskFull, "injected")
+
+	local := filepath.Join(t.TempDir(), "fw.bin")
+	err := client.Get(srv.Addr.String(), "fw.bin", local, time.Second)
+	var remote *client.RemoteError
+	if !errors.As(err, &remote) || remote.Code != packets.ErrDiskFull || remote.Message != "injected" {
+		t.Fatalf("Expected the injected error, got %v", err)
+	}
+
+	// only the next request fails
+	if err = client.Get(srv.Addr.String(), "fw.bin", local, time.Second); err != nil {
+		t.Fatalf("Error downloading: %v", err)
+	}
+	if data, _ := os.ReadFile(local); string(data) != "firmware" {
+		t.Errorf("Expected the file, got %q", data)
+	}
+
+	srv.Close()
+	transfers := srv.Transfers()
+	if len(transfers) != 2 || !transfers[0].Injected || transfers[1].Error != nil {
+		t.Errorf("Expected an injected error and a transfer, got %+v", transfers)
+	}
+}
+
+func TestServerOnSimulatedNetwork(t *testing.T) {
+	content := bytes.Repeat([]byte{1, 2, 3}, 1000)
+	network := netsim.NewNetwork(netsim.Config{Seed: 1, Delay: time.Millisecond})
+	srv := tftptest.NewUnstartedServer(t, fstest.MapFS{"fw.bin": {Data: content}})
+	srv.Config.Timeout = 100 * time.Millisecond
+	srv.StartSim(network)
+
+	conn, err := network.Listen("client:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	err = client.SendRequestTo(conn, packets.ReadRequest{FileName: "fw.bin", Mode: packets.OCTET}, srv.Addr)
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+
+	var downloaded bytes.Buffer
+	if err = client.NewHandler(conn, time.Second).ReadTo(&downloaded); err != nil {
+		t.Fatalf("Error downloading: %v", err)
+	}
+	if !bytes.Equal(downloaded.Bytes(), content) {
+		t.Errorf("Expected %d bytes, got %d", len(content), downloaded.Len())
+	}
+
+	srv.Close()
+	if transfers := srv.Transfers(); len(transfers) != 1 || transfers[0].Client.String() != conn.LocalAddr().String() {
+		t.Errorf("Expected a transfer with the simulated client, got %+v", transfers)
+	}
+}
+
+func TestHandlerServer(t *testing.T) {
+	srv := tftptest.NewHandlerServer(t, func(req tftptest.Request) ([]byte, error) {
+		if req.FileName != "config/"+req.Client.(*net.UDPAddr).IP.String() {
+			return nil, fs.ErrNotExist
+		}
+		return []byte("hostname switch"), nil
+	})
+
+	local := filepath.Join(t.TempDir(), "config")
+	if err := client.Get(srv.Addr.String(), "config/127.0.0.1", local, time.Second); err != nil {
+		t.Fatalf("Error downloading: %v", err)
+	}
+	if data, err := os.ReadFile(local); err != nil || string(data) != "hostname switch" {
+		t.Errorf("Expected the content of the handler, got %q (%v)", data, err)
+	}
+
+	err := client.Get(srv.Addr.String(), "config/10.0.0.1", local, time.Second)
+	var remote *client.RemoteError
+	if !errors.As(err, &remote) || remote.Code != packets.ErrNotFound {
+		t.Fatalf("Expected a not found error, got %v", err)
+	}
+
+	srv.Close()
+	transfers := srv.Transfers()
+	if len(transfers) != 2 || transfers[0].Error != nil || transfers[1].Error == nil || transfers[1].Injected {
+		t.Errorf("Expected a transfer and a refused request, got %+v", transfers)
+	}
+}
+
+func TestServerRecordsDeniedRequests(t *testing.T) {
+	content := []byte("firmware")
+	srv := tftptest.NewUnstartedServer(t, fstest.MapFS{"fw.bin": {Data: content}, "secret.bin": {Data: content}})
+	loopback := netip.MustParsePrefix("127.0.0.0/8")
+	srv.Config.ACL = server.ACL{{Network: loopback, Files: "secret.bin", Deny: true}, {Network: loopback}}
+	srv.Start()
+
+	// both requests come from one address, the denied one does not take the transfer of the next one
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for _, name := range []string{"secret.bin", "fw.bin"} {
+		if err = client.SendRequestTo(conn, packets.ReadRequest{FileName: name, Mode: packets.OCTET}, srv.Addr); err != nil {
+			t.Fatalf("Error sending request: %v", err)
+		}
+		var downloaded bytes.Buffer
+		err = client.NewHandler(conn, time.Second).ReadTo(&downloaded)
+		if name == "fw.bin" && (err != nil || !bytes.Equal(downloaded.Bytes(), content)) {
+			t.Fatalf("Expected the file, got %q (%v)", downloaded.Bytes(), err)
+		}
+	}
+
+	srv.Close()
+	transfers := srv.Transfers()
+	if len(transfers) != 2 {
+		t.Fatalf("Expected 2 transfers, got %+v", transfers)
+	}
+	denied, served := transfers[0], transfers[1]
+	if denied.Error == nil || denied.Error.ErrCode != packets.ErrAccessViolation || !denied.Done || denied.Bytes != 0 {
+		t.Errorf("Unexpected denied transfer: %+v", denied)
+	}
+	if served.FileName != "fw.bin" || served.Error != nil || served.Bytes != int64(len(content)) {
+		t.Errorf("Unexpected served transfer: %+v", served)
+	}
+}
+
+func TestTransferBytesWithRetransmissions(t *testing.T) {
+	content := bytes.Repeat([]byte{1, 2, 3}, 10*packets.BlockSize)
+	network := netsim.NewNetwork(netsim.Config{Seed: 2, Loss: 0.1})
+	srv := tftptest.NewUnstartedServer(t, fstest.MapFS{"fw.bin": {Data: content}})
+	srv.Config.Timeout = 50 * time.Millisecond
+	srv.Config.Retries = 20
+	srv.StartSim(network)
+
+	conn, err := network.Listen("client:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	req := packets.ReadRequest{FileName: "fw.bin", Mode: packets.OCTET, Options: map[string]string{packets.OptWindowSize: "4"}}
+	handler := client.NewHandler(conn, 2*time.Second)
+	handler.Request, handler.Server = req, srv.Addr
+	if err = client.SendRequestTo(conn, req, srv.Addr); err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	var downloaded bytes.Buffer
+	if err = handler.ReadTo(&downloaded); err != nil || !bytes.Equal(downloaded.Bytes(), content) {
+		t.Fatalf("Expected %d bytes, got %d (%v)", len(content), downloaded.Len(), err)
+	}
+
+	// windows sent again are not counted again
+	srv.Close()
+	transfers := srv.Transfers()
+	if len(transfers) == 0 || transfers[len(transfers)-1].Bytes != int64(len(content)) {
+		t.Errorf("Expected %d bytes, got %+v", len(content), transfers)
+	}
+}
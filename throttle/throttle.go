@@ -0,0 +1,128 @@
+// Package throttle limits rates with token buckets, e.g. the bandwidth of transfers.
+package throttle
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Bucket is a token bucket: it refills at a rate of tokens per second and holds at most a burst of them.
+// Wait takes the tokens up front, so the bucket may go into debt; the next callers wait until it is paid
+// back, which shares the rate between them in the order they come.
+type Bucket struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// NewBucket returns a full bucket of rate tokens per second that holds up to burst tokens,
+// a tenth of a second worth of them when burst is zero.
+func NewBucket(rate int64, burst int64) *Bucket {
+	if burst <= 0 {
+		burst = max(rate/10, 1)
+	}
+	return &Bucket{rate: float64(rate), burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// refill adds the tokens earned since the last call, the lock has to be held.
+func (b *Bucket) refill(now time.Time) {
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// reserve takes n tokens and returns how long to wait until they are earned.
+func (b *Bucket) reserve(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// Wait takes n tokens, it blocks until they are earned.
+func (b *Bucket) Wait(n int) {
+	if delay := b.reserve(n); delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// Allow takes n tokens if the bucket holds them and reports whether it did, it never blocks.
+func (b *Bucket) Allow(n int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	if b.tokens < float64(n) {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+// Limiter takes tokens from several buckets at once, e.g. the global, session and network limits of
+// a transfer. Nil buckets are skipped.
+type Limiter []*Bucket
+
+// Wait takes n tokens of every bucket, it blocks until the slowest one earned them.
+func (l Limiter) Wait(n int) {
+	var delay time.Duration
+	for _, b := range l {
+		if b != nil {
+			delay = max(delay, b.reserve(n))
+		}
+	}
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// Rate is a rate in bytes per second. It implements flag.Value, the value may end with k, m or g
+// for kibibytes, mebibytes or gibibytes per second, e.g. "500k".
+type Rate int64
+
+func (r *Rate) String() string {
+	if r == nil || *r == 0 {
+		return ""
+	}
+	return strconv.FormatInt(int64(*r), 10)
+}
+
+func (r *Rate) Set(value string) error {
+	parsed, err := ParseRate(value)
+	if err != nil {
+		return err
+	}
+	*r = parsed
+	return nil
+}
+
+// ParseRate reads a rate such as "1048576", "500k" or "2M".
+func ParseRate(value string) (Rate, error) {
+	invalid := errors.New("Invalid rate " + strconv.Quote(value))
+	unit := int64(1)
+	switch {
+	case strings.HasSuffix(strings.ToLower(value), "k"):
+		unit = 1 << 10
+	case strings.HasSuffix(strings.ToLower(value), "m"):
+		unit = 1 << 20
+	case strings.HasSuffix(strings.ToLower(value), "g"):
+		unit = 1 << 30
+	}
+	if unit > 1 {
+		value = value[:len(value)-1]
+	}
+
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, invalid
+	}
+	return Rate(n * unit), nil
+}
@@ -0,0 +1,85 @@
+package throttle
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBucketWait(t *testing.T) {
+	// the burst is spent at once, the rest at the rate
+	b := NewBucket(10000, 1000)
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		b.Wait(500)
+	}
+	if elapsed := time.Since(start); elapsed < 180*time.Millisecond || elapsed > time.Second {
+		t.Errorf("Expected 2000 bytes over the burst to take 200ms, took %v", elapsed)
+	}
+}
+
+func TestBucketShared(t *testing.T) {
+	b := NewBucket(20000, 0)
+	start := time.Now()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				b.Wait(200)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// 8000 bytes minus the burst of 2000 at 20000 bytes per second
+	if elapsed := time.Since(start); elapsed < 280*time.Millisecond {
+		t.Errorf("Expected the callers to share the rate, took %v", elapsed)
+	}
+}
+
+func TestBucketAllow(t *testing.T) {
+	b := NewBucket(10, 3)
+	for i := 0; i < 3; i++ {
+		if !b.Allow(1) {
+			t.Fatalf("Expected token %d of the burst", i+1)
+		}
+	}
+	if b.Allow(1) {
+		t.Errorf("Expected the bucket to be empty")
+	}
+	time.Sleep(150 * time.Millisecond)
+	if !b.Allow(1) {
+		t.Errorf("Expected the bucket to refill")
+	}
+}
+
+func TestLimiterWaitsForTheSlowest(t *testing.T) {
+	fast, slow := NewBucket(1<<30, 1), NewBucket(10000, 1)
+	start := time.Now()
+	Limiter{fast, nil, slow}.Wait(1001)
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("Expected to wait for the slow bucket, took %v", elapsed)
+	}
+}
+
+func TestParseRate(t *testing.T) {
+	for value, expected := range map[string]Rate{
+		"1000": 1000,
+		"500k": 500 << 10,
+		"2M":   2 << 20,
+		"1g":   1 << 30,
+	} {
+		if rate, err := ParseRate(value); err != nil || rate != expected {
+			t.Errorf("Expected %s to be %d, got %d (%v)", value, expected, rate, err)
+		}
+	}
+
+	for _, value := range []string{"", "k", "fast", "-5", "1.5m"} {
+		if _, err := ParseRate(value); err == nil {
+			t.Errorf("Expected %q to be rejected", value)
+		}
+	}
+}
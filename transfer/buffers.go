@@ -0,0 +1,34 @@
+package transfer
+
+import "sync"
+
+// pools holds a sync.Pool of datagram buffers for every datagram size in use, which depends on the
+// negotiated block size. A session takes its buffers from the pool and gives them back when it ends,
+// so the following sessions reuse them instead of allocating their own.
+var pools sync.Map // int → *sync.Pool
+
+func pool(size int) *sync.Pool {
+	if p, ok := pools.Load(size); ok {
+		return p.(*sync.Pool)
+	}
+	p, _ := pools.LoadOrStore(size, &sync.Pool{
+		New: func() any {
+			buf := make([]byte, size)
+			return &buf
+		},
+	})
+	return p.(*sync.Pool)
+}
+
+// getBuffer returns a buffer of size bytes.
+func getBuffer(size int) *[]byte {
+	buf := pool(size).Get().(*[]byte)
+	*buf = (*buf)[:size]
+	return buf
+}
+
+// putBuffer gives a buffer of getBuffer back, it must not be used anymore.
+func putBuffer(buf *[]byte) {
+	*buf = (*buf)[:cap(*buf)]
+	pool(len(*buf)).Put(buf)
+}
@@ -0,0 +1,200 @@
+package transfer
+
+import (
+	"TFTP/packets"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"time"
+)
+
+// Receiver receives a file block by block and acknowledges every window of blocks (RFC 1350, RFC 7440).
+//
+// Every block is written once: a block that arrives twice or out of order is not written, the last block
+// received in order is acknowledged again instead so the sender knows where to continue from. When the
+// sender does not answer in time the last ACK is sent again, it may have been lost.
+type Receiver struct {
+	Conn    net.PacketConn
+	Peer    net.Addr      // address of the sender, packets from other addresses are answered with an ERROR
+	Timeout time.Duration // how long to wait for a block before the last ACK is sent again
+	Retries int           // how many times the last ACK is sent before the transfer is given up
+	Options Options
+	Stats   Stats
+	Limit   Limiter      // limits the bandwidth of the DATA packets when set, their ACKs are held back
+	Logger  *slog.Logger // logs the timeouts and the packets of other transfers, slog.Default() when nil
+
+	// Pending is a packet that was already read from the sender, e.g. the first DATA packet
+	// that answered a read request. Receive handles it before reading from Conn.
+	Pending []byte
+
+	// Complete is called once the last block is written, before it is acknowledged, e.g. to store the
+	// received file. When it fails the sender gets an ERROR instead of the last ACK, see Error.
+	Complete func() error
+
+	// Progress is called with what is added to Stats as the transfer goes, a block or a retransmission at
+	// a time, e.g. to count the transfers that are still running. The Duration is only added to Stats.
+	Progress func(delta Stats)
+
+	peer   *peer
+	block  uint16  // number of the last block received in order
+	last   []byte  // last packet sent, sent again when the sender does not answer
+	ackBuf [4]byte // the ACKs are encoded into it
+}
+
+func (r *Receiver) init() {
+	if r.peer == nil {
+		r.peer = newPeer(r.Conn, r.Peer, r.Logger)
+	}
+}
+
+// acquire takes the buffer packets are read into from the pool. A packet one byte longer
+// than a full block is recognized as oversized.
+func (r *Receiver) acquire() {
+	r.peer.acquire(4 + r.Options.blockSize() + 1)
+}
+
+// Acknowledge accepts the transfer: the accepted options are sent in an OACK, without options block 0 is
+// acknowledged (RFC 2347). It is sent again when the first block does not arrive in time.
+func (r *Receiver) Acknowledge(options map[string]string) error {
+	r.init()
+	if len(options) > 0 {
+		r.last = packets.AppendOptionAck(nil, options)
+	} else {
+		r.last = packets.AppendAck(r.ackBuf[:0], 0)
+	}
+	return r.peer.write(r.last)
+}
+
+// Receive writes the data of every block to w, up to the block shorter than the block size that ends the
+// transfer. The last ACK is sent before Receive returns.
+func (r *Receiver) Receive(w io.Writer) error {
+	r.init()
+	r.acquire()
+	defer r.peer.release()
+	start := time.Now()
+	defer func() { r.Stats.Duration += time.Since(start) }()
+
+	var (
+		blockSize = r.Options.blockSize()
+		received  int // blocks received since the last ACK
+		attempt   int
+	)
+
+	for {
+		packet := r.Pending
+		r.Pending = nil
+		if packet == nil {
+			var err error
+			packet, err = r.peer.read(time.Now().Add(r.Timeout))
+			if err != nil {
+				return err
+			}
+		}
+
+		if packet == nil {
+			attempt++
+			r.Stats.count(Stats{Timeouts: 1}, r.Progress)
+			if attempt >= r.Retries {
+				return fmt.Errorf("%w for: %s", ErrTimeout, r.Peer)
+			}
+			r.peer.log.Warn("timeout waiting for DATA", "block", r.block+1, "attempt", attempt)
+			err := r.resend()
+			if err != nil {
+				return err
+			}
+			received = 0
+			continue
+		}
+
+		switch opcode(packet) {
+		case packets.DATA:
+			if len(packet) > 4+blockSize {
+				return r.peer.illegal(packet)
+			}
+			if r.Limit != nil {
+				r.Limit.Wait(len(packet))
+			}
+
+			if blockNumber(packet) != r.block+1 {
+				// a retransmitted block, or a block after a lost one
+				r.Stats.count(Stats{Duplicates: 1}, r.Progress)
+				err := r.ack()
+				if err != nil {
+					return err
+				}
+				received = 0
+				continue
+			}
+
+			_, err := w.Write(packet[4:])
+			if err != nil {
+				r.peer.sendError(errorCode(err), err.Error())
+				return err
+			}
+			attempt = 0
+			r.block++
+			r.Stats.count(Stats{Blocks: 1, Bytes: int64(len(packet) - 4)}, r.Progress)
+			received++
+
+			done := len(packet) < 4+blockSize
+			if done && r.Complete != nil {
+				err = r.Complete()
+				if err != nil {
+					r.peer.sendError(errorCode(err), err.Error())
+					return err
+				}
+			}
+			if done || received == r.Options.windowSize() {
+				err = r.ack()
+				if err != nil {
+					return err
+				}
+				received = 0
+			}
+			if done {
+				return nil
+			}
+
+		case packets.ERROR:
+			return remoteError(packet)
+
+		default:
+			return r.peer.illegal(packet)
+		}
+	}
+}
+
+// Dally waits for the sender to retransmit the last block in case the last ACK was lost, and acknowledges
+// it again (RFC 1350). It returns once the sender stayed quiet for twice the Timeout, the sender may wait
+// longer than the receiver before it retransmits.
+func (r *Receiver) Dally() {
+	r.init()
+	r.acquire()
+	defer r.peer.release()
+	for {
+		packet, err := r.peer.read(time.Now().Add(2 * r.Timeout))
+		if packet == nil || err != nil {
+			return
+		}
+		if opcode(packet) == packets.DATA && blockNumber(packet) == r.block {
+			r.Stats.count(Stats{Duplicates: 1}, r.Progress)
+			_ = r.resend()
+		}
+	}
+}
+
+// ack acknowledges the last block received in order.
+func (r *Receiver) ack() error {
+	r.last = packets.AppendAck(r.ackBuf[:0], r.block)
+	return r.peer.write(r.last)
+}
+
+// resend sends the last packet again, the ACK of block 0 when nothing was sent yet.
+func (r *Receiver) resend() error {
+	if r.last == nil {
+		r.last = packets.AppendAck(r.ackBuf[:0], r.block)
+	}
+	r.Stats.count(Stats{Retransmits: 1}, r.Progress)
+	return r.peer.write(r.last)
+}
@@ -0,0 +1,163 @@
+package transfer
+
+import (
+	"TFTP/netsim"
+	"TFTP/packets"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func receiverPair(t *testing.T) (*Receiver, *netsim.PacketConn) {
+	t.Helper()
+	network := netsim.NewNetwork(netsim.Config{})
+	conn, err := network.Listen("receiver:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := network.Listen("sender:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		peer.Close()
+	})
+	return &Receiver{Conn: conn, Peer: peer.LocalAddr(), Timeout: 20 * time.Millisecond, Retries: 3}, peer
+}
+
+// expectAck reads the next packet of the receiver, it has to be the ACK of block.
+func expectAck(t *testing.T, conn *netsim.PacketConn, block uint16) {
+	t.Helper()
+	buf := make([]byte, packets.DatagramSize)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil || !bytes.Equal(buf[:n], packets.AppendAck(nil, block)) {
+		t.Fatalf("Expected ACK %d, got %v (%v)", block, buf[:n], err)
+	}
+}
+
+func data(block uint16, payload []byte) []byte {
+	return packets.AppendData(nil, block, payload)
+}
+
+func TestReceiverDuplicates(t *testing.T) {
+	receiver, peer := receiverPair(t)
+	full := bytes.Repeat([]byte("x"), packets.BlockSize)
+
+	var received bytes.Buffer
+	result := make(chan error, 1)
+	go func() { result <- receiver.Receive(&received) }()
+
+	// the duplicate and the block from the future are acknowledged with the last block received in order
+	peer.WriteTo(data(1, full), receiver.Conn.LocalAddr())
+	expectAck(t, peer, 1)
+	peer.WriteTo(data(1, full), receiver.Conn.LocalAddr())
+	expectAck(t, peer, 1)
+	peer.WriteTo(data(3, []byte("future")), receiver.Conn.LocalAddr())
+	expectAck(t, peer, 1)
+	peer.WriteTo(data(2, []byte("end")), receiver.Conn.LocalAddr())
+	expectAck(t, peer, 2)
+
+	if err := <-result; err != nil {
+		t.Fatalf("Error receiving: %v", err)
+	}
+	if expected := append(full, "end"...); !bytes.Equal(received.Bytes(), expected) {
+		t.Errorf("Expected every block once, got %d bytes", received.Len())
+	}
+	if receiver.Stats.Duplicates != 2 || receiver.Stats.Blocks != 2 {
+		t.Errorf("Unexpected statistics: %+v", receiver.Stats)
+	}
+}
+
+func TestReceiverTimeout(t *testing.T) {
+	receiver, peer := receiverPair(t)
+	if err := receiver.Acknowledge(map[string]string{packets.OptTransferSize: "8"}); err != nil {
+		t.Fatal(err)
+	}
+
+	err := receiver.Receive(&bytes.Buffer{})
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatalf("Expected ErrTimeout, got %v", err)
+	}
+
+	// the OACK is sent again until the receiver gives up
+	buf := make([]byte, packets.DatagramSize)
+	for i := 0; i < receiver.Retries; i++ {
+		peer.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := peer.ReadFrom(buf)
+		if err != nil || opcode(buf[:n]) != packets.OACK {
+			t.Fatalf("Expected OACK %d, got %v (%v)", i+1, buf[:n], err)
+		}
+	}
+}
+
+func TestReceiverOversizedBlock(t *testing.T) {
+	receiver, peer := receiverPair(t)
+	receiver.Options.BlockSize = 16
+	receiver.Pending = data(1, make([]byte, 17))
+
+	if err := receiver.Receive(&bytes.Buffer{}); err == nil {
+		t.Fatalf("Expected an error")
+	}
+
+	var errorPacket packets.Error
+	buf := make([]byte, packets.DatagramSize)
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := peer.ReadFrom(buf)
+	if err != nil || errorPacket.UnmarshalBinary(buf[:n]) != nil || errorPacket.ErrCode != packets.ErrIllegalOp {
+		t.Errorf("Expected an illegal operation error, got %v (%v)", buf[:n], err)
+	}
+}
+
+// BenchmarkReceiver receives a block per iteration from a peer that sends the next one instantly.
+// The blocks are read into a pooled buffer and decoded in place, so no allocation is made per block.
+func BenchmarkReceiver(b *testing.B) {
+	var (
+		blocks  int
+		payload = make([]byte, packets.BlockSize)
+	)
+	conn := &fakeConn{peer: fakePeer, sent: func([]byte) {}}
+	conn.reply = func(buf []byte) int {
+		blocks++
+		if blocks > b.N {
+			// the last block is empty
+			return len(packets.AppendData(buf[:0], uint16(blocks), nil))
+		}
+		return len(packets.AppendData(buf[:0], uint16(blocks), payload))
+	}
+
+	receiver := &Receiver{Conn: conn, Peer: net.UDPAddrFromAddrPort(fakePeer), Timeout: time.Second, Retries: 1}
+	b.ReportAllocs()
+	b.SetBytes(packets.BlockSize)
+	b.ResetTimer()
+	if err := receiver.Receive(io.Discard); err != nil {
+		b.Fatal(err)
+	}
+	if receiver.Stats.Bytes != int64(b.N)*packets.BlockSize {
+		b.Fatalf("Expected %d blocks, got %+v", b.N, receiver.Stats)
+	}
+}
+
+func TestReceiverCompleteFails(t *testing.T) {
+	receiver, peer := receiverPair(t)
+	receiver.Complete = func() error { return errors.New("Cannot store file") }
+
+	result := make(chan error, 1)
+	go func() { result <- receiver.Receive(io.Discard) }()
+
+	// the last block is answered with the error instead of an ACK
+	peer.WriteTo(data(1, []byte("end")), receiver.Conn.LocalAddr())
+	buf := make([]byte, packets.DatagramSize)
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := peer.ReadFrom(buf)
+	if err != nil || opcode(buf[:n]) != packets.ERROR {
+		t.Fatalf("Expected an ERROR, got %v (%v)", buf[:n], err)
+	}
+	if err = <-result; err == nil {
+		t.Errorf("Expected the error of Complete")
+	}
+}
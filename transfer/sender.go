@@ -0,0 +1,235 @@
+package transfer
+
+import (
+	"TFTP/packets"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"time"
+)
+
+// Sender sends a file block by block, a window of blocks is only sent once the previous one was acknowledged
+// (RFC 1350, RFC 7440).
+//
+// Blocks are only sent again when their ACK does not arrive in time. Duplicate ACKs are ignored,
+// answering them would send every following block twice (the Sorcerer's Apprentice syndrome).
+type Sender struct {
+	Conn    net.PacketConn
+	Peer    net.Addr      // address of the receiver, packets from other addresses are answered with an ERROR
+	Timeout time.Duration // how long to wait for an ACK before the window is sent again
+	Retries int           // how many times a window is sent before the transfer is given up
+	Options Options
+	Stats   Stats
+	Limit   Limiter      // limits the bandwidth of the DATA packets, retransmissions included, when set
+	Logger  *slog.Logger // logs the timeouts and the packets of other transfers, slog.Default() when nil
+
+	// Unverified is how many bytes of new packets may be sent before the receiver acknowledges a packet,
+	// which proves that the request came from its address, no limit when zero. It keeps a spoofed request
+	// from turning the sender into a reflector. The packets sent are retransmitted as usual, a lost one does
+	// not fail the transfer, but nothing more is sent and the transfer is given up with ErrUnverified.
+	Unverified int
+
+	// Progress is called with what is added to Stats as the transfer goes, a block or a retransmission at
+	// a time, e.g. to count the transfers that are still running. The Duration is only added to Stats.
+	Progress func(delta Stats)
+
+	peer     *peer
+	block    uint16 // number of the last block acknowledged
+	verified bool   // the receiver acknowledged a packet
+	sent     int    // bytes of new packets sent before the receiver acknowledged a packet
+}
+
+func (s *Sender) init() {
+	if s.peer == nil {
+		s.peer = newPeer(s.Conn, s.Peer, s.Logger)
+	}
+}
+
+// SendOptionAck sends the accepted options and waits for the ACK of block 0 that confirms them (RFC 2347).
+func (s *Sender) SendOptionAck(options map[string]string) error {
+	s.init()
+	s.peer.acquire(packets.DatagramSize)
+	defer s.peer.release()
+	oack := packets.AppendOptionAck(nil, options)
+
+	// the OACK takes the place of block 0, the block before the first one
+	s.block--
+	defer func() { s.block++ }()
+
+	for attempt := 0; attempt < s.Retries; attempt++ {
+		// the OACK sent again was already counted
+		if attempt == 0 && !s.mayWrite(len(oack)) {
+			return fmt.Errorf("%w: %s", ErrUnverified, s.Peer)
+		}
+		err := s.peer.write(oack)
+		if err != nil {
+			return err
+		}
+
+		acked, err := s.waitAck(1, time.Now().Add(s.Timeout))
+		if err != nil || acked > 0 {
+			return err
+		}
+		s.Stats.count(Stats{Timeouts: 1}, s.Progress)
+	}
+
+	return s.giveUp()
+}
+
+// Send sends everything read from r, up to the block shorter than the block size that ends the transfer.
+// Only the blocks of the current window are kept in memory, in buffers of a pool shared by the transfers.
+func (s *Sender) Send(r io.Reader) error {
+	s.init()
+	s.peer.acquire(packets.DatagramSize)
+	defer s.peer.release()
+	start := time.Now()
+	defer func() { s.Stats.Duration += time.Since(start) }()
+
+	var (
+		blockSize = s.Options.blockSize()
+		window    []*[]byte // packets not acknowledged yet, the first one is block s.block+1
+		unsent    int       // index of the first packet of the window that was not sent yet
+		written   int       // packets of the window sent at least once, the others are new
+		done      bool      // the last block was read
+		attempt   int
+	)
+	defer func() {
+		for _, packet := range window {
+			putBuffer(packet)
+		}
+	}()
+
+	for {
+		for !done && len(window) < s.Options.windowSize() {
+			packet, err := s.readBlock(r, s.block+1+uint16(len(window)), blockSize)
+			if err != nil {
+				s.peer.sendError(packets.ErrUnknown, "Cannot read file")
+				return err
+			}
+			window = append(window, packet)
+			done = len(*packet) < 4+blockSize
+		}
+
+		if len(window) == 0 {
+			return nil
+		}
+
+		sending := unsent
+		for ; unsent < len(window); unsent++ {
+			if unsent >= written {
+				if !s.mayWrite(len(*window[unsent])) {
+					break
+				}
+				written = unsent + 1
+			}
+			if s.Limit != nil {
+				s.Limit.Wait(len(*window[unsent]))
+			}
+			err := s.peer.write(*window[unsent])
+			if err != nil {
+				return err
+			}
+		}
+
+		if unsent == sending {
+			// nothing more may be sent before the receiver acknowledges
+			return fmt.Errorf("%w: %s", ErrUnverified, s.Peer)
+		}
+
+		acked, err := s.waitAck(unsent, time.Now().Add(s.Timeout))
+		if err != nil {
+			return err
+		}
+
+		if acked == 0 {
+			attempt++
+			s.Stats.count(Stats{Timeouts: 1}, s.Progress)
+			if attempt >= s.Retries {
+				return s.giveUp()
+			}
+			s.peer.log.Warn("timeout waiting for ACK", "block", s.block+uint16(len(window)), "attempt", attempt)
+			s.Stats.count(Stats{Retransmits: len(window)}, s.Progress)
+			unsent = 0
+			continue
+		}
+
+		acknowledged := Stats{Blocks: acked}
+		for _, packet := range window[:acked] {
+			acknowledged.Bytes += int64(len(*packet) - 4)
+			putBuffer(packet)
+		}
+		s.Stats.count(acknowledged, s.Progress)
+		attempt = 0
+		s.block += uint16(acked)
+		// moved to the front, so the window does not grow into new memory
+		window = append(window[:0], window[acked:]...)
+		written = max(written-acked, 0)
+		// an ACK inside the window means the blocks after it were lost, they are sent again (RFC 7440)
+		s.Stats.count(Stats{Retransmits: len(window)}, s.Progress)
+		unsent = 0
+	}
+}
+
+// giveUp returns the error of a transfer whose receiver did not answer in time, ErrUnverified when it
+// never acknowledged anything while Unverified limited what was sent.
+func (s *Sender) giveUp() error {
+	if !s.verified && s.Unverified > 0 {
+		return fmt.Errorf("%w: %s", ErrUnverified, s.Peer)
+	}
+	return fmt.Errorf("%w for: %s", ErrTimeout, s.Peer)
+}
+
+// mayWrite tells whether a new packet of n bytes may be sent to the receiver, see Unverified.
+// Packets sent again are not counted twice.
+func (s *Sender) mayWrite(n int) bool {
+	if s.verified || s.Unverified <= 0 {
+		return true
+	}
+	if s.sent+n > s.Unverified {
+		return false
+	}
+	s.sent += n
+	return true
+}
+
+// readBlock reads the next block from r into a buffer of the pool and returns its DATA packet.
+func (s *Sender) readBlock(r io.Reader, block uint16, blockSize int) (*[]byte, error) {
+	packet := getBuffer(4 + blockSize)
+	packets.AppendData((*packet)[:0], block, nil)
+	n, err := io.ReadFull(r, (*packet)[4:])
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		putBuffer(packet)
+		return nil, err
+	}
+	*packet = (*packet)[:4+n]
+	return packet, nil
+}
+
+// waitAck reads packets until an ACK of one of the size blocks after s.block arrives and returns how many
+// blocks it acknowledged. It returns 0 when the deadline expires first.
+func (s *Sender) waitAck(size int, deadline time.Time) (int, error) {
+	for {
+		packet, err := s.peer.read(deadline)
+		if packet == nil || err != nil {
+			return 0, err
+		}
+
+		switch opcode(packet) {
+		case packets.ACK:
+			// block numbers roll over, the distance to the last acknowledged block tells whether it is new
+			acked := int(blockNumber(packet) - s.block)
+			if acked >= 1 && acked <= size {
+				s.verified = true
+				return acked, nil
+			}
+			s.Stats.count(Stats{Duplicates: 1}, s.Progress)
+
+		case packets.ERROR:
+			return 0, remoteError(packet)
+
+		default:
+			return 0, s.peer.illegal(packet)
+		}
+	}
+}
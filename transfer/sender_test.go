@@ -0,0 +1,128 @@
+package transfer
+
+import (
+	"TFTP/netsim"
+	"TFTP/packets"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func senderPair(t *testing.T) (*Sender, *netsim.PacketConn) {
+	t.Helper()
+	network := netsim.NewNetwork(netsim.Config{})
+	conn, err := network.Listen("sender:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := network.Listen("receiver:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		peer.Close()
+	})
+	return &Sender{Conn: conn, Peer: peer.LocalAddr(), Timeout: 20 * time.Millisecond, Retries: 3}, peer
+}
+
+func TestSenderGivesUp(t *testing.T) {
+	sender, peer := senderPair(t)
+
+	err := sender.Send(bytes.NewReader([]byte("firmware")))
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatalf("Expected ErrTimeout, got %v", err)
+	}
+
+	// the block was sent Retries times
+	buf := make([]byte, packets.DatagramSize)
+	for i := 0; i < sender.Retries; i++ {
+		peer.SetReadDeadline(time.Now().Add(time.Second))
+		if _, _, err = peer.ReadFrom(buf); err != nil {
+			t.Fatalf("Expected attempt %d, got %v", i+1, err)
+		}
+	}
+	peer.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, _, err = peer.ReadFrom(buf); err == nil {
+		t.Errorf("Expected no more attempts")
+	}
+}
+
+func TestSenderProgress(t *testing.T) {
+	sender, _ := senderPair(t)
+	var progress Stats
+	sender.Progress = func(delta Stats) { progress.count(delta, nil) }
+
+	// nothing is acknowledged, the timeouts and retransmissions are reported as they happen
+	err := sender.Send(bytes.NewReader([]byte("firmware")))
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatalf("Expected ErrTimeout, got %v", err)
+	}
+	progress.Duration = sender.Stats.Duration
+	if progress != sender.Stats || progress.Timeouts == 0 || progress.Retransmits == 0 {
+		t.Errorf("Expected the progress to add up to %+v, got %+v", sender.Stats, progress)
+	}
+}
+
+func TestSenderUnverified(t *testing.T) {
+	sender, peer := senderPair(t)
+	sender.Unverified = 4 + packets.BlockSize
+	sender.Options.WindowSize = 3
+
+	err := sender.Send(bytes.NewReader(make([]byte, 3*packets.BlockSize)))
+	if !errors.Is(err, ErrUnverified) {
+		t.Fatalf("Expected ErrUnverified, got %v", err)
+	}
+
+	// only the first block of the window was sent, again after every timeout
+	buf := make([]byte, packets.DatagramSize)
+	for i := 0; i < sender.Retries; i++ {
+		peer.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := peer.ReadFrom(buf)
+		if err != nil || binary.BigEndian.Uint16(buf[2:n]) != 1 {
+			t.Fatalf("Expected attempt %d of the first block, got %v %v", i+1, buf[:4], err)
+		}
+	}
+	peer.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, _, err = peer.ReadFrom(buf); err == nil {
+		t.Errorf("Expected nothing more")
+	}
+}
+
+func TestSenderRemoteError(t *testing.T) {
+	sender, peer := senderPair(t)
+	go func() {
+		buf := make([]byte, packets.DatagramSize)
+		_, addr, err := peer.ReadFrom(buf)
+		if err == nil {
+			SendError(peer, addr, packets.ErrDiskFull, "Disk full")
+		}
+	}()
+
+	err := sender.Send(bytes.NewReader([]byte("firmware")))
+	var remote *RemoteError
+	if !errors.As(err, &remote) || remote.Code != packets.ErrDiskFull {
+		t.Errorf("Expected the error of the receiver, got %v", err)
+	}
+}
+
+// BenchmarkSender sends a block per iteration to a peer that acknowledges it instantly.
+// The blocks are read into pooled buffers, so no allocation is made per block.
+func BenchmarkSender(b *testing.B) {
+	var last uint16
+	conn := &fakeConn{peer: fakePeer}
+	conn.sent = func(packet []byte) { last = binary.BigEndian.Uint16(packet[2:]) }
+	conn.reply = func(buf []byte) int { return len(packets.AppendAck(buf[:0], last)) }
+
+	sender := &Sender{Conn: conn, Peer: net.UDPAddrFromAddrPort(fakePeer), Timeout: time.Second, Retries: 1}
+	b.ReportAllocs()
+	b.SetBytes(packets.BlockSize)
+	b.ResetTimer()
+	if err := sender.Send(io.LimitReader(zeros{}, int64(b.N)*packets.BlockSize)); err != nil {
+		b.Fatal(err)
+	}
+}
@@ -0,0 +1,319 @@
+// Package transfer implements the state machines that move a file between two TFTP peers,
+// shared by the client and the server.
+//
+// A Sender and a Receiver talk over a net.PacketConn with a single peer, packets from other
+// addresses are answered with an ERROR and otherwise ignored (RFC 1350). Block numbers roll over
+// from 65535 to 0, so files of any size can be transferred.
+package transfer
+
+import (
+	"TFTP/packets"
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strconv"
+	"time"
+)
+
+const (
+	MinBlockSize  = 8     // smallest block size of the blksize option (RFC 2348)
+	MaxBlockSize  = 65464 // largest block size of the blksize option (RFC 2348)
+	MaxWindowSize = 64    // largest window accepted by Negotiate, it bounds the memory of a transfer
+)
+
+// ErrTimeout is returned when the peer did not answer a packet sent Retries times.
+var ErrTimeout = errors.New("Max retries reached")
+
+// ErrUnverified is returned by a Sender when the receiver did not acknowledge anything it was sent
+// while its Unverified bytes were limited, the request that started the transfer may have had a spoofed address.
+var ErrUnverified = errors.New("No ACK from an unverified peer")
+
+// RemoteError is returned when the peer aborts a transfer with an ERROR packet.
+type RemoteError struct {
+	Code    packets.ErrCode
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return "Received ERROR packet: " + e.Message
+}
+
+// LogValue logs the code of the ERROR packet along with its message.
+func (e *RemoteError) LogValue() slog.Value {
+	return slog.GroupValue(slog.Any("code", e.Code), slog.String("message", e.Message))
+}
+
+// Error aborts a transfer with the code of the ERROR packet sent to the peer, e.g. an io.Writer passed
+// to Receive returns it when there is no room for the file. Other errors are sent with ErrUnknown.
+type Error struct {
+	Code    packets.ErrCode
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// errorCode returns the code of the ERROR packet that reports err.
+func errorCode(err error) packets.ErrCode {
+	var transferErr *Error
+	if errors.As(err, &transferErr) {
+		return transferErr.Code
+	}
+	return packets.ErrUnknown
+}
+
+// Limiter limits the bandwidth of a transfer, Wait blocks until n more bytes may be sent or received.
+// See the throttle package.
+type Limiter interface {
+	Wait(n int)
+}
+
+// Options are the parameters of a transfer that can be negotiated.
+type Options struct {
+	BlockSize  int // bytes of data in a DATA packet, packets.BlockSize when zero
+	WindowSize int // DATA packets sent before waiting for an ACK, 1 when zero
+}
+
+func (o Options) blockSize() int {
+	if o.BlockSize == 0 {
+		return packets.BlockSize
+	}
+	return o.BlockSize
+}
+
+func (o Options) windowSize() int {
+	if o.WindowSize == 0 {
+		return 1
+	}
+	return o.WindowSize
+}
+
+// Negotiate picks the options of a transfer from the ones requested by the client and adds the
+// accepted ones to accepted, which is sent back in the OACK. Values above the limits are lowered,
+// invalid ones are left out so the defaults apply (RFC 2347).
+func Negotiate(requested map[string]string, accepted map[string]string) Options {
+	var options Options
+
+	if size, err := strconv.Atoi(requested[packets.OptBlockSize]); err == nil && size >= MinBlockSize {
+		options.BlockSize = min(size, MaxBlockSize)
+		accepted[packets.OptBlockSize] = strconv.Itoa(options.BlockSize)
+	}
+
+	if size, err := strconv.Atoi(requested[packets.OptWindowSize]); err == nil && size >= 1 {
+		options.WindowSize = min(size, MaxWindowSize)
+		accepted[packets.OptWindowSize] = strconv.Itoa(options.WindowSize)
+	}
+
+	return options
+}
+
+// ParseOptionAck returns the options the server accepted in its OACK.
+func ParseOptionAck(accepted map[string]string) (Options, error) {
+	var options Options
+
+	if value, ok := accepted[packets.OptBlockSize]; ok {
+		size, err := strconv.Atoi(value)
+		if err != nil || size < MinBlockSize || size > MaxBlockSize {
+			return options, errors.New("Invalid block size")
+		}
+		options.BlockSize = size
+	}
+
+	if value, ok := accepted[packets.OptWindowSize]; ok {
+		size, err := strconv.Atoi(value)
+		if err != nil || size < 1 || size > 65535 {
+			return options, errors.New("Invalid window size")
+		}
+		options.WindowSize = size
+	}
+
+	return options, nil
+}
+
+// Stats describes what happened during a transfer.
+type Stats struct {
+	Blocks      int           // blocks sent or received, without duplicates
+	Bytes       int64         // bytes of data sent or received, without duplicates
+	Retransmits int           // packets sent again after a timeout
+	Duplicates  int           // packets that arrived twice or out of order and were ignored
+	Timeouts    int           // times the peer did not answer in time
+	Duration    time.Duration // time from the first packet to the end of the transfer
+}
+
+// LogValue logs the stats as a group of attributes.
+func (s Stats) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.Int("blocks", s.Blocks),
+		slog.Int64("bytes", s.Bytes),
+		slog.Int("retransmits", s.Retransmits),
+		slog.Int("duplicates", s.Duplicates),
+		slog.Int("timeouts", s.Timeouts),
+		slog.Duration("duration", s.Duration),
+	)
+}
+
+// count adds delta to the stats and passes it to progress, when it is set and something changed.
+func (s *Stats) count(delta Stats, progress func(delta Stats)) {
+	s.Blocks += delta.Blocks
+	s.Bytes += delta.Bytes
+	s.Retransmits += delta.Retransmits
+	s.Duplicates += delta.Duplicates
+	s.Timeouts += delta.Timeouts
+	if progress != nil && delta != (Stats{}) {
+		progress(delta)
+	}
+}
+
+// SendError sends an ERROR packet, failures are only logged since the transfer is aborted anyway.
+func SendError(conn net.PacketConn, addr net.Addr, code packets.ErrCode, message string) {
+	sendError(slog.Default(), conn, addr, code, message)
+}
+
+func sendError(logger *slog.Logger, conn net.PacketConn, addr net.Addr, code packets.ErrCode, message string) {
+	_, err := conn.WriteTo(packets.AppendError(nil, code, message), addr)
+	if err != nil {
+		logger.Warn("sending the ERROR packet failed", "code", code, "error", err)
+		return
+	}
+	logger.Debug("ERROR sent", "code", code, "message", message)
+}
+
+// UDPConn is implemented by *net.UDPConn, its methods pass addresses without allocating them.
+// The Sender and the Receiver use them when their Conn implements it, a wrapper of a UDP socket should too.
+type UDPConn interface {
+	ReadFromUDPAddrPort(b []byte) (int, netip.AddrPort, error)
+	WriteToUDPAddrPort(b []byte, addr netip.AddrPort) (int, error)
+}
+
+// peer holds what the Sender and the Receiver share: the socket and the address of the peer.
+type peer struct {
+	conn net.PacketConn
+	addr net.Addr
+	buf  *[]byte // packets are read into it, it comes from the pool while a transfer runs
+	log  *slog.Logger
+
+	udp     UDPConn        // conn when it is a UDP socket, packets are then sent and read without allocating
+	udpAddr netip.AddrPort // addr when conn is a UDP socket
+}
+
+func newPeer(conn net.PacketConn, addr net.Addr, logger *slog.Logger) *peer {
+	if logger == nil {
+		logger = slog.Default().With("peer", addr.String())
+	}
+	p := &peer{conn: conn, addr: addr, log: logger}
+	if udp, ok := conn.(UDPConn); ok {
+		if addr, ok := addr.(*net.UDPAddr); ok {
+			p.udp, p.udpAddr = udp, unmap(addr.AddrPort())
+		}
+	}
+	return p
+}
+
+// acquire takes a buffer of at least size bytes from the pool, release gives it back.
+func (p *peer) acquire(size int) {
+	if p.buf != nil && len(*p.buf) >= size {
+		return
+	}
+	p.release()
+	p.buf = getBuffer(size)
+}
+
+func (p *peer) release() {
+	if p.buf != nil {
+		putBuffer(p.buf)
+		p.buf = nil
+	}
+}
+
+// read returns the next packet of the peer, it returns nil when the deadline expires first.
+// Packets from other addresses belong to other transfers, they are answered with an ERROR.
+func (p *peer) read(deadline time.Time) ([]byte, error) {
+	buf := *p.buf
+	for {
+		err := p.conn.SetReadDeadline(deadline)
+		if err != nil {
+			return nil, err
+		}
+
+		n, stranger, err := p.readFrom(buf)
+		if err != nil {
+			if nErr, ok := err.(net.Error); ok && nErr.Timeout() {
+				return nil, nil
+			}
+			return nil, err
+		}
+
+		if stranger != nil {
+			p.log.Warn("packet from an unknown transfer", "stranger", stranger.String())
+			sendError(p.log, p.conn, stranger, packets.ErrUnknownID, "Unknown transfer ID")
+			continue
+		}
+
+		if n < 4 {
+			return buf[:n], p.illegal(buf[:n])
+		}
+		return buf[:n], nil
+	}
+}
+
+// readFrom reads a packet into buf, stranger is the address it came from when it is not the peer.
+func (p *peer) readFrom(buf []byte) (n int, stranger net.Addr, err error) {
+	if p.udp != nil {
+		n, addr, err := p.udp.ReadFromUDPAddrPort(buf)
+		if err == nil && unmap(addr) != p.udpAddr {
+			stranger = net.UDPAddrFromAddrPort(addr)
+		}
+		return n, stranger, err
+	}
+
+	n, addr, err := p.conn.ReadFrom(buf)
+	if err == nil && addr.String() != p.addr.String() {
+		stranger = addr
+	}
+	return n, stranger, err
+}
+
+func (p *peer) write(packet []byte) error {
+	var err error
+	if p.udp != nil {
+		_, err = p.udp.WriteToUDPAddrPort(packet, p.udpAddr)
+	} else {
+		_, err = p.conn.WriteTo(packet, p.addr)
+	}
+	return err
+}
+
+func (p *peer) sendError(code packets.ErrCode, message string) {
+	sendError(p.log, p.conn, p.addr, code, message)
+}
+
+// illegal aborts the transfer because of a packet that does not belong to it.
+func (p *peer) illegal(packet []byte) error {
+	p.sendError(packets.ErrIllegalOp, "Illegal TFTP operation")
+	return errors.New("Illegal packet received")
+}
+
+// unmap returns the IPv4 form of an IPv4-mapped IPv6 address, sockets report IPv4 peers in both forms.
+func unmap(addr netip.AddrPort) netip.AddrPort {
+	return netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+}
+
+// remoteError returns the error of an ERROR packet.
+func remoteError(packet []byte) error {
+	code, message, err := packets.ParseError(packet)
+	if err != nil {
+		return err
+	}
+	return &RemoteError{Code: code, Message: message}
+}
+
+func opcode(packet []byte) packets.OpCode {
+	return packets.OpCode(binary.BigEndian.Uint16(packet))
+}
+
+func blockNumber(packet []byte) uint16 {
+	return binary.BigEndian.Uint16(packet[2:])
+}
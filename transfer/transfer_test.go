@@ -0,0 +1,170 @@
+package transfer
+
+import (
+	"TFTP/netsim"
+	"TFTP/packets"
+	"bytes"
+	"math/rand"
+	"net"
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNegotiate(t *testing.T) {
+	for _, test := range []struct {
+		requested map[string]string
+		options   Options
+		accepted  map[string]string
+	}{
+		{nil, Options{}, map[string]string{}},
+		{
+			map[string]string{packets.OptBlockSize: "1428", packets.OptWindowSize: "8"},
+			Options{BlockSize: 1428, WindowSize: 8},
+			map[string]string{packets.OptBlockSize: "1428", packets.OptWindowSize: "8"},
+		},
+		{
+			map[string]string{packets.OptBlockSize: "100000", packets.OptWindowSize: "1000"},
+			Options{BlockSize: MaxBlockSize, WindowSize: MaxWindowSize},
+			map[string]string{packets.OptBlockSize: "65464", packets.OptWindowSize: "64"},
+		},
+		{
+			map[string]string{packets.OptBlockSize: "4", packets.OptWindowSize: "many"},
+			Options{},
+			map[string]string{},
+		},
+	} {
+		accepted := make(map[string]string)
+		options := Negotiate(test.requested, accepted)
+		if options != test.options || !reflect.DeepEqual(accepted, test.accepted) {
+			t.Errorf("Negotiate(%v) = %+v, %v, expected %+v, %v", test.requested, options, accepted, test.options, test.accepted)
+		}
+	}
+}
+
+func TestParseOptionAck(t *testing.T) {
+	options, err := ParseOptionAck(map[string]string{packets.OptBlockSize: "1024", packets.OptWindowSize: "4", packets.OptTransferSize: "10"})
+	if err != nil || options != (Options{BlockSize: 1024, WindowSize: 4}) {
+		t.Errorf("Expected the accepted options, got %+v (%v)", options, err)
+	}
+
+	for _, accepted := range []map[string]string{
+		{packets.OptBlockSize: "70000"},
+		{packets.OptBlockSize: "big"},
+		{packets.OptWindowSize: "0"},
+	} {
+		if _, err = ParseOptionAck(accepted); err == nil {
+			t.Errorf("Expected an error for %v", accepted)
+		}
+	}
+}
+
+// transferOver sends content from a Sender to a Receiver over a network with cfg and returns what was received.
+func transferOver(t *testing.T, cfg netsim.Config, options Options, content []byte) (*Sender, *Receiver, []byte) {
+	t.Helper()
+	network := netsim.NewNetwork(cfg)
+	senderConn, err := network.Listen("sender:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiverConn, err := network.Listen("receiver:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer senderConn.Close()
+	defer receiverConn.Close()
+
+	timeout := 20 * time.Millisecond
+	sender := &Sender{Conn: senderConn, Peer: receiverConn.LocalAddr(), Timeout: timeout, Retries: 20, Options: options}
+	receiver := &Receiver{Conn: receiverConn, Peer: senderConn.LocalAddr(), Timeout: timeout, Retries: 20, Options: options}
+
+	sent := make(chan error, 1)
+	go func() { sent <- sender.Send(bytes.NewReader(content)) }()
+
+	var received bytes.Buffer
+	if err = receiver.Receive(&received); err != nil {
+		t.Fatalf("Error receiving: %v", err)
+	}
+	receiver.Dally()
+	if err = <-sent; err != nil {
+		t.Fatalf("Error sending: %v", err)
+	}
+	return sender, receiver, received.Bytes()
+}
+
+func TestTransferOptions(t *testing.T) {
+	content := make([]byte, 50000)
+	rand.New(rand.NewSource(1)).Read(content)
+
+	for _, options := range []Options{
+		{},
+		{BlockSize: 1428},
+		{WindowSize: 8},
+		{BlockSize: 1000, WindowSize: 5}, // 50 full blocks and an empty one
+	} {
+		sender, receiver, received := transferOver(t, netsim.Config{Seed: 1, Loss: 0.05}, options, content)
+		if !bytes.Equal(received, content) {
+			t.Errorf("%+v: expected %d bytes, got %d different ones", options, len(content), len(received))
+		}
+
+		blocks := len(content)/options.blockSize() + 1
+		if sender.Stats.Blocks != blocks || receiver.Stats.Blocks != blocks || receiver.Stats.Bytes != int64(len(content)) {
+			t.Errorf("%+v: expected %d blocks, got %+v and %+v", options, blocks, sender.Stats, receiver.Stats)
+		}
+	}
+}
+
+func TestTransferRollover(t *testing.T) {
+	// more than 65535 blocks, the block numbers start over at 0
+	content := bytes.Repeat([]byte("rollover"), 70000)
+	_, receiver, received := transferOver(t, netsim.Config{}, Options{BlockSize: MinBlockSize, WindowSize: 16}, content)
+	if !bytes.Equal(received, content) {
+		t.Errorf("Expected %d bytes, got %d different ones", len(content), len(received))
+	}
+	if receiver.Stats.Blocks != 70001 {
+		t.Errorf("Expected 70001 blocks, got %d", receiver.Stats.Blocks)
+	}
+}
+
+// fakeConn is the socket of a peer that answers instantly, without a network in between. It implements
+// the UDP methods the transfers use, so the benchmarks measure the allocations of the transfers alone.
+type fakeConn struct {
+	peer  netip.AddrPort
+	reply func(buf []byte) int // writes the next packet of the peer into buf
+	sent  func(packet []byte)  // receives the packets sent to the peer
+}
+
+var fakePeer = netip.MustParseAddrPort("192.0.2.1:69")
+
+func (c *fakeConn) ReadFromUDPAddrPort(b []byte) (int, netip.AddrPort, error) {
+	return c.reply(b), c.peer, nil
+}
+
+func (c *fakeConn) WriteToUDPAddrPort(b []byte, addr netip.AddrPort) (int, error) {
+	c.sent(b)
+	return len(b), nil
+}
+
+func (c *fakeConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.ReadFromUDPAddrPort(b)
+	return n, net.UDPAddrFromAddrPort(addr), err
+}
+
+func (c *fakeConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return c.WriteToUDPAddrPort(b, c.peer)
+}
+
+func (c *fakeConn) Close() error                       { return nil }
+func (c *fakeConn) LocalAddr() net.Addr                { return &net.UDPAddr{} }
+func (c *fakeConn) SetDeadline(t time.Time) error      { return nil }
+func (c *fakeConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *fakeConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// zeros is an endless reader of zero bytes.
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}